@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/cf"
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/config"
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/metrics"
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/server"
+	"github.com/rs/zerolog/log"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, p provider.CloudflareTunnelProvider, args []string) error
+	// provision creates the tunnel by name and writes its token, the other
+	// commands only look it up
+	provision bool
+	// tunnelOptional runs the command even if the tunnel does not exist
+	tunnelOptional bool
+}
+
+var commands = map[string]command{
+	"serve":   {usage: "serve", run: serve, provision: true},
+	"plan":    {usage: "plan <changes file>|-", run: planChanges},
+	"records": {usage: "records", run: records},
+	"rules":   {usage: "rules", run: rules},
+	"analyse": {usage: "analyse", run: analyse},
+	"doctor":  {usage: "doctor", run: doctor, tunnelOptional: true},
+	"backup":  {usage: "backup [file]", run: backup},
+	"restore": {usage: "restore <file>|-", run: restore},
+	"gc":      {usage: "gc", run: gc},
+	"migrate": {usage: "migrate <target tunnel id>|resume|rollback|status", run: migrate},
+}
+
+// commandUsage lists the usage of every command
+func commandUsage() string {
+	usages := make([]string, 0, len(commands))
+	for _, command := range commands {
+		usages = append(usages, command.usage)
+	}
+
+	sort.Strings(usages)
+	return strings.Join(usages, "\n")
+}
+
+func printJSON(v any) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// openArg opens the file named by the argument, or stdin if it is -
+func openArg(args []string, usage string) (io.ReadCloser, error) {
+	if len(args) == 0 || args[0] == "" {
+		return nil, fmt.Errorf("usage: %s", usage)
+	}
+
+	if args[0] == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+
+	return os.Open(args[0])
+}
+
+// serve runs the webhook server until interrupted
+func serve(ctx context.Context, p provider.CloudflareTunnelProvider, args []string) error {
+	if config.Values.StartupCheck {
+		report := p.Doctor(ctx)
+		for _, check := range report {
+			log.Info().Str("check", check.Name).Bool("passed", check.Passed).Str("detail", check.Detail).Send()
+		}
+
+		if !report.Passed() {
+			return fmt.Errorf("startup check failed")
+		}
+	}
+
+	ctx, cancel := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	reloadable := provider.NewReloadableProvider(p)
+	settings := atomic.Pointer[config.Settings]{}
+	settings.Store(&config.Values)
+
+	if files := config.Values.WatchedFiles(); len(files) > 0 {
+		if err := config.Watch(ctx, files, func() { reload(reloadable, &settings) }); err != nil {
+			return err
+		}
+
+		log.Info().Strs("files", files).Msg("watching files for changes")
+	}
+
+	socketMode, err := config.Values.SocketMode()
+	if err != nil {
+		return err
+	}
+
+	opts := server.Options{
+		ListenAddress:       config.Values.ListenAddress,
+		Port:                config.Values.Port,
+		UnixSocket:          config.Values.UnixSocket,
+		UnixSocketMode:      socketMode,
+		HealthListenAddress: config.Values.HealthListenAddress,
+		HealthPort:          config.Values.HealthPort,
+		DebugEnabled:        config.Values.DebugEnabled,
+		ReadTimeout:         config.Values.ReadTimeout,
+		WriteTimeout:        config.Values.WriteTimeout,
+		TunnelTokenSecret:   func() string { return settings.Load().TunnelTokenSecret },
+		MigrationEnabled:    config.Values.MigrationEnabled,
+		AuthMode:            config.Values.AuthMode,
+		AuthSecret:          func() string { return settings.Load().AuthSecret },
+		TLSCertFile:         config.Values.TLSCertFile,
+		TLSKeyFile:          config.Values.TLSKeyFile,
+		TLSClientCAFile:     config.Values.TLSClientCAFile,
+		TLSMinVersion:       config.Values.TLSMinVersion,
+		TLSCipherSuites:     config.Values.TLSCipherSuites,
+	}
+
+	webhookServer, err := server.NewServer(reloadable, opts)
+	if err != nil {
+		return fmt.Errorf("failed to create server: %w", err)
+	}
+
+	// requests are only interrupted once the shutdown timeout is exceeded
+	requests, interrupt := context.WithCancelCause(context.Background())
+	defer interrupt(nil)
+	webhookServer.BaseContext = func(net.Listener) context.Context { return requests }
+	reloadable.Background = requests
+
+	listener, err := server.Listen(opts)
+	if err != nil {
+		return err
+	}
+
+	var healthServer *http.Server
+	if opts.HealthPort != 0 {
+		healthListener, err := server.ListenHealth(opts)
+		if err != nil {
+			_ = listener.Close()
+			return err
+		}
+
+		healthServer = server.NewHealthServer(reloadable, opts)
+		log.Info().Str("address", healthListener.Addr().String()).Msg("listening for health checks")
+		go func() {
+			if err := healthServer.Serve(healthListener); err != nil && err != http.ErrServerClosed {
+				log.Error().Err(fmt.Errorf("failed to start health server: %w", err)).Send()
+				cancel()
+			}
+		}()
+	}
+
+	log.Info().Str("address", listener.Addr().String()).Msg("listening")
+	go func() {
+		if err := server.Serve(webhookServer, listener); err != nil && err != http.ErrServerClosed {
+			log.Error().Err(fmt.Errorf("failed to start server: %w", err)).Send()
+			cancel()
+		}
+	}()
+
+	<-ctx.Done()
+	log.Info().Dur("timeout", config.Values.ShutdownTimeout).Msg("shutting down server")
+
+	if healthServer != nil {
+		defer func() {
+			if err := healthServer.Close(); err != nil {
+				log.Error().Err(fmt.Errorf("failed to close health server: %w", err)).Send()
+			}
+		}()
+	}
+
+	return shutdown(webhookServer, reloadable, interrupt, config.Values.ShutdownTimeout)
+}
+
+// shutdown stops accepting requests and waits up to the timeout for those in
+// progress, then interrupts the remaining applies and waits for them to roll
+// back
+func shutdown(s *http.Server, r *provider.ReloadableProvider, interrupt context.CancelCauseFunc, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := s.Shutdown(ctx)
+	if err == nil || err == http.ErrServerClosed {
+		// migrations run in the background after their request completed
+		if err := r.Drain(ctx); err == nil {
+			return nil
+		}
+	}
+
+	for _, changes := range r.InFlight() {
+		log.Warn().
+			Int("create", len(changes.Create)).
+			Int("update", len(changes.UpdateNew)).
+			Int("delete", len(changes.Delete)).
+			Strs("hostnames", changedHostnames(changes)).
+			Msg("interrupting apply in progress")
+	}
+
+	if migrations := r.InFlightMigrations(); migrations > 0 {
+		log.Warn().Int("migrations", migrations).Msg("interrupting migration in progress, resume or roll it back from its checkpoint")
+	}
+
+	interrupt(fmt.Errorf("shutdown timeout of %s exceeded", timeout))
+
+	ctx, cancel = context.WithTimeout(context.Background(), provider.RollbackTimeout)
+	defer cancel()
+
+	if err := r.Drain(ctx); err != nil {
+		return fmt.Errorf("failed to shutdown server: %w", err)
+	}
+
+	_ = s.Close()
+	return nil
+}
+
+// changedHostnames returns the hostnames of the changes
+func changedHostnames(changes *plan.Changes) []string {
+	hostnames := []string{}
+	for _, endpoints := range [][]*endpoint.Endpoint{changes.Create, changes.UpdateNew, changes.Delete} {
+		for _, e := range endpoints {
+			hostnames = append(hostnames, e.DNSName)
+		}
+	}
+
+	sort.Strings(hostnames)
+	return hostnames
+}
+
+// reload replaces the provider with one created from the reloaded config and
+// credentials, keeping the current provider if they are invalid. Settings of
+// the server and tunnel only take effect on restart, except its secrets
+func reload(r *provider.ReloadableProvider, current *atomic.Pointer[config.Settings]) {
+	settings, err := config.Reload()
+	if err != nil {
+		metrics.ConfigReloads.WithLabelValues("failure").Inc()
+		log.Error().Err(err).Msg("keeping the current config")
+		return
+	}
+
+	client, err := cf.NewCloudflareClient(settings.CloudflareAPIEmail, settings.CloudflareAPIKey, settings.CloudflareAPIToken)
+	if err != nil {
+		metrics.ConfigReloads.WithLabelValues("failure").Inc()
+		log.Error().Err(fmt.Errorf("failed to create cloudflare client: %w", err)).Msg("keeping the current config")
+		return
+	}
+
+	next, err := newProvider(*settings, client, r.Load().CloudflareTunnelID)
+	if err != nil {
+		metrics.ConfigReloads.WithLabelValues("failure").Inc()
+		log.Error().Err(fmt.Errorf("failed to create provider: %w", err)).Msg("keeping the current config")
+		return
+	}
+
+	r.Store(next)
+	current.Store(settings)
+	metrics.ConfigReloads.WithLabelValues("success").Inc()
+	log.Info().Msg("reloaded config")
+}
+
+// planChanges prints the changes which applying the external-dns changes in
+// the file would make, without making them
+func planChanges(ctx context.Context, p provider.CloudflareTunnelProvider, args []string) error {
+	file, err := openArg(args, "plan <changes file>|-")
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	var changes plan.Changes
+	if err := json.NewDecoder(file).Decode(&changes); err != nil {
+		return fmt.Errorf("failed to decode changes: %w", err)
+	}
+
+	applyPlan, err := p.Plan(ctx, &changes)
+	if err != nil {
+		return fmt.Errorf("failed to plan changes: %w", err)
+	}
+
+	return applyPlan.Print(os.Stdout)
+}
+
+// records prints the endpoints reported to external-dns
+func records(ctx context.Context, p provider.CloudflareTunnelProvider, args []string) error {
+	endpoints, err := p.Records(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get records: %w", err)
+	}
+
+	return printJSON(endpoints)
+}
+
+// rules prints the ingress rules of the tunnel
+func rules(ctx context.Context, p provider.CloudflareTunnelProvider, args []string) error {
+	backup, err := p.Backup(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get rules: %w", err)
+	}
+
+	return printJSON(backup.Rules)
+}
+
+// analyse prints the shadowed rules of the live tunnel configuration, failing
+// if there are any
+func analyse(ctx context.Context, p provider.CloudflareTunnelProvider, args []string) error {
+	shadows, err := p.AnalyseRules(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to analyse rules: %w", err)
+	}
+
+	if err := printJSON(shadows); err != nil {
+		return fmt.Errorf("failed to encode shadowed rules: %w", err)
+	}
+
+	if len(shadows) > 0 {
+		return fmt.Errorf("found %d shadowed rules", len(shadows))
+	}
+
+	return nil
+}
+
+// doctor prints the outcome of checking the credentials, failing if any check
+// failed
+func doctor(ctx context.Context, p provider.CloudflareTunnelProvider, args []string) error {
+	report := p.Doctor(ctx)
+	if err := report.Print(os.Stdout); err != nil {
+		return fmt.Errorf("failed to print doctor report: %w", err)
+	}
+
+	if !report.Passed() {
+		return fmt.Errorf("doctor checks failed")
+	}
+
+	return nil
+}
+
+// backup writes a snapshot of the ingress rules to the file, or stdout
+func backup(ctx context.Context, p provider.CloudflareTunnelProvider, args []string) error {
+	backup, err := p.Backup(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to back up tunnel: %w", err)
+	}
+
+	if len(args) == 0 || args[0] == "-" {
+		return printJSON(backup)
+	}
+
+	raw, err := json.MarshalIndent(backup, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode backup: %w", err)
+	}
+
+	if err := os.WriteFile(args[0], raw, 0o600); err != nil {
+		return fmt.Errorf("failed to write backup to %s: %w", args[0], err)
+	}
+
+	log.Info().Str("path", args[0]).Int("rules", len(backup.Rules)).Msg("wrote backup")
+	return nil
+}
+
+// restore replaces the ingress rules with those of the backup in the file,
+// printing the changes
+func restore(ctx context.Context, p provider.CloudflareTunnelProvider, args []string) error {
+	file, err := openArg(args, "restore <file>|-")
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	backup, err := provider.ReadBackup(file)
+	if err != nil {
+		return err
+	}
+
+	applyPlan, err := p.Restore(ctx, *backup)
+	if err != nil {
+		return err
+	}
+
+	return applyPlan.Print(os.Stdout)
+}
+
+// gc deletes the records and access applications left without an ingress
+// rule, printing the changes
+func gc(ctx context.Context, p provider.CloudflareTunnelProvider, args []string) error {
+	applyPlan, err := p.GC(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to collect garbage: %w", err)
+	}
+
+	return applyPlan.Print(os.Stdout)
+}
+
+// migrate moves the hostnames of the tunnel to the target tunnel, or resumes,
+// rolls back or prints the status of the last migration, printing the
+// checkpoint
+func migrate(ctx context.Context, p provider.CloudflareTunnelProvider, args []string) error {
+	if len(args) == 0 || args[0] == "" {
+		return fmt.Errorf("usage: migrate <target tunnel id>|resume|rollback|status")
+	}
+
+	var checkpoint *provider.MigrationCheckpoint
+	var err error
+	switch args[0] {
+	case "resume":
+		checkpoint, err = p.ResumeMigration(ctx)
+	case "rollback":
+		checkpoint, err = p.RollbackMigration(ctx)
+	case "status":
+		checkpoint, err = p.MigrationStatus(ctx)
+	default:
+		checkpoint, err = p.MigrateTunnel(ctx, args[0])
+	}
+
+	if checkpoint != nil {
+		if err := printJSON(checkpoint); err != nil {
+			log.Error().Err(fmt.Errorf("failed to encode migration checkpoint: %w", err)).Send()
+		}
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to migrate tunnel: %w", err)
+	}
+
+	return nil
+}
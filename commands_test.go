@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/config"
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	t.Setenv("CLOUDFLARE_ACCOUNT_ID", "account123")
+	t.Setenv("CLOUDFLARE_TUNNEL_ID", "tunnel123")
+	t.Setenv("DRY_RUN", "false")
+
+	osArgs := os.Args
+	t.Cleanup(func() { os.Args = osArgs })
+	os.Args = []string{"webhook"}
+
+	previous := &config.Settings{DryRun: true}
+	current := atomic.Pointer[config.Settings]{}
+	current.Store(previous)
+	r := provider.NewReloadableProvider(provider.CloudflareTunnelProvider{CloudflareTunnelID: "tunnel123", DryRun: true})
+
+	// the credential file is missing
+	t.Setenv("CLOUDFLARE_API_TOKEN_FILE", filepath.Join(t.TempDir(), "token"))
+	reload(r, &current)
+	assert.True(t, r.Load().DryRun)
+	assert.Same(t, previous, current.Load())
+
+	// the provider cannot be created
+	os.Unsetenv("CLOUDFLARE_API_TOKEN_FILE")
+	t.Setenv("CLOUDFLARE_API_TOKEN", "token")
+	t.Setenv("SERVICE_TEMPLATES", "example.com={{")
+	reload(r, &current)
+	assert.True(t, r.Load().DryRun)
+	assert.Same(t, previous, current.Load())
+
+	os.Unsetenv("SERVICE_TEMPLATES")
+	reload(r, &current)
+	assert.False(t, r.Load().DryRun)
+	assert.Equal(t, "tunnel123", r.Load().CloudflareTunnelID)
+	assert.NotSame(t, previous, current.Load())
+}
@@ -2,10 +2,9 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
-	"net/http"
 	"os"
-	"os/signal"
 	"runtime"
 	"strings"
 	"time"
@@ -13,7 +12,7 @@ import (
 	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/cf"
 	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/config"
 	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
-	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/server"
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/tracing"
 	"github.com/rs/zerolog/log"
 )
 
@@ -35,66 +34,173 @@ func main() {
 		log.Fatal().Err(err).Fields(build).Send()
 	}
 
-	log.Info().
+	if config.Values.PrintConfig {
+		if err := config.Print(os.Stdout); err != nil {
+			log.Fatal().Err(err).Send()
+		}
+
+		return
+	}
+
+	name := flag.Arg(0)
+	if name == "" {
+		name = "serve"
+	}
+
+	command, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %s, usage: %s [flags] <command>\n\n%s\n", name, os.Args[0], commandUsage())
+		os.Exit(2)
+	}
+
+	// the other commands print their output, so only serve logs the settings
+	settings := log.Debug()
+	if name == "serve" {
+		settings = log.Info()
+	}
+
+	settings.
 		Fields(build).
+		Str("config_file", config.Values.ConfigFile).
 		Str("log_level", config.Values.LogLevel).
 		Str("log_format", config.Values.LogFormat).
 		Str("cloudflare_api_key", strings.Repeat("*", len(config.Values.CloudflareAPIKey))).
 		Str("cloudflare_api_email", strings.Repeat("*", len(config.Values.CloudflareAPIEmail))).
 		Str("cloudflare_api_token", strings.Repeat("*", len(config.Values.CloudflareAPIToken))).
+		Str("cloudflare_api_key_file", config.Values.CloudflareAPIKeyFile).
+		Str("cloudflare_api_token_file", config.Values.CloudflareAPITokenFile).
 		Str("cloudflare_account_id", config.Values.CloudflareAccountID).
 		Str("cloudflare_tunnel_id", config.Values.CloudflareTunnelID).
+		Str("cloudflare_tunnel_name", config.Values.CloudflareTunnelName).
+		Str("tunnel_token_file", config.Values.TunnelTokenFile).
+		Str("tunnel_token_secret", strings.Repeat("*", len(config.Values.TunnelTokenSecret))).
+		Str("tunnel_token_secret_file", config.Values.TunnelTokenSecretFile).
+		Str("listen_address", config.Values.ListenAddress).
 		Int64("port", config.Values.Port).
+		Str("unix_socket", config.Values.UnixSocket).
+		Str("unix_socket_mode", config.Values.UnixSocketMode).
+		Str("health_listen_address", config.Values.HealthListenAddress).
+		Int64("health_port", config.Values.HealthPort).
+		Bool("debug_enabled", config.Values.DebugEnabled).
+		Bool("readiness_require_connectors", config.Values.ReadinessRequireConnectors).
 		Dur("read_timeout", config.Values.ReadTimeout).
 		Dur("write_timeout", config.Values.WriteTimeout).
+		Dur("shutdown_timeout", config.Values.ShutdownTimeout).
 		Bool("dry_run", config.Values.DryRun).
 		Strs("domain_filter", config.Values.DomainFilter).
+		Str("policy", config.Values.Policy).
+		Strs("protected_hostnames", config.Values.ProtectedHostnames).
+		Str("conflict_policy", config.Values.ConflictPolicy).
+		Str("service_default_scheme", config.Values.ServiceDefaultScheme).
+		Int64("service_default_port", config.Values.ServiceDefaultPort).
+		Strs("service_templates", config.Values.ServiceTemplates).
+		Str("shadowed_rules", config.Values.ShadowedRules).
+		Bool("access_enabled", config.Values.AccessEnabled).
+		Str("access_team_name", config.Values.AccessTeamName).
+		Bool("private_networks_enabled", config.Values.PrivateNetworksEnabled).
+		Str("default_virtual_network", config.Values.DefaultVirtualNetwork).
+		Bool("migration_enabled", config.Values.MigrationEnabled).
+		Int64("migration_batch_size", config.Values.MigrationBatchSize).
+		Str("migration_checkpoint_file", config.Values.MigrationCheckpointFile).
+		Str("connector_guard", config.Values.ConnectorGuard).
+		Bool("startup_check", config.Values.StartupCheck).
+		Str("auth_mode", config.Values.AuthMode).
+		Str("auth_secret", strings.Repeat("*", len(config.Values.AuthSecret))).
+		Str("auth_secret_file", config.Values.AuthSecretFile).
+		Str("tls_cert_file", config.Values.TLSCertFile).
+		Str("tls_key_file", config.Values.TLSKeyFile).
+		Str("tls_client_ca_file", config.Values.TLSClientCAFile).
+		Str("tls_min_version", config.Values.TLSMinVersion).
+		Strs("tls_cipher_suites", config.Values.TLSCipherSuites).
+		Str("tracing_exporter", config.Values.TracingExporter).
 		Send()
 
+	shutdownTracing, err := tracing.Setup(context.Background(), config.Values.TracingExporter)
+	if err != nil {
+		log.Fatal().Err(fmt.Errorf("failed to set up tracing: %w", err)).Send()
+	}
+
 	client, err := cf.NewCloudflareClient(config.Values.CloudflareAPIEmail, config.Values.CloudflareAPIKey, config.Values.CloudflareAPIToken)
 	if err != nil {
 		log.Fatal().Err(fmt.Errorf("failed to create cloudflare client: %w", err)).Send()
 	}
 
-	provider := provider.CloudflareTunnelProvider{
-		Cloudflare:          client,
-		CloudflareAccountID: config.Values.CloudflareAccountID,
-		CloudflareTunnelID:  config.Values.CloudflareTunnelID,
-		DryRun:              config.Values.DryRun,
-		DomainFilter:        config.Values.DomainFilter,
+	// only serve provisions the tunnel, the other commands look it up
+	tunnelID := config.Values.CloudflareTunnelID
+	if config.Values.CloudflareTunnelName != "" && command.provision {
+		tunnelID, err = provider.ProvisionTunnel(context.Background(), client, config.Values.CloudflareAccountID, config.Values.CloudflareTunnelName)
+		if err != nil {
+			log.Fatal().Err(fmt.Errorf("failed to provision tunnel: %w", err)).Send()
+		}
+	} else if config.Values.CloudflareTunnelName != "" {
+		tunnel, err := provider.FindTunnel(context.Background(), client, config.Values.CloudflareAccountID, config.Values.CloudflareTunnelName)
+		if err != nil {
+			log.Fatal().Err(fmt.Errorf("failed to find tunnel: %w", err)).Send()
+		}
+
+		if tunnel != nil {
+			tunnelID = tunnel.ID
+		}
+	}
+
+	if config.Values.TunnelTokenFile != "" && command.provision {
+		if err := provider.WriteTunnelToken(context.Background(), client, config.Values.CloudflareAccountID, tunnelID, config.Values.TunnelTokenFile); err != nil {
+			log.Fatal().Err(fmt.Errorf("failed to write tunnel token: %w", err)).Send()
+		}
 	}
 
+	provider, err := newProvider(config.Values, client, tunnelID)
 	if err != nil {
 		log.Fatal().Err(fmt.Errorf("failed to create provider: %w", err)).Send()
 	}
 
-	server := server.NewServer(config.Values.Port, provider, config.Values.ReadTimeout, config.Values.WriteTimeout)
-
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
-	defer cancel()
-
-	go func() {
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Error().Err(fmt.Errorf("failed to start server: %w", err)).Send()
-			cancel()
-		}
-	}()
+	if tunnelID == "" && !command.tunnelOptional {
+		log.Fatal().Err(fmt.Errorf("tunnel %s does not exist", config.Values.CloudflareTunnelName)).Send()
+	}
 
-	<-ctx.Done()
-	log.Info().Msg("shutting down server")
+	runErr := command.run(context.Background(), provider, flag.Args()[min(1, flag.NArg()):])
 
-	ctx, cancel = context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		log.Error().Err(fmt.Errorf("failed to flush traces: %w", err)).Send()
+	}
 
-	go func() {
-		defer cancel()
-		if err := server.Shutdown(ctx); err != nil && err != http.ErrServerClosed {
-			log.Error().Err(fmt.Errorf("failed to shutdown server: %w", err)).Send()
-		}
-	}()
+	if runErr != nil {
+		log.Fatal().Err(runErr).Send()
+	}
+}
 
-	<-ctx.Done()
-	if err := ctx.Err(); err != nil && err != context.Canceled {
-		log.Error().Err(fmt.Errorf("failed to shutdown server: %w", err)).Send()
+// newProvider creates the provider for the tunnel from the settings
+func newProvider(settings config.Settings, client cf.Cloudflare, tunnelID string) (provider.CloudflareTunnelProvider, error) {
+	serviceTemplates, err := provider.ParseServiceTemplates(settings.ServiceTemplates)
+	if err != nil {
+		return provider.CloudflareTunnelProvider{}, fmt.Errorf("failed to parse service templates: %w", err)
 	}
+
+	return provider.CloudflareTunnelProvider{
+		Cloudflare:          client,
+		CloudflareAccountID: settings.CloudflareAccountID,
+		CloudflareTunnelID:  tunnelID,
+		DryRun:              settings.DryRun,
+		DomainFilter:        settings.DomainFilter,
+		Policy:              provider.Policy(settings.Policy),
+		ProtectedHostnames:  settings.ProtectedHostnames,
+		ConflictPolicy:      provider.ConflictPolicy(settings.ConflictPolicy),
+		ServiceInference: provider.ServiceInference{
+			DefaultScheme: settings.ServiceDefaultScheme,
+			DefaultPort:   settings.ServiceDefaultPort,
+			Templates:     serviceTemplates,
+		},
+		ShadowedRules:              provider.ShadowedRulesMode(settings.ShadowedRules),
+		AccessEnabled:              settings.AccessEnabled,
+		AccessTeamName:             settings.AccessTeamName,
+		PrivateNetworksEnabled:     settings.PrivateNetworksEnabled,
+		DefaultVirtualNetwork:      settings.DefaultVirtualNetwork,
+		MigrationBatchSize:         int(settings.MigrationBatchSize),
+		MigrationCheckpointFile:    settings.MigrationCheckpointFile,
+		ConnectorGuard:             provider.ConnectorGuard(settings.ConnectorGuard),
+		ReadinessRequireConnectors: settings.ReadinessRequireConnectors,
+		HealthCache:                provider.NewHealthCache(provider.HealthCacheTTL),
+	}, nil
 }
@@ -18,9 +18,22 @@ func (l cloudflareLogger) Printf(format string, v ...any) {
 }
 
 type Cloudflare interface {
+	// VerifyToken returns the status of the api token, or nil when
+	// authenticating with an api key
+	VerifyToken(ctx context.Context) (*cloudflare.APITokenVerifyBody, error)
+	// GetTokenPolicies returns the policies of the api token, which requires
+	// the token to have permission to read api tokens
+	GetTokenPolicies(ctx context.Context, tokenID string) ([]cloudflare.APITokenPolicies, error)
+
 	GetTunnelConfiguration(ctx context.Context, accountID, tunnelID string) (*cloudflare.TunnelConfigurationResult, error)
 	UpdateTunnelIngress(ctx context.Context, accountID, tunnelID string, ingress []cloudflare.UnvalidatedIngressRule) error
 
+	GetTunnel(ctx context.Context, accountID, tunnelID string) (*cloudflare.Tunnel, error)
+	ListTunnelConnections(ctx context.Context, accountID, tunnelID string) ([]cloudflare.Connection, error)
+	ListTunnelsByName(ctx context.Context, accountID, name string) ([]cloudflare.Tunnel, error)
+	CreateTunnel(ctx context.Context, accountID string, params cloudflare.TunnelCreateParams) (*cloudflare.Tunnel, error)
+	GetTunnelToken(ctx context.Context, accountID, tunnelID string) (string, error)
+
 	ListZones(ctx context.Context) ([]cloudflare.Zone, error)
 	ListAllZoneRecords(ctx context.Context) ([]cloudflare.DNSRecord, error)
 	ListZoneRecords(ctx context.Context, zoneID string) ([]cloudflare.DNSRecord, error)
@@ -28,6 +41,22 @@ type Cloudflare interface {
 	CreateDNSRecord(ctx context.Context, record cloudflare.DNSRecord) error
 	DeleteDNSRecord(ctx context.Context, zoneID, recordID string) error
 	UpdateDNSRecord(ctx context.Context, record cloudflare.DNSRecord) error
+
+	ListAccessApplications(ctx context.Context, accountID string) ([]cloudflare.AccessApplication, error)
+	CreateAccessApplication(ctx context.Context, accountID string, params cloudflare.CreateAccessApplicationParams) (*cloudflare.AccessApplication, error)
+	UpdateAccessApplication(ctx context.Context, accountID string, params cloudflare.UpdateAccessApplicationParams) (*cloudflare.AccessApplication, error)
+	DeleteAccessApplication(ctx context.Context, accountID, applicationID string) error
+
+	ListAccessPolicies(ctx context.Context, accountID, applicationID string) ([]cloudflare.AccessPolicy, error)
+	CreateAccessPolicy(ctx context.Context, accountID string, params cloudflare.CreateAccessPolicyParams) error
+	UpdateAccessPolicy(ctx context.Context, accountID string, params cloudflare.UpdateAccessPolicyParams) error
+
+	// ListTunnelRoutes lists the routes through the tunnel, or through every
+	// tunnel of the account if the tunnel id is empty
+	ListTunnelRoutes(ctx context.Context, accountID, tunnelID string) ([]cloudflare.TunnelRoute, error)
+	CreateTunnelRoute(ctx context.Context, accountID string, params cloudflare.TunnelRoutesCreateParams) error
+	DeleteTunnelRoute(ctx context.Context, accountID string, params cloudflare.TunnelRoutesDeleteParams) error
+	ListVirtualNetworks(ctx context.Context, accountID string) ([]cloudflare.TunnelVirtualNetwork, error)
 }
 
 func NewCloudflareClient(email, key, token string) (Cloudflare, error) {
@@ -47,6 +76,7 @@ func NewCloudflareClient(email, key, token string) (Cloudflare, error) {
 
 	var err error
 	if token != "" {
+		client.usingToken = true
 		client.api, err = cloudflare.NewWithAPIToken(token, options...)
 	} else {
 		client.api, err = cloudflare.New(key, email, options...)
@@ -56,10 +86,37 @@ func NewCloudflareClient(email, key, token string) (Cloudflare, error) {
 		return nil, fmt.Errorf("failed to create cloudflare client: %w", err)
 	}
 
-	return &client, nil
+	return WithTracing(&client), nil
 }
 
-type clientImpl struct{ api *cloudflare.API }
+type clientImpl struct {
+	api        *cloudflare.API
+	usingToken bool
+}
+
+func (p clientImpl) VerifyToken(ctx context.Context) (*cloudflare.APITokenVerifyBody, error) {
+	if !p.usingToken {
+		return nil, nil
+	}
+
+	token, err := p.api.VerifyAPIToken(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to verify api token: %w", err)
+	}
+
+	log.Debug().Str("token_id", token.ID).Str("token_status", token.Status).Send()
+	return &token, nil
+}
+
+func (p clientImpl) GetTokenPolicies(ctx context.Context, tokenID string) ([]cloudflare.APITokenPolicies, error) {
+	token, err := p.api.GetAPIToken(ctx, tokenID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get api token: %w", err)
+	}
+
+	log.Debug().Str("token_id", token.ID).Int("policies", len(token.Policies)).Send()
+	return token.Policies, nil
+}
 
 func (p clientImpl) GetTunnelConfiguration(ctx context.Context, accountID, tunnelID string) (*cloudflare.TunnelConfigurationResult, error) {
 	rc := cloudflare.ResourceIdentifier(accountID)
@@ -99,6 +156,61 @@ func (p clientImpl) UpdateTunnelIngress(ctx context.Context, accountID, tunnelID
 	return nil
 }
 
+func (p clientImpl) GetTunnel(ctx context.Context, accountID, tunnelID string) (*cloudflare.Tunnel, error) {
+	rc := cloudflare.AccountIdentifier(accountID)
+	tunnel, err := p.api.GetTunnel(ctx, rc, tunnelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tunnel %s: %w", tunnelID, err)
+	}
+
+	log.Debug().Str("tunnel_id", tunnel.ID).Str("tunnel_status", tunnel.Status).Send()
+	return &tunnel, nil
+}
+
+func (p clientImpl) ListTunnelConnections(ctx context.Context, accountID, tunnelID string) ([]cloudflare.Connection, error) {
+	rc := cloudflare.AccountIdentifier(accountID)
+	connections, err := p.api.ListTunnelConnections(ctx, rc, tunnelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tunnel connections: %w", err)
+	}
+
+	log.Debug().Any("tunnel_connections", connections).Send()
+	return connections, nil
+}
+
+func (p clientImpl) ListTunnelsByName(ctx context.Context, accountID, name string) ([]cloudflare.Tunnel, error) {
+	rc := cloudflare.AccountIdentifier(accountID)
+	isDeleted := false
+	tunnels, _, err := p.api.ListTunnels(ctx, rc, cloudflare.TunnelListParams{Name: name, IsDeleted: &isDeleted})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tunnels named %s: %w", name, err)
+	}
+
+	log.Debug().Any("tunnels", tunnels).Send()
+	return tunnels, nil
+}
+
+func (p clientImpl) CreateTunnel(ctx context.Context, accountID string, params cloudflare.TunnelCreateParams) (*cloudflare.Tunnel, error) {
+	rc := cloudflare.AccountIdentifier(accountID)
+	tunnel, err := p.api.CreateTunnel(ctx, rc, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tunnel %s: %w", params.Name, err)
+	}
+
+	log.Debug().Str("created_tunnel_id", tunnel.ID).Str("created_tunnel_name", tunnel.Name).Send()
+	return &tunnel, nil
+}
+
+func (p clientImpl) GetTunnelToken(ctx context.Context, accountID, tunnelID string) (string, error) {
+	rc := cloudflare.AccountIdentifier(accountID)
+	token, err := p.api.GetTunnelToken(ctx, rc, tunnelID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get tunnel token: %w", err)
+	}
+
+	return token, nil
+}
+
 func (p clientImpl) ListZones(ctx context.Context) ([]cloudflare.Zone, error) {
 	zones, err := p.api.ListZones(ctx)
 	if err != nil {
@@ -189,3 +301,128 @@ func (p clientImpl) UpdateDNSRecord(ctx context.Context, record cloudflare.DNSRe
 	log.Debug().Any("updated_record", record).Send()
 	return nil
 }
+
+func (p clientImpl) ListAccessApplications(ctx context.Context, accountID string) ([]cloudflare.AccessApplication, error) {
+	rc := cloudflare.AccountIdentifier(accountID)
+	applications, _, err := p.api.ListAccessApplications(ctx, rc, cloudflare.ListAccessApplicationsParams{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list access applications: %w", err)
+	}
+
+	log.Debug().Any("access_applications", applications).Send()
+	return applications, nil
+}
+
+func (p clientImpl) CreateAccessApplication(ctx context.Context, accountID string, params cloudflare.CreateAccessApplicationParams) (*cloudflare.AccessApplication, error) {
+	rc := cloudflare.AccountIdentifier(accountID)
+	application, err := p.api.CreateAccessApplication(ctx, rc, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create access application %s: %w", params.Name, err)
+	}
+
+	log.Debug().Any("created_access_application", application).Send()
+	return &application, nil
+}
+
+func (p clientImpl) UpdateAccessApplication(ctx context.Context, accountID string, params cloudflare.UpdateAccessApplicationParams) (*cloudflare.AccessApplication, error) {
+	rc := cloudflare.AccountIdentifier(accountID)
+	application, err := p.api.UpdateAccessApplication(ctx, rc, params)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update access application %s: %w", params.ID, err)
+	}
+
+	log.Debug().Any("updated_access_application", application).Send()
+	return &application, nil
+}
+
+func (p clientImpl) DeleteAccessApplication(ctx context.Context, accountID, applicationID string) error {
+	rc := cloudflare.AccountIdentifier(accountID)
+	if err := p.api.DeleteAccessApplication(ctx, rc, applicationID); err != nil {
+		return fmt.Errorf("failed to delete access application %s: %w", applicationID, err)
+	}
+
+	log.Debug().Str("deleted_access_application_id", applicationID).Send()
+	return nil
+}
+
+func (p clientImpl) ListAccessPolicies(ctx context.Context, accountID, applicationID string) ([]cloudflare.AccessPolicy, error) {
+	rc := cloudflare.AccountIdentifier(accountID)
+	policies, _, err := p.api.ListAccessPolicies(ctx, rc, cloudflare.ListAccessPoliciesParams{ApplicationID: applicationID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list access policies for application %s: %w", applicationID, err)
+	}
+
+	log.Debug().Any("access_policies", policies).Send()
+	return policies, nil
+}
+
+func (p clientImpl) CreateAccessPolicy(ctx context.Context, accountID string, params cloudflare.CreateAccessPolicyParams) error {
+	rc := cloudflare.AccountIdentifier(accountID)
+	policy, err := p.api.CreateAccessPolicy(ctx, rc, params)
+	if err != nil {
+		return fmt.Errorf("failed to create access policy %s: %w", params.Name, err)
+	}
+
+	log.Debug().Any("created_access_policy", policy).Send()
+	return nil
+}
+
+func (p clientImpl) UpdateAccessPolicy(ctx context.Context, accountID string, params cloudflare.UpdateAccessPolicyParams) error {
+	rc := cloudflare.AccountIdentifier(accountID)
+	policy, err := p.api.UpdateAccessPolicy(ctx, rc, params)
+	if err != nil {
+		return fmt.Errorf("failed to update access policy %s: %w", params.PolicyID, err)
+	}
+
+	log.Debug().Any("updated_access_policy", policy).Send()
+	return nil
+}
+
+func (p clientImpl) ListTunnelRoutes(ctx context.Context, accountID, tunnelID string) ([]cloudflare.TunnelRoute, error) {
+	rc := cloudflare.AccountIdentifier(accountID)
+	isDeleted := false
+	routes, err := p.api.ListTunnelRoutes(ctx, rc, cloudflare.TunnelRoutesListParams{
+		TunnelID:          tunnelID,
+		IsDeleted:         &isDeleted,
+		PaginationOptions: cloudflare.PaginationOptions{PerPage: 1000},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tunnel routes: %w", err)
+	}
+
+	log.Debug().Any("tunnel_routes", routes).Send()
+	return routes, nil
+}
+
+func (p clientImpl) CreateTunnelRoute(ctx context.Context, accountID string, params cloudflare.TunnelRoutesCreateParams) error {
+	rc := cloudflare.AccountIdentifier(accountID)
+	route, err := p.api.CreateTunnelRoute(ctx, rc, params)
+	if err != nil {
+		return fmt.Errorf("failed to create tunnel route %s: %w", params.Network, err)
+	}
+
+	log.Debug().Any("created_tunnel_route", route).Send()
+	return nil
+}
+
+func (p clientImpl) DeleteTunnelRoute(ctx context.Context, accountID string, params cloudflare.TunnelRoutesDeleteParams) error {
+	rc := cloudflare.AccountIdentifier(accountID)
+	if err := p.api.DeleteTunnelRoute(ctx, rc, params); err != nil {
+		return fmt.Errorf("failed to delete tunnel route %s: %w", params.Network, err)
+	}
+
+	log.Debug().Str("deleted_tunnel_route", params.Network).Send()
+	return nil
+}
+
+func (p clientImpl) ListVirtualNetworks(ctx context.Context, accountID string) ([]cloudflare.TunnelVirtualNetwork, error) {
+	rc := cloudflare.AccountIdentifier(accountID)
+	isDeleted := false
+	networks, err := p.api.ListTunnelVirtualNetworks(ctx, rc, cloudflare.TunnelVirtualNetworksListParams{IsDeleted: &isDeleted})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list virtual networks: %w", err)
+	}
+
+	log.Debug().Any("virtual_networks", networks).Send()
+	return networks, nil
+}
@@ -0,0 +1,203 @@
+package cf
+
+import (
+	"context"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/tracing"
+	"github.com/cloudflare/cloudflare-go"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var _ Cloudflare = tracedClient{}
+
+// tracedClient records a span for each call to the client
+type tracedClient struct {
+	next Cloudflare
+}
+
+// WithTracing records a span for each call to the client
+func WithTracing(client Cloudflare) Cloudflare {
+	return tracedClient{client}
+}
+
+func (c tracedClient) VerifyToken(ctx context.Context) (*cloudflare.APITokenVerifyBody, error) {
+	ctx, span := tracing.Start(ctx, "cf.VerifyToken")
+	result, err := c.next.VerifyToken(ctx)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) GetTokenPolicies(ctx context.Context, tokenID string) ([]cloudflare.APITokenPolicies, error) {
+	ctx, span := tracing.Start(ctx, "cf.GetTokenPolicies", attribute.String("cloudflare.token_id", tokenID))
+	result, err := c.next.GetTokenPolicies(ctx, tokenID)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) GetTunnelConfiguration(ctx context.Context, accountID, tunnelID string) (*cloudflare.TunnelConfigurationResult, error) {
+	ctx, span := tracing.Start(ctx, "cf.GetTunnelConfiguration", attribute.String("cloudflare.account_id", accountID), attribute.String("cloudflare.tunnel_id", tunnelID))
+	result, err := c.next.GetTunnelConfiguration(ctx, accountID, tunnelID)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) UpdateTunnelIngress(ctx context.Context, accountID, tunnelID string, ingress []cloudflare.UnvalidatedIngressRule) error {
+	ctx, span := tracing.Start(ctx, "cf.UpdateTunnelIngress", attribute.String("cloudflare.account_id", accountID), attribute.String("cloudflare.tunnel_id", tunnelID))
+	err := c.next.UpdateTunnelIngress(ctx, accountID, tunnelID, ingress)
+	tracing.End(span, err)
+	return err
+}
+
+func (c tracedClient) GetTunnel(ctx context.Context, accountID, tunnelID string) (*cloudflare.Tunnel, error) {
+	ctx, span := tracing.Start(ctx, "cf.GetTunnel", attribute.String("cloudflare.account_id", accountID), attribute.String("cloudflare.tunnel_id", tunnelID))
+	result, err := c.next.GetTunnel(ctx, accountID, tunnelID)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) ListTunnelConnections(ctx context.Context, accountID, tunnelID string) ([]cloudflare.Connection, error) {
+	ctx, span := tracing.Start(ctx, "cf.ListTunnelConnections", attribute.String("cloudflare.account_id", accountID), attribute.String("cloudflare.tunnel_id", tunnelID))
+	result, err := c.next.ListTunnelConnections(ctx, accountID, tunnelID)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) ListTunnelsByName(ctx context.Context, accountID, name string) ([]cloudflare.Tunnel, error) {
+	ctx, span := tracing.Start(ctx, "cf.ListTunnelsByName", attribute.String("cloudflare.account_id", accountID), attribute.String("cloudflare.tunnel_name", name))
+	result, err := c.next.ListTunnelsByName(ctx, accountID, name)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) CreateTunnel(ctx context.Context, accountID string, params cloudflare.TunnelCreateParams) (*cloudflare.Tunnel, error) {
+	ctx, span := tracing.Start(ctx, "cf.CreateTunnel", attribute.String("cloudflare.account_id", accountID))
+	result, err := c.next.CreateTunnel(ctx, accountID, params)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) GetTunnelToken(ctx context.Context, accountID, tunnelID string) (string, error) {
+	ctx, span := tracing.Start(ctx, "cf.GetTunnelToken", attribute.String("cloudflare.account_id", accountID), attribute.String("cloudflare.tunnel_id", tunnelID))
+	result, err := c.next.GetTunnelToken(ctx, accountID, tunnelID)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) ListZones(ctx context.Context) ([]cloudflare.Zone, error) {
+	ctx, span := tracing.Start(ctx, "cf.ListZones")
+	result, err := c.next.ListZones(ctx)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) ListAllZoneRecords(ctx context.Context) ([]cloudflare.DNSRecord, error) {
+	ctx, span := tracing.Start(ctx, "cf.ListAllZoneRecords")
+	result, err := c.next.ListAllZoneRecords(ctx)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) ListZoneRecords(ctx context.Context, zoneID string) ([]cloudflare.DNSRecord, error) {
+	ctx, span := tracing.Start(ctx, "cf.ListZoneRecords", attribute.String("cloudflare.zone_id", zoneID))
+	result, err := c.next.ListZoneRecords(ctx, zoneID)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) CreateDNSRecord(ctx context.Context, record cloudflare.DNSRecord) error {
+	ctx, span := tracing.Start(ctx, "cf.CreateDNSRecord", attribute.String("cloudflare.zone_id", record.ZoneID), attribute.String("cloudflare.record_name", record.Name))
+	err := c.next.CreateDNSRecord(ctx, record)
+	tracing.End(span, err)
+	return err
+}
+
+func (c tracedClient) DeleteDNSRecord(ctx context.Context, zoneID, recordID string) error {
+	ctx, span := tracing.Start(ctx, "cf.DeleteDNSRecord", attribute.String("cloudflare.zone_id", zoneID), attribute.String("cloudflare.record_id", recordID))
+	err := c.next.DeleteDNSRecord(ctx, zoneID, recordID)
+	tracing.End(span, err)
+	return err
+}
+
+func (c tracedClient) UpdateDNSRecord(ctx context.Context, record cloudflare.DNSRecord) error {
+	ctx, span := tracing.Start(ctx, "cf.UpdateDNSRecord", attribute.String("cloudflare.zone_id", record.ZoneID), attribute.String("cloudflare.record_name", record.Name))
+	err := c.next.UpdateDNSRecord(ctx, record)
+	tracing.End(span, err)
+	return err
+}
+
+func (c tracedClient) ListAccessApplications(ctx context.Context, accountID string) ([]cloudflare.AccessApplication, error) {
+	ctx, span := tracing.Start(ctx, "cf.ListAccessApplications", attribute.String("cloudflare.account_id", accountID))
+	result, err := c.next.ListAccessApplications(ctx, accountID)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) CreateAccessApplication(ctx context.Context, accountID string, params cloudflare.CreateAccessApplicationParams) (*cloudflare.AccessApplication, error) {
+	ctx, span := tracing.Start(ctx, "cf.CreateAccessApplication", attribute.String("cloudflare.account_id", accountID))
+	result, err := c.next.CreateAccessApplication(ctx, accountID, params)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) UpdateAccessApplication(ctx context.Context, accountID string, params cloudflare.UpdateAccessApplicationParams) (*cloudflare.AccessApplication, error) {
+	ctx, span := tracing.Start(ctx, "cf.UpdateAccessApplication", attribute.String("cloudflare.account_id", accountID))
+	result, err := c.next.UpdateAccessApplication(ctx, accountID, params)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) DeleteAccessApplication(ctx context.Context, accountID, applicationID string) error {
+	ctx, span := tracing.Start(ctx, "cf.DeleteAccessApplication", attribute.String("cloudflare.account_id", accountID), attribute.String("cloudflare.application_id", applicationID))
+	err := c.next.DeleteAccessApplication(ctx, accountID, applicationID)
+	tracing.End(span, err)
+	return err
+}
+
+func (c tracedClient) ListAccessPolicies(ctx context.Context, accountID, applicationID string) ([]cloudflare.AccessPolicy, error) {
+	ctx, span := tracing.Start(ctx, "cf.ListAccessPolicies", attribute.String("cloudflare.account_id", accountID), attribute.String("cloudflare.application_id", applicationID))
+	result, err := c.next.ListAccessPolicies(ctx, accountID, applicationID)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) CreateAccessPolicy(ctx context.Context, accountID string, params cloudflare.CreateAccessPolicyParams) error {
+	ctx, span := tracing.Start(ctx, "cf.CreateAccessPolicy", attribute.String("cloudflare.account_id", accountID))
+	err := c.next.CreateAccessPolicy(ctx, accountID, params)
+	tracing.End(span, err)
+	return err
+}
+
+func (c tracedClient) UpdateAccessPolicy(ctx context.Context, accountID string, params cloudflare.UpdateAccessPolicyParams) error {
+	ctx, span := tracing.Start(ctx, "cf.UpdateAccessPolicy", attribute.String("cloudflare.account_id", accountID))
+	err := c.next.UpdateAccessPolicy(ctx, accountID, params)
+	tracing.End(span, err)
+	return err
+}
+
+func (c tracedClient) ListTunnelRoutes(ctx context.Context, accountID, tunnelID string) ([]cloudflare.TunnelRoute, error) {
+	ctx, span := tracing.Start(ctx, "cf.ListTunnelRoutes", attribute.String("cloudflare.account_id", accountID), attribute.String("cloudflare.tunnel_id", tunnelID))
+	result, err := c.next.ListTunnelRoutes(ctx, accountID, tunnelID)
+	tracing.End(span, err)
+	return result, err
+}
+
+func (c tracedClient) CreateTunnelRoute(ctx context.Context, accountID string, params cloudflare.TunnelRoutesCreateParams) error {
+	ctx, span := tracing.Start(ctx, "cf.CreateTunnelRoute", attribute.String("cloudflare.account_id", accountID))
+	err := c.next.CreateTunnelRoute(ctx, accountID, params)
+	tracing.End(span, err)
+	return err
+}
+
+func (c tracedClient) DeleteTunnelRoute(ctx context.Context, accountID string, params cloudflare.TunnelRoutesDeleteParams) error {
+	ctx, span := tracing.Start(ctx, "cf.DeleteTunnelRoute", attribute.String("cloudflare.account_id", accountID))
+	err := c.next.DeleteTunnelRoute(ctx, accountID, params)
+	tracing.End(span, err)
+	return err
+}
+
+func (c tracedClient) ListVirtualNetworks(ctx context.Context, accountID string) ([]cloudflare.TunnelVirtualNetwork, error) {
+	ctx, span := tracing.Start(ctx, "cf.ListVirtualNetworks", attribute.String("cloudflare.account_id", accountID))
+	result, err := c.next.ListVirtualNetworks(ctx, accountID)
+	tracing.End(span, err)
+	return result, err
+}
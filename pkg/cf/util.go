@@ -18,7 +18,7 @@ func RecordMapByName(records []cloudflare.DNSRecord) map[string][]cloudflare.DNS
 			result[record.Name] = []cloudflare.DNSRecord{}
 		}
 
-		result[record.ID] = append(result[record.ID], record)
+		result[record.Name] = append(result[record.Name], record)
 	}
 
 	return result
@@ -1,39 +1,105 @@
 package config
 
 import (
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/axatol/gonfig"
 	"github.com/joho/godotenv"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/rs/zerolog/pkgerrors"
 )
 
-var Values = struct {
+// Settings are the values of the config, from the defaults, config file,
+// environment, flags and credential files in increasing precedence
+type Settings struct {
+	ConfigFile  string `env:"CONFIG_FILE"  flag:"config"       file:"-"`
+	PrintConfig bool   `env:"PRINT_CONFIG" flag:"print-config" file:"-" default:"false"`
+
 	LogLevel  string `env:"LOG_LEVEL"  flag:"log-level"  default:"info"`
 	LogFormat string `env:"LOG_FORMAT" flag:"log-format" default:"json"`
 
-	CloudflareAPIKey    string `env:"CLOUDFLARE_API_KEY"    flag:"cloudflare-api-key"`
-	CloudflareAPIEmail  string `env:"CLOUDFLARE_API_EMAIL"  flag:"cloudflare-api-email"`
-	CloudflareAPIToken  string `env:"CLOUDFLARE_API_TOKEN"  flag:"cloudflare-api-token"`
+	CloudflareAPIKey    string `env:"CLOUDFLARE_API_KEY"    flag:"cloudflare-api-key"    secret:"true"`
+	CloudflareAPIEmail  string `env:"CLOUDFLARE_API_EMAIL"  flag:"cloudflare-api-email"  secret:"true"`
+	CloudflareAPIToken  string `env:"CLOUDFLARE_API_TOKEN"  flag:"cloudflare-api-token"  secret:"true"`
 	CloudflareAccountID string `env:"CLOUDFLARE_ACCOUNT_ID" flag:"cloudflare-account-id" required:"true"`
-	CloudflareTunnelID  string `env:"CLOUDFLARE_TUNNEL_ID"  flag:"cloudflare-tunnel-id"   required:"true"`
+	CloudflareTunnelID  string `env:"CLOUDFLARE_TUNNEL_ID"  flag:"cloudflare-tunnel-id"`
+
+	CloudflareAPIKeyFile   string `env:"CLOUDFLARE_API_KEY_FILE"   flag:"cloudflare-api-key-file"`
+	CloudflareAPIEmailFile string `env:"CLOUDFLARE_API_EMAIL_FILE" flag:"cloudflare-api-email-file"`
+	CloudflareAPITokenFile string `env:"CLOUDFLARE_API_TOKEN_FILE" flag:"cloudflare-api-token-file"`
+
+	CloudflareTunnelName string `env:"CLOUDFLARE_TUNNEL_NAME" flag:"cloudflare-tunnel-name"`
+	TunnelTokenFile      string `env:"TUNNEL_TOKEN_FILE"      flag:"tunnel-token-file"`
+	TunnelTokenSecret    string `env:"TUNNEL_TOKEN_SECRET"    flag:"tunnel-token-secret" secret:"true"`
+
+	TunnelTokenSecretFile string `env:"TUNNEL_TOKEN_SECRET_FILE" flag:"tunnel-token-secret-file"`
+
+	ListenAddress  string `env:"LISTEN_ADDRESS"   flag:"listen-address"`
+	UnixSocket     string `env:"UNIX_SOCKET"      flag:"unix-socket"`
+	UnixSocketMode string `env:"UNIX_SOCKET_MODE" flag:"unix-socket-mode" default:"0660"`
+
+	HealthListenAddress        string `env:"HEALTH_LISTEN_ADDRESS"        flag:"health-listen-address"`
+	HealthPort                 int64  `env:"HEALTH_PORT"                  flag:"health-port"                  default:"8080"`
+	DebugEnabled               bool   `env:"DEBUG_ENABLED"                flag:"debug-enabled"                default:"false"`
+	ReadinessRequireConnectors bool   `env:"READINESS_REQUIRE_CONNECTORS" flag:"readiness-require-connectors" default:"false"`
+
+	Port            int64         `env:"PORT"             flag:"port"             default:"8888"`
+	ReadTimeout     time.Duration `env:"READ_TIMEOUT"     flag:"read-timeout"     default:"5s"`
+	WriteTimeout    time.Duration `env:"WRITE_TIMEOUT"    flag:"write-timeout"    default:"10s"`
+	ShutdownTimeout time.Duration `env:"SHUTDOWN_TIMEOUT" flag:"shutdown-timeout" default:"15s"`
+	DryRun          bool          `env:"DRY_RUN"          flag:"dry-run"          default:"false"`
+	DomainFilter    []string      `env:"DOMAIN_FILTER"    flag:"domain-filter"    delimiter:","`
+	Policy          string        `env:"POLICY"           flag:"policy"           default:"sync" enum:"sync,upsert-only,create-only"`
+
+	ProtectedHostnames []string `env:"PROTECTED_HOSTNAMES" flag:"protected-hostnames" delimiter:","`
+	ConflictPolicy     string   `env:"CONFLICT_POLICY"     flag:"conflict-policy"     default:"adopt" enum:"refuse,adopt,owned"`
+
+	ServiceDefaultScheme string   `env:"SERVICE_DEFAULT_SCHEME" flag:"service-default-scheme" default:"http" enum:"http,https,tcp,ssh,rdp,smb,unix,unix+tls"`
+	ServiceDefaultPort   int64    `env:"SERVICE_DEFAULT_PORT"   flag:"service-default-port"   default:"0"`
+	ServiceTemplates     []string `env:"SERVICE_TEMPLATES"      flag:"service-templates"      delim:";" file:"map"`
+
+	ShadowedRules string `env:"SHADOWED_RULES" flag:"shadowed-rules" default:"warn" enum:"warn,reject"`
+
+	AccessEnabled  bool   `env:"ACCESS_ENABLED"   flag:"access-enabled"   default:"false"`
+	AccessTeamName string `env:"ACCESS_TEAM_NAME" flag:"access-team-name"`
+
+	PrivateNetworksEnabled bool   `env:"PRIVATE_NETWORKS_ENABLED" flag:"private-networks-enabled" default:"false"`
+	DefaultVirtualNetwork  string `env:"DEFAULT_VIRTUAL_NETWORK"  flag:"default-virtual-network"`
+
+	MigrationEnabled        bool   `env:"MIGRATION_ENABLED"         flag:"migration-enabled"         default:"false"`
+	MigrationBatchSize      int64  `env:"MIGRATION_BATCH_SIZE"      flag:"migration-batch-size"      default:"10"`
+	MigrationCheckpointFile string `env:"MIGRATION_CHECKPOINT_FILE" flag:"migration-checkpoint-file" default:"migration.json"`
+
+	ConnectorGuard string `env:"CONNECTOR_GUARD" flag:"connector-guard" default:"off" enum:"off,warn,refuse"`
 
-	Port         int64         `env:"PORT"          flag:"port"          default:"8888"`
-	ReadTimeout  time.Duration `env:"READ_TIMEOUT"  flag:"read-timeout"  default:"5s"`
-	WriteTimeout time.Duration `env:"WRITE_TIMEOUT" flag:"write-timeout" default:"10s"`
-	DryRun       bool          `env:"DRY_RUN"       flag:"dry-run"       default:"false"`
-	DomainFilter []string      `env:"DOMAIN_FILTER" flag:"domain-filter" delimiter:","`
-}{}
+	StartupCheck bool `env:"STARTUP_CHECK" flag:"startup-check" default:"false"`
+
+	AuthMode       string `env:"AUTH_MODE"        flag:"auth-mode"        default:"none" enum:"none,bearer,hmac"`
+	AuthSecret     string `env:"AUTH_SECRET"      flag:"auth-secret"      secret:"true"`
+	AuthSecretFile string `env:"AUTH_SECRET_FILE" flag:"auth-secret-file"`
+
+	TracingExporter string `env:"TRACING_EXPORTER" flag:"tracing-exporter" default:"none" enum:"none,otlp,stdout"`
+
+	TLSCertFile     string   `env:"TLS_CERT_FILE"      flag:"tls-cert-file"`
+	TLSKeyFile      string   `env:"TLS_KEY_FILE"       flag:"tls-key-file"`
+	TLSClientCAFile string   `env:"TLS_CLIENT_CA_FILE" flag:"tls-client-ca-file"`
+	TLSMinVersion   string   `env:"TLS_MIN_VERSION"    flag:"tls-min-version"    default:"1.2" enum:"1.2,1.3"`
+	TLSCipherSuites []string `env:"TLS_CIPHER_SUITES"  flag:"tls-cipher-suites"  delimiter:","`
+}
+
+var Values = Settings{}
 
 func Configure() error {
 	// ignore error if .env file does not exist
 	_ = godotenv.Load()
 
-	if err := gonfig.Load(&Values); err != nil {
+	if err := load(&Values, flag.CommandLine, os.Args[1:]); err != nil {
 		return fmt.Errorf("failed to load config: %w", err)
 	}
 
@@ -49,7 +115,7 @@ func Configure() error {
 	case "json":
 		zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 	case "text":
-		log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout}).With().Timestamp().Logger()
+		log.Logger = zerolog.New(zerolog.ConsoleWriter{Out: os.Stderr}).With().Timestamp().Logger()
 	default:
 		return fmt.Errorf("invalid log format: %s", Values.LogFormat)
 	}
@@ -59,3 +125,94 @@ func Configure() error {
 
 	return nil
 }
+
+// Reload reads the config again, for the config and credential files which
+// may have changed since startup
+func Reload() (*Settings, error) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	settings := Settings{}
+	if err := load(&settings, fs, os.Args[1:]); err != nil {
+		return nil, fmt.Errorf("failed to reload config: %w", err)
+	}
+
+	return &settings, nil
+}
+
+// WatchedFiles are the config and credential files which are reloaded when
+// changed
+func (s Settings) WatchedFiles() []string {
+	files := []string{}
+	for _, file := range []string{s.ConfigFile, s.CloudflareAPIKeyFile, s.CloudflareAPIEmailFile, s.CloudflareAPITokenFile, s.TunnelTokenSecretFile, s.AuthSecretFile} {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+
+	return files
+}
+
+// readCredentialFiles sets the credentials from their files, which take
+// precedence over the credentials themselves
+func (s *Settings) readCredentialFiles() error {
+	credentials := []struct {
+		path  string
+		value *string
+	}{
+		{s.CloudflareAPIKeyFile, &s.CloudflareAPIKey},
+		{s.CloudflareAPIEmailFile, &s.CloudflareAPIEmail},
+		{s.CloudflareAPITokenFile, &s.CloudflareAPIToken},
+		{s.TunnelTokenSecretFile, &s.TunnelTokenSecret},
+		{s.AuthSecretFile, &s.AuthSecret},
+	}
+
+	for _, credential := range credentials {
+		if credential.path == "" {
+			continue
+		}
+
+		raw, err := os.ReadFile(credential.path)
+		if err != nil {
+			return fmt.Errorf("failed to read credential file: %w", err)
+		}
+
+		*credential.value = strings.TrimSpace(string(raw))
+	}
+
+	return nil
+}
+
+// SocketMode parses the octal permissions of the unix socket
+func (s Settings) SocketMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s.UnixSocketMode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return 0, fmt.Errorf("UNIX_SOCKET_MODE must be octal permissions, e.g. 0660: %s", s.UnixSocketMode)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+func (s Settings) validate() error {
+	if (s.CloudflareTunnelID == "") == (s.CloudflareTunnelName == "") {
+		return fmt.Errorf("either CLOUDFLARE_TUNNEL_ID or CLOUDFLARE_TUNNEL_NAME must be set, but not both")
+	}
+
+	if s.AuthMode != "none" && s.AuthSecret == "" {
+		return fmt.Errorf("AUTH_SECRET must be set when AUTH_MODE is %s", s.AuthMode)
+	}
+
+	if (s.TLSCertFile == "") != (s.TLSKeyFile == "") {
+		return fmt.Errorf("both TLS_CERT_FILE and TLS_KEY_FILE must be set")
+	}
+
+	if _, err := s.SocketMode(); err != nil {
+		return err
+	}
+
+	if s.TLSClientCAFile != "" && s.TLSCertFile == "" {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set when TLS_CLIENT_CA_FILE is set")
+	}
+
+	return nil
+}
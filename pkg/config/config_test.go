@@ -0,0 +1,166 @@
+package config_test
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/config"
+	"github.com/stretchr/testify/assert"
+)
+
+var update = flag.Bool("update", false, "update the published config schema")
+
+func TestSchema(t *testing.T) {
+	schema, err := config.Schema()
+	assert.NoError(t, err)
+
+	raw, err := json.MarshalIndent(schema, "", "  ")
+	assert.NoError(t, err)
+	raw = append(raw, '\n')
+
+	if *update {
+		assert.NoError(t, os.WriteFile("../../config.schema.json", raw, 0o644))
+	}
+
+	published, err := os.ReadFile("../../config.schema.json")
+	assert.NoError(t, err)
+	assert.Equal(t, string(published), string(raw), "run go test ./pkg/config -update to update the published schema")
+}
+
+func TestValidateFile(t *testing.T) {
+	assert.NoError(t, config.ValidateFile(map[string]any{
+		"cloudflare-account-id": "account123",
+		"port":                  float64(8080),
+		"read-timeout":          "10s",
+		"dry-run":               true,
+		"policy":                "upsert-only",
+		"protected-hostnames":   []any{"*.internal.example.com"},
+		"service-templates":     map[string]any{"db.example.com": "tcp://{{.Target}}:5432"},
+	}))
+
+	assert.ErrorContains(t, config.ValidateFile(map[string]any{"unknown": "value"}), "unknown property unknown")
+	assert.ErrorContains(t, config.ValidateFile(map[string]any{"config": "config.yaml"}), "unknown property config")
+	assert.ErrorContains(t, config.ValidateFile(map[string]any{"port": "8080"}), "property port: expected integer, got string")
+	assert.ErrorContains(t, config.ValidateFile(map[string]any{"port": 80.5}), "expected integer, got number")
+	assert.ErrorContains(t, config.ValidateFile(map[string]any{"policy": "delete-only"}), "value delete-only was not a member of [sync, upsert-only, create-only]")
+	assert.ErrorContains(t, config.ValidateFile(map[string]any{"domain-filter": []any{"example.com", true}}), "item 1: expected string, got boolean")
+	assert.ErrorContains(t, config.ValidateFile(map[string]any{"domain-filter": map[string]any{}}), "expected array, got object")
+}
+
+func TestWatch(t *testing.T) {
+	config.WatchDebounce = time.Millisecond * 10
+	dir := t.TempDir()
+	path := filepath.Join(dir, "token")
+	assert.NoError(t, os.WriteFile(path, []byte("old"), 0o600))
+
+	changed := make(chan struct{}, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	assert.NoError(t, config.Watch(ctx, []string{path}, func() { changed <- struct{}{} }))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "unrelated"), []byte("unrelated"), 0o600))
+	assert.NoError(t, os.WriteFile(path, []byte("new"), 0o600))
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("change was not observed")
+	}
+
+	select {
+	case <-changed:
+		t.Fatal("change was not debounced")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+// reload loads the config from the arguments and the environment of the test
+func reload(t *testing.T, args ...string) (*config.Settings, error) {
+	t.Helper()
+	t.Setenv("CLOUDFLARE_ACCOUNT_ID", "account123")
+	if _, ok := os.LookupEnv("CLOUDFLARE_TUNNEL_ID"); !ok {
+		t.Setenv("CLOUDFLARE_TUNNEL_ID", "tunnel123")
+	}
+
+	osArgs := os.Args
+	t.Cleanup(func() { os.Args = osArgs })
+	os.Args = append([]string{"webhook"}, args...)
+
+	return config.Reload()
+}
+
+func TestServiceTemplates(t *testing.T) {
+	t.Setenv("SERVICE_TEMPLATES", `a.example.com=http://{{.Target}};b.example.com={{printf "%s://%s,%d" .Scheme .Target .Port}}`)
+
+	settings, err := reload(t)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.example.com=http://{{.Target}}", `b.example.com={{printf "%s://%s,%d" .Scheme .Target .Port}}`}, settings.ServiceTemplates)
+
+	settings, err = reload(t, "-service-templates", "c.example.com=tcp://{{.Target}}")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"c.example.com=tcp://{{.Target}}"}, settings.ServiceTemplates)
+}
+
+func TestTunnelIdentity(t *testing.T) {
+	_, err := reload(t)
+	assert.NoError(t, err)
+
+	_, err = reload(t, "-cloudflare-tunnel-name", "webhook")
+	assert.ErrorContains(t, err, "but not both")
+
+	t.Setenv("CLOUDFLARE_TUNNEL_ID", "")
+	settings, err := reload(t, "-cloudflare-tunnel-name", "webhook")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "webhook", settings.CloudflareTunnelName)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("policy: upsert-only\nport: 9999\n"), 0o600))
+
+	for _, args := range [][]string{
+		{"-config", path, "-port", "8080"},
+		{"-port", "8080", "-config", path},
+		{"-port=8080", "-config=" + path},
+	} {
+		settings, err := reload(t, args...)
+		if assert.NoError(t, err, args) {
+			assert.Equal(t, "upsert-only", settings.Policy, args)
+			assert.Equal(t, int64(8080), settings.Port, args)
+		}
+	}
+}
+
+func TestCredentialFiles(t *testing.T) {
+	dir := t.TempDir()
+	for name, value := range map[string]string{"key": "file-key\n", "email": "file@example.com\n", "token": "file-token\n"} {
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(value), 0o600))
+	}
+
+	t.Setenv("CLOUDFLARE_API_KEY", "env-key")
+	t.Setenv("CLOUDFLARE_API_KEY_FILE", filepath.Join(dir, "key"))
+	t.Setenv("CLOUDFLARE_API_EMAIL", "env@example.com")
+	t.Setenv("CLOUDFLARE_API_EMAIL_FILE", filepath.Join(dir, "email"))
+
+	settings, err := reload(t,
+		"-cloudflare-api-email", "flag@example.com",
+		"-cloudflare-api-token", "flag-token",
+		"-cloudflare-api-token-file", filepath.Join(dir, "token"),
+	)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "file-key", settings.CloudflareAPIKey)
+		assert.Equal(t, "file@example.com", settings.CloudflareAPIEmail)
+		assert.Equal(t, "file-token", settings.CloudflareAPIToken)
+		assert.Equal(t, []string{filepath.Join(dir, "key"), filepath.Join(dir, "email"), filepath.Join(dir, "token")}, settings.WatchedFiles())
+	}
+
+	t.Setenv("CLOUDFLARE_API_EMAIL_FILE", filepath.Join(dir, "missing"))
+	_, err = reload(t)
+	assert.ErrorContains(t, err, "failed to read credential file")
+}
@@ -0,0 +1,427 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/axatol/gonfig"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// FileTag is "-" for fields which cannot be set in the config file, or "map"
+	// for string slices which can also be set as an object, each entry becoming
+	// "<key>=<value>"
+	FileTag = "file"
+	// SecretTag denotes values which are redacted when printed
+	SecretTag = "secret"
+)
+
+// field is a config value, named in the config file by its flag name
+type field struct {
+	*gonfig.Field
+	structField reflect.StructField
+	value       reflect.Value
+}
+
+func (f field) key() string {
+	if f.FlagName == nil {
+		return ""
+	}
+
+	return *f.FlagName
+}
+
+func (f field) inFile() bool {
+	return f.key() != "" && f.structField.Tag.Get(FileTag) != "-"
+}
+
+func (f field) isMap() bool {
+	return f.structField.Tag.Get(FileTag) == "map"
+}
+
+// boolFlag allows boolean flags to be set without a value, e.g. -print-config
+type boolFlag struct{ *gonfig.Value }
+
+func (b boolFlag) String() string {
+	if b.Value == nil {
+		return ""
+	}
+
+	return b.Value.String()
+}
+
+func (b boolFlag) IsBoolFlag() bool {
+	return true
+}
+
+// newFields reads the struct tags of the target, setting the defaults
+func newFields(target any) ([]field, error) {
+	v := reflect.ValueOf(target).Elem()
+	t := v.Type()
+
+	fields := []field{}
+	for i := 0; i < t.NumField(); i++ {
+		f, err := gonfig.NewField(t.Field(i), v.Field(i))
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure field from struct tags '%s': %s", t.Field(i).Name, err)
+		}
+
+		fields = append(fields, field{f, t.Field(i), v.Field(i)})
+	}
+
+	return fields, nil
+}
+
+// load sets the settings from their defaults, then the config file, then the
+// environment, then the flags and finally the credential files, like
+// gonfig.Load with the config file layered beneath the environment
+func load(settings *Settings, fs *flag.FlagSet, args []string) error {
+	fields, err := newFields(settings)
+	if err != nil {
+		return err
+	}
+
+	if path := configFilePath(args); path != "" {
+		if err := readFile(fields, path); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range fields {
+		if f.EnvName == nil {
+			continue
+		}
+
+		if value, ok := os.LookupEnv(*f.EnvName); ok {
+			if err := f.Set(value); err != nil {
+				return fmt.Errorf("failed to set field '%s': %s", f.Name, err)
+			}
+		}
+	}
+
+	bindFlags(fields, fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	missing := []string{}
+	for _, f := range fields {
+		if f.Required && !f.Value.IsSet() {
+			missing = append(missing, f.Name)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("required fields are unset: [%s]", strings.Join(missing, ", "))
+	}
+
+	if err := settings.readCredentialFiles(); err != nil {
+		return err
+	}
+
+	return settings.validate()
+}
+
+func bindFlags(fields []field, fs *flag.FlagSet) {
+	for _, f := range fields {
+		if f.FlagName == nil {
+			continue
+		}
+
+		// other boolean flags keep taking a value so "-dry-run true" still works
+		if f.structField.Type.Kind() == reflect.Bool && !f.inFile() {
+			fs.Var(boolFlag{f.Value}, *f.FlagName, f.Usage)
+		} else {
+			f.BindFlag(fs)
+		}
+	}
+}
+
+// configFilePath finds the -config flag by parsing the arguments into a
+// throwaway flag set with every flag, so the values of other flags are not
+// mistaken for it, falling back to the CONFIG_FILE environment variable.
+// Parse errors are left for the real parse to report
+func configFilePath(args []string) string {
+	settings := Settings{}
+	fields, err := newFields(&settings)
+	if err != nil {
+		return os.Getenv("CONFIG_FILE")
+	}
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	bindFlags(fields, fs)
+	_ = fs.Parse(args)
+
+	if settings.ConfigFile != "" {
+		return settings.ConfigFile
+	}
+
+	return os.Getenv("CONFIG_FILE")
+}
+
+// readFile validates the yaml or json config file against the schema and sets
+// the fields it contains
+func readFile(fields []field, path string) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+
+	var values map[string]any
+	if err := yaml.Unmarshal(raw, &values); err != nil {
+		return fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+
+	if err := ValidateFile(values); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	for _, f := range fields {
+		value, ok := values[f.key()]
+		if !ok || !f.inFile() {
+			continue
+		}
+
+		if err := setFileValue(f, value); err != nil {
+			return fmt.Errorf("failed to set %s from config file %s: %w", f.key(), path, err)
+		}
+	}
+
+	return nil
+}
+
+func setFileValue(f field, value any) error {
+	switch value := value.(type) {
+	case map[string]any:
+		entries := []string{}
+		for k, v := range value {
+			entries = append(entries, fmt.Sprintf("%s=%v", k, v))
+		}
+
+		sort.Strings(entries)
+		f.value.Set(reflect.ValueOf(entries))
+		return nil
+
+	case []any:
+		// elements are set directly as they may contain the delimiter
+		entries := []string{}
+		for _, v := range value {
+			entries = append(entries, fmt.Sprint(v))
+		}
+
+		f.value.Set(reflect.ValueOf(entries))
+		return nil
+
+	case float64:
+		return f.Set(fmt.Sprintf("%v", int64(value)))
+
+	default:
+		return f.Set(fmt.Sprint(value))
+	}
+}
+
+func schemaType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Int64:
+		if t == reflect.TypeFor[time.Duration]() {
+			return "string"
+		}
+
+		return "integer"
+	case reflect.Slice:
+		return "array"
+	default:
+		return "string"
+	}
+}
+
+func schemaValue(v any) any {
+	if d, ok := v.(time.Duration); ok {
+		return d.String()
+	}
+
+	return v
+}
+
+// Schema is the json schema of the config file, properties are named by the
+// flag of the value
+func Schema() (map[string]any, error) {
+	fields, err := newFields(&Settings{})
+	if err != nil {
+		return nil, err
+	}
+
+	properties := map[string]any{}
+	for _, f := range fields {
+		if !f.inFile() {
+			continue
+		}
+
+		property := map[string]any{"type": schemaType(f.structField.Type)}
+		if f.EnvName != nil {
+			property["description"] = fmt.Sprintf("Same as the %s environment variable", *f.EnvName)
+		}
+
+		if f.Enum != nil {
+			property["enum"] = f.Enum
+		}
+
+		if _, ok := f.structField.Tag.Lookup("default"); ok {
+			property["default"] = schemaValue(f.Value.Get())
+		}
+
+		if f.structField.Type.Kind() == reflect.Slice {
+			property["items"] = map[string]any{"type": "string"}
+		}
+
+		if f.isMap() {
+			property["type"] = []string{"array", "object"}
+			property["additionalProperties"] = map[string]any{"type": "string"}
+		}
+
+		properties[f.key()] = property
+	}
+
+	return map[string]any{
+		"$schema":              "https://json-schema.org/draft/2020-12/schema",
+		"title":                "external-dns-cloudflare-tunnel-webhook config file",
+		"type":                 "object",
+		"additionalProperties": false,
+		"properties":           properties,
+	}, nil
+}
+
+// ValidateFile validates the values of a config file against the schema
+func ValidateFile(values map[string]any) error {
+	schema, err := Schema()
+	if err != nil {
+		return err
+	}
+
+	properties := schema["properties"].(map[string]any)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		property, ok := properties[key].(map[string]any)
+		if !ok {
+			return fmt.Errorf("unknown property %s", key)
+		}
+
+		if err := validateValue(property, values[key]); err != nil {
+			return fmt.Errorf("property %s: %w", key, err)
+		}
+	}
+
+	return nil
+}
+
+func valueType(value any) string {
+	switch value := value.(type) {
+	case bool:
+		return "boolean"
+	case float64:
+		if value == float64(int64(value)) {
+			return "integer"
+		}
+
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return "null"
+	}
+}
+
+func validateValue(property map[string]any, value any) error {
+	types := []string{}
+	switch t := property["type"].(type) {
+	case string:
+		types = append(types, t)
+	case []string:
+		types = append(types, t...)
+	}
+
+	actual := valueType(value)
+	if !slices.Contains(types, actual) {
+		return fmt.Errorf("expected %s, got %s", strings.Join(types, " or "), actual)
+	}
+
+	if enum, ok := property["enum"].([]string); ok && !slices.Contains(enum, fmt.Sprint(value)) {
+		return fmt.Errorf("value %v was not a member of [%s]", value, strings.Join(enum, ", "))
+	}
+
+	switch value := value.(type) {
+	case []any:
+		items := property["items"].(map[string]any)
+		for i, item := range value {
+			if err := validateValue(items, item); err != nil {
+				return fmt.Errorf("item %d: %w", i, err)
+			}
+		}
+
+	case map[string]any:
+		additional := property["additionalProperties"].(map[string]any)
+		for key, item := range value {
+			if err := validateValue(additional, item); err != nil {
+				return fmt.Errorf("key %s: %w", key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Print writes the resolved config as yaml in the format of the config file,
+// redacting secrets
+func Print(w io.Writer) error {
+	v := reflect.ValueOf(Values)
+	t := v.Type()
+
+	values := map[string]any{}
+	for i := 0; i < t.NumField(); i++ {
+		key, ok := t.Field(i).Tag.Lookup(gonfig.FlagTag)
+		if !ok || t.Field(i).Tag.Get(FileTag) == "-" {
+			continue
+		}
+
+		value := schemaValue(v.Field(i).Interface())
+		if s, ok := value.(string); ok && s != "" && t.Field(i).Tag.Get(SecretTag) == "true" {
+			value = strings.Repeat("*", len(s))
+		}
+
+		if s, ok := value.([]string); ok && s == nil {
+			value = []string{}
+		}
+
+		values[key] = value
+	}
+
+	raw, err := yaml.Marshal(values)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	_, err = w.Write(raw)
+	return err
+}
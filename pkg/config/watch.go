@@ -0,0 +1,83 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+)
+
+// WatchDebounce is how long to wait for changes to settle before reloading
+var WatchDebounce = time.Second
+
+// Watch calls onChange whenever any of the files change, until the context is
+// done. The parent directories are watched, as mounted kubernetes secrets and
+// config maps are updated by swapping a symlink rather than writing the files
+func Watch(ctx context.Context, files []string, onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create file watcher: %w", err)
+	}
+
+	watched := map[string]bool{}
+	dirs := map[string]bool{}
+	for _, file := range files {
+		path, err := filepath.Abs(file)
+		if err != nil {
+			_ = watcher.Close()
+			return fmt.Errorf("failed to resolve %s: %w", file, err)
+		}
+
+		watched[path] = true
+		if dir := filepath.Dir(path); !dirs[dir] {
+			if err := watcher.Add(dir); err != nil {
+				_ = watcher.Close()
+				return fmt.Errorf("failed to watch %s: %w", dir, err)
+			}
+
+			dirs[dir] = true
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+
+		timer := time.NewTimer(0)
+		<-timer.C
+
+		for {
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				// kubernetes swaps the ..data symlink of the mounted volume
+				if watched[event.Name] || strings.HasPrefix(filepath.Base(event.Name), "..") {
+					log.Debug().Str("file", event.Name).Str("op", event.Op.String()).Msg("watched file changed")
+					timer.Reset(WatchDebounce)
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				log.Error().Err(fmt.Errorf("failed to watch files: %w", err)).Send()
+
+			case <-timer.C:
+				onChange()
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "external_dns_cloudflare_tunnel"
+
+var (
+	ProtectedHostnameRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "protected_hostname_rejections_total",
+		Help:      "Number of changes rejected because they targeted a protected hostname",
+	}, []string{"action"})
+
+	TunnelActiveConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_connections",
+		Help:      "Number of active connections between cloudflared connectors and the edge",
+	})
+
+	TunnelConnectorConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connector_connections",
+		Help:      "Number of active connections of each cloudflared connector",
+	}, []string{"connector_id", "version", "arch"})
+
+	ConnectorGuardRejections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connector_guard_rejections_total",
+		Help:      "Number of hostnames not created because the tunnel had no active connections",
+	})
+
+	ConfigReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "config_reloads_total",
+		Help:      "Number of times the config was reloaded after a watched file changed",
+	}, []string{"result"})
+
+	AuthFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_failures_total",
+		Help:      "Number of requests rejected because they failed authentication",
+	}, []string{"method"})
+)
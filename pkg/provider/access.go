@@ -0,0 +1,380 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/cf"
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/util"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/rs/zerolog/log"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+const (
+	PropertyAccessPolicy = "access-policy"
+	PropertyAccessGroups = "access-groups"
+)
+
+// AccessDecisions are the decisions an access policy can make
+var AccessDecisions = []string{"allow", "deny", "bypass", "non_identity"}
+
+// AccessSpec describes the access application and policy for a hostname
+type AccessSpec struct {
+	Decision string
+	// Groups are the access group ids to include, everyone is included if
+	// empty
+	Groups []string
+	// AUD is the audience tag of the access application, empty until the
+	// application exists
+	AUD string
+}
+
+// AccessSpecFromEndpoint reads the "cloudflare-tunnel/access-policy" and
+// "cloudflare-tunnel/access-groups" properties, returning nil if neither is set
+func AccessSpecFromEndpoint(e *endpoint.Endpoint) (*AccessSpec, error) {
+	decision, hasDecision := GetProperty(e, PropertyAccessPolicy)
+	rawGroups, hasGroups := GetProperty(e, PropertyAccessGroups)
+	if !hasDecision && !hasGroups {
+		return nil, nil
+	}
+
+	if decision == "" {
+		decision = "allow"
+	}
+
+	if !slices.Contains(AccessDecisions, decision) {
+		return nil, fmt.Errorf("invalid access policy for endpoint %s: %s", e.DNSName, decision)
+	}
+
+	groups := []string{}
+	for _, group := range strings.Split(rawGroups, ",") {
+		if group = strings.TrimSpace(group); group != "" {
+			groups = append(groups, group)
+		}
+	}
+
+	slices.Sort(groups)
+	return &AccessSpec{Decision: decision, Groups: slices.Compact(groups)}, nil
+}
+
+// SetProperties replaces the access properties of the endpoint with the
+// canonical form of the spec, which is the same form reported by Records
+func (s AccessSpec) SetProperties(e *endpoint.Endpoint) {
+	DeleteProperty(e, PropertyAccessPolicy)
+	DeleteProperty(e, PropertyAccessGroups)
+	e.SetProviderSpecificProperty(PropertyPrefix+PropertyAccessPolicy, s.Decision)
+	if len(s.Groups) > 0 {
+		e.SetProviderSpecificProperty(PropertyPrefix+PropertyAccessGroups, strings.Join(s.Groups, ","))
+	}
+}
+
+func (s AccessSpec) include() []interface{} {
+	if len(s.Groups) == 0 {
+		return []interface{}{cloudflare.AccessGroupEveryone{}}
+	}
+
+	include := make([]interface{}, 0, len(s.Groups))
+	for _, id := range s.Groups {
+		group := cloudflare.AccessGroupAccessGroup{}
+		group.Group.ID = id
+		include = append(include, group)
+	}
+
+	return include
+}
+
+// accessSpecFromPolicy reads the spec back from a policy created by this
+// provider
+func accessSpecFromPolicy(policy cloudflare.AccessPolicy) AccessSpec {
+	groups := []string{}
+	for _, rule := range policy.Include {
+		raw, err := json.Marshal(rule)
+		if err != nil {
+			continue
+		}
+
+		var group cloudflare.AccessGroupAccessGroup
+		if err := json.Unmarshal(raw, &group); err == nil && group.Group.ID != "" {
+			groups = append(groups, group.Group.ID)
+		}
+	}
+
+	slices.Sort(groups)
+	return AccessSpec{Decision: policy.Decision, Groups: groups}
+}
+
+// accessName names the access applications and policies created by this
+// provider by the id of the tunnel which owns them and the hostname
+func accessName(tunnelID, hostname string) string {
+	return ownerMark(tunnelID + "/" + hostname)
+}
+
+func isManagedAccessName(name string) bool {
+	_, ok := ownedValue(name)
+	return ok
+}
+
+// accessOwner returns the id of the tunnel which owns the access application,
+// empty for applications named before they were owned by a tunnel
+func accessOwner(name string) string {
+	value, _ := ownedValue(name)
+	owner, _, ok := strings.Cut(value, "/")
+	if !ok {
+		return ""
+	}
+
+	return owner
+}
+
+// managedApplications maps hostnames to the access applications created by
+// this provider
+func managedApplications(applications []cloudflare.AccessApplication) map[string]cloudflare.AccessApplication {
+	managed := map[string]cloudflare.AccessApplication{}
+	for _, application := range applications {
+		if isManagedAccessName(application.Name) {
+			managed[NormaliseHostname(application.Domain)] = application
+		}
+	}
+
+	return managed
+}
+
+type AccessChange struct {
+	Action        ChangeType
+	Hostname      string
+	ApplicationID string
+	// AUD is the audience tag of the existing application, if any
+	AUD  string
+	Spec *AccessSpec
+}
+
+// AccessChangeSet determines the access application changes required so that
+// every desired hostname has an application, removed hostnames do not, and no
+// application owned by the tunnel is left behind for a hostname within the
+// domain filter which is not in the tunnel. Applications owned by another
+// tunnel are never removed, unowned applications only with their hostname
+func AccessChangeSet(applications []cloudflare.AccessApplication, desired map[string]AccessSpec, removed []string, live map[string]bool, tunnelID string, filter endpoint.DomainFilter) []AccessChange {
+	managed := managedApplications(applications)
+	changes := map[string]AccessChange{}
+
+	for hostname, spec := range desired {
+		spec := spec
+		change := AccessChange{Action: ChangeTypeCreate, Hostname: hostname, Spec: &spec}
+		if application, ok := managed[hostname]; ok {
+			change.Action = ChangeTypeUpdate
+			change.ApplicationID = application.ID
+			change.AUD = application.AUD
+		}
+
+		changes[hostname] = change
+	}
+
+	for _, hostname := range removed {
+		if _, ok := desired[hostname]; ok {
+			continue
+		}
+
+		if application, ok := managed[hostname]; ok && slices.Contains([]string{"", tunnelID}, accessOwner(application.Name)) {
+			changes[hostname] = AccessChange{Action: ChangeTypeDelete, Hostname: hostname, ApplicationID: application.ID}
+		}
+	}
+
+	for hostname, application := range managed {
+		if _, ok := changes[hostname]; ok || live[hostname] || accessOwner(application.Name) != tunnelID || !filter.Match(hostname) {
+			continue
+		}
+
+		log.Info().Str("hostname", hostname).Str("application_id", application.ID).Msg("orphaned access application")
+		changes[hostname] = AccessChange{Action: ChangeTypeDelete, Hostname: hostname, ApplicationID: application.ID}
+	}
+
+	changeList := make([]AccessChange, 0, len(changes))
+	for _, change := range changes {
+		changeList = append(changeList, change)
+	}
+
+	sort.Slice(changeList, func(i, j int) bool { return changeList[i].Hostname < changeList[j].Hostname })
+	return changeList
+}
+
+// splitAccessChanges separates the creates and updates from the deletes
+func splitAccessChanges(changes []AccessChange) ([]AccessChange, []AccessChange) {
+	upserts, deletes := []AccessChange{}, []AccessChange{}
+	for _, change := range changes {
+		if change.Action == ChangeTypeDelete {
+			deletes = append(deletes, change)
+		} else {
+			upserts = append(upserts, change)
+		}
+	}
+
+	return upserts, deletes
+}
+
+// accessAudiences maps hostnames to the audience tag of their existing access
+// application
+func accessAudiences(changes []AccessChange) map[string]string {
+	audiences := map[string]string{}
+	for _, change := range changes {
+		if change.AUD != "" {
+			audiences[change.Hostname] = change.AUD
+		}
+	}
+
+	return audiences
+}
+
+// GetAccessSpecs reads the spec of every access application created by this
+// provider
+func GetAccessSpecs(ctx context.Context, cf cf.Cloudflare, accountID string) (map[string]AccessSpec, error) {
+	applications, err := cf.ListAccessApplications(ctx, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list access applications: %w", err)
+	}
+
+	specs := map[string]AccessSpec{}
+	for hostname, application := range managedApplications(applications) {
+		policies, err := cf.ListAccessPolicies(ctx, accountID, application.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list access policies: %w", err)
+		}
+
+		for _, policy := range policies {
+			if isManagedAccessName(policy.Name) {
+				spec := accessSpecFromPolicy(policy)
+				spec.AUD = application.AUD
+				specs[hostname] = spec
+				break
+			}
+		}
+	}
+
+	return specs, nil
+}
+
+// ApplyAccessChanges creates, updates or deletes the access applications and
+// their policies, owned by the tunnel, returning the audience tag of each
+// created or updated application by hostname
+func ApplyAccessChanges(ctx context.Context, cf cf.Cloudflare, accountID, tunnelID string, changes []AccessChange) (map[string]string, error) {
+	errs := util.ErrorList{}
+	audiences := map[string]string{}
+
+	for _, change := range changes {
+		aud, err := applyAccessChange(ctx, cf, accountID, tunnelID, change)
+		if err != nil {
+			errs.Add(err)
+			continue
+		}
+
+		if aud != "" {
+			audiences[change.Hostname] = aud
+		}
+	}
+
+	if len(errs) > 0 {
+		return audiences, &errs
+	}
+
+	return audiences, nil
+}
+
+func applyAccessChange(ctx context.Context, cf cf.Cloudflare, accountID, tunnelID string, change AccessChange) (string, error) {
+	switch change.Action {
+	case ChangeTypeCreate:
+		application, err := cf.CreateAccessApplication(ctx, accountID, cloudflare.CreateAccessApplicationParams{
+			Name:   accessName(tunnelID, change.Hostname),
+			Domain: change.Hostname,
+			Type:   cloudflare.SelfHosted,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		return application.AUD, cf.CreateAccessPolicy(ctx, accountID, cloudflare.CreateAccessPolicyParams{
+			ApplicationID: application.ID,
+			Name:          accessName(tunnelID, change.Hostname),
+			Decision:      change.Spec.Decision,
+			Precedence:    1,
+			Include:       change.Spec.include(),
+		})
+
+	case ChangeTypeUpdate:
+		application, err := cf.UpdateAccessApplication(ctx, accountID, cloudflare.UpdateAccessApplicationParams{
+			ID:     change.ApplicationID,
+			Name:   accessName(tunnelID, change.Hostname),
+			Domain: change.Hostname,
+			Type:   cloudflare.SelfHosted,
+		})
+		if err != nil {
+			return "", err
+		}
+
+		policies, err := cf.ListAccessPolicies(ctx, accountID, change.ApplicationID)
+		if err != nil {
+			return "", err
+		}
+
+		for _, policy := range policies {
+			if isManagedAccessName(policy.Name) {
+				return application.AUD, cf.UpdateAccessPolicy(ctx, accountID, cloudflare.UpdateAccessPolicyParams{
+					ApplicationID: change.ApplicationID,
+					PolicyID:      policy.ID,
+					Name:          accessName(tunnelID, change.Hostname),
+					Decision:      change.Spec.Decision,
+					Precedence:    policy.Precedence,
+					Include:       change.Spec.include(),
+				})
+			}
+		}
+
+		return application.AUD, cf.CreateAccessPolicy(ctx, accountID, cloudflare.CreateAccessPolicyParams{
+			ApplicationID: change.ApplicationID,
+			Name:          accessName(tunnelID, change.Hostname),
+			Decision:      change.Spec.Decision,
+			Precedence:    1,
+			Include:       change.Spec.include(),
+		})
+
+	case ChangeTypeDelete:
+		return "", cf.DeleteAccessApplication(ctx, accountID, change.ApplicationID)
+	}
+
+	return "", nil
+}
+
+// TransferAccessApplications makes the tunnel the owner of the access
+// applications of the hostnames, so they are not removed as orphans by the
+// tunnel the hostnames were moved from
+func TransferAccessApplications(ctx context.Context, cf cf.Cloudflare, accountID, tunnelID string, hostnames []string) error {
+	applications, err := cf.ListAccessApplications(ctx, accountID)
+	if err != nil {
+		return fmt.Errorf("failed to list access applications: %w", err)
+	}
+
+	errs := util.ErrorList{}
+	for hostname, application := range managedApplications(applications) {
+		if !slices.Contains(hostnames, hostname) || accessOwner(application.Name) == tunnelID {
+			continue
+		}
+
+		if _, err := cf.UpdateAccessApplication(ctx, accountID, cloudflare.UpdateAccessApplicationParams{
+			ID:     application.ID,
+			Name:   accessName(tunnelID, hostname),
+			Domain: application.Domain,
+			Type:   application.Type,
+		}); err != nil {
+			errs.Add(fmt.Errorf("failed to transfer access application %s: %w", application.ID, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return &errs
+	}
+
+	return nil
+}
@@ -0,0 +1,92 @@
+package provider_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestAccessSpecFromEndpoint(t *testing.T) {
+	e := endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeCNAME, "http://a")
+	spec, err := provider.AccessSpecFromEndpoint(e)
+	assert.NoError(t, err)
+	assert.Nil(t, spec)
+
+	e.SetProviderSpecificProperty("webhook/cloudflare-tunnel-access-groups", "group2, group1,group2")
+	spec, err = provider.AccessSpecFromEndpoint(e)
+	assert.NoError(t, err)
+	assert.Equal(t, &provider.AccessSpec{Decision: "allow", Groups: []string{"group1", "group2"}}, spec)
+
+	spec.SetProperties(e)
+	policy, _ := e.GetProviderSpecificProperty("cloudflare-tunnel/access-policy")
+	groups, _ := e.GetProviderSpecificProperty("cloudflare-tunnel/access-groups")
+	_, hasWebhookGroups := e.GetProviderSpecificProperty("webhook/cloudflare-tunnel-access-groups")
+	assert.Equal(t, "allow", policy)
+	assert.Equal(t, "group1,group2", groups)
+	assert.False(t, hasWebhookGroups)
+
+	e.SetProviderSpecificProperty("cloudflare-tunnel/access-policy", "maybe")
+	_, err = provider.AccessSpecFromEndpoint(e)
+	assert.Error(t, err)
+}
+
+func TestAccessChangeSet(t *testing.T) {
+	applications := []cloudflare.AccessApplication{
+		{ID: "app1", Name: "external-dns/tunnel123/update.example.com", Domain: "update.example.com"},
+		{ID: "app2", Name: "external-dns/tunnel123/delete.example.com", Domain: "delete.example.com"},
+		{ID: "app3", Name: "external-dns/tunnel123/orphan.example.com", Domain: "orphan.example.com"},
+		{ID: "app4", Name: "external-dns/tunnel123/live.example.com", Domain: "live.example.com"},
+		{ID: "app5", Name: "manual", Domain: "manual.example.com"},
+		{ID: "app6", Name: "external-dns/tunnel456/other.example.com", Domain: "other.example.com"},
+		{ID: "app7", Name: "external-dns/tunnel456/removed.example.com", Domain: "removed.example.com"},
+		{ID: "app8", Name: "external-dns/legacy.example.com", Domain: "legacy.example.com"},
+		{ID: "app9", Name: "external-dns/legacy-removed.example.com", Domain: "legacy-removed.example.com"},
+		{ID: "app10", Name: "external-dns/tunnel123/orphan.example.net", Domain: "orphan.example.net"},
+	}
+
+	desired := map[string]provider.AccessSpec{
+		"create.example.com": {Decision: "allow"},
+		"update.example.com": {Decision: "deny"},
+	}
+
+	removed := []string{"delete.example.com", "manual.example.com", "removed.example.com", "legacy-removed.example.com"}
+	live := map[string]bool{
+		"create.example.com": true,
+		"update.example.com": true,
+		"live.example.com":   true,
+		"manual.example.com": true,
+	}
+
+	changes := provider.AccessChangeSet(applications, desired, removed, live, "tunnel123", endpoint.NewDomainFilter([]string{"example.com"}))
+	assert.Equal(t, []provider.AccessChange{
+		{Action: provider.ChangeTypeCreate, Hostname: "create.example.com", Spec: &provider.AccessSpec{Decision: "allow"}},
+		{Action: provider.ChangeTypeDelete, Hostname: "delete.example.com", ApplicationID: "app2"},
+		{Action: provider.ChangeTypeDelete, Hostname: "legacy-removed.example.com", ApplicationID: "app9"},
+		{Action: provider.ChangeTypeDelete, Hostname: "orphan.example.com", ApplicationID: "app3"},
+		{Action: provider.ChangeTypeUpdate, Hostname: "update.example.com", ApplicationID: "app1", Spec: &provider.AccessSpec{Decision: "deny"}},
+	}, changes)
+}
+
+func TestTransferAccessApplications(t *testing.T) {
+	fake := newFakeCloudflare()
+	fake.apps = []cloudflare.AccessApplication{
+		{ID: "app1", Name: "external-dns/source/a.example.com", Domain: "a.example.com"},
+		{ID: "app2", Name: "external-dns/b.example.com", Domain: "b.example.com"},
+		{ID: "app3", Name: "external-dns/source/c.example.com", Domain: "c.example.com"},
+		{ID: "app4", Name: "manual", Domain: "d.example.com"},
+	}
+
+	err := provider.TransferAccessApplications(context.Background(), fake, "account123", "target", []string{"a.example.com", "b.example.com", "d.example.com"})
+	assert.NoError(t, err)
+
+	names := []string{}
+	for _, app := range fake.apps {
+		names = append(names, app.Name)
+	}
+
+	assert.Equal(t, []string{"external-dns/target/a.example.com", "external-dns/target/b.example.com", "external-dns/source/c.example.com", "manual"}, names)
+}
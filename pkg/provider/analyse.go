@@ -0,0 +1,116 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+type ShadowedRulesMode string
+
+const (
+	// ShadowedRulesWarn logs shadowed rules but applies the changes anyway
+	ShadowedRulesWarn ShadowedRulesMode = "warn"
+	// ShadowedRulesReject fails the apply if any rule is shadowed
+	ShadowedRulesReject ShadowedRulesMode = "reject"
+)
+
+// Shadow is an ingress rule which never matches a request because an earlier
+// rule always matches first
+type Shadow struct {
+	Index      int    `json:"index"`
+	Hostname   string `json:"hostname"`
+	Path       string `json:"path,omitempty"`
+	ShadowedBy int    `json:"shadowedBy"`
+	// Unreachable is set when the earlier rule is a catch-all
+	Unreachable bool `json:"unreachable"`
+}
+
+func (s Shadow) Error() string {
+	name := s.Hostname
+	if name == "" {
+		name = "catch-all"
+	}
+
+	if s.Unreachable {
+		return fmt.Sprintf("ingress rule %d (%s%s) is unreachable after catch-all rule %d", s.Index, name, s.Path, s.ShadowedBy)
+	}
+
+	return fmt.Sprintf("ingress rule %d (%s%s) is shadowed by rule %d", s.Index, name, s.Path, s.ShadowedBy)
+}
+
+// hostnameCovers reports whether every hostname matched by inner is also
+// matched by outer, following cloudflared wildcard semantics where
+// "*.example.com" matches any subdomain of example.com
+func hostnameCovers(outer, inner string) bool {
+	if outer == "" || outer == "*" {
+		return true
+	}
+
+	if inner == "" || inner == "*" {
+		return false
+	}
+
+	outer, inner = NormaliseHostname(outer), NormaliseHostname(inner)
+	if outer == inner {
+		return true
+	}
+
+	if !IsWildcard(outer) {
+		return false
+	}
+
+	domain := outer[2:]
+	if IsWildcard(inner) {
+		return isSubdomain(inner[2:], domain)
+	}
+
+	return inner != domain && isSubdomain(inner, domain)
+}
+
+// pathCovers reports whether every path matched by inner is also matched by
+// outer, identical expressions are the only non-empty paths known to match
+func pathCovers(outer, inner string) bool {
+	return outer == "" || outer == inner
+}
+
+func ruleCovers(outer, inner cloudflare.UnvalidatedIngressRule) bool {
+	return hostnameCovers(outer.Hostname, inner.Hostname) && pathCovers(outer.Path, inner.Path)
+}
+
+// Analyse finds the rules which can never be reached because an earlier rule
+// matches every request they would
+func (r Rules) Analyse() []Shadow {
+	shadows := []Shadow{}
+	for i, rule := range r {
+		for j := 0; j < i; j++ {
+			earlier := r[j]
+			if !ruleCovers(earlier, rule) {
+				continue
+			}
+
+			shadows = append(shadows, Shadow{
+				Index:       i,
+				Hostname:    rule.Hostname,
+				Path:        rule.Path,
+				ShadowedBy:  j,
+				Unreachable: isCatchAll(earlier),
+			})
+
+			break
+		}
+	}
+
+	return shadows
+}
+
+// AnalyseRules finds the shadowed rules of the live tunnel configuration
+func (p CloudflareTunnelProvider) AnalyseRules(ctx context.Context) ([]Shadow, error) {
+	tunnel, err := p.Cloudflare.GetTunnelConfiguration(ctx, p.CloudflareAccountID, p.CloudflareTunnelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tunnel configuration: %w", err)
+	}
+
+	return Rules(tunnel.Config.Ingress).Analyse(), nil
+}
@@ -0,0 +1,37 @@
+package provider_test
+
+import (
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRules_Analyse(t *testing.T) {
+	rules := provider.Rules{
+		{Hostname: "*.example.com", Service: "http://wildcard"},
+		{Hostname: "app.example.com", Service: "http://app"},
+		{Hostname: "*.sub.example.com", Service: "http://sub"},
+		{Hostname: "api.example.net", Path: "^/v1", Service: "http://v1"},
+		{Hostname: "api.example.net", Path: "^/v2", Service: "http://v2"},
+		{Hostname: "api.example.net", Path: "^/v1", Service: "http://v1-again"},
+		{Hostname: "example.com", Service: "http://apex"},
+		{Service: "http_status:404"},
+		{Hostname: "late.example.org", Service: "http://late"},
+	}
+
+	assert.Equal(t, []provider.Shadow{
+		{Index: 1, Hostname: "app.example.com", ShadowedBy: 0},
+		{Index: 2, Hostname: "*.sub.example.com", ShadowedBy: 0},
+		{Index: 5, Hostname: "api.example.net", Path: "^/v1", ShadowedBy: 3},
+		{Index: 8, Hostname: "late.example.org", ShadowedBy: 7, Unreachable: true},
+	}, rules.Analyse())
+
+	ordered := provider.Rules{
+		{Hostname: "app.example.com", Service: "http://app"},
+		{Hostname: "*.example.com", Service: "http://wildcard"},
+		{Service: "http_status:404"},
+	}
+
+	assert.Empty(t, ordered.Analyse())
+}
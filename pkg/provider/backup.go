@@ -0,0 +1,184 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/util"
+	"github.com/rs/zerolog/log"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// Backup is a snapshot of the ingress rules of a tunnel, the dns records are
+// derived from the rules when restored
+type Backup struct {
+	TunnelID  string    `json:"tunnelId"`
+	CreatedAt time.Time `json:"createdAt"`
+	Rules     Rules     `json:"rules"`
+}
+
+// ReadBackup decodes a backup
+func ReadBackup(r io.Reader) (*Backup, error) {
+	var backup Backup
+	if err := json.NewDecoder(r).Decode(&backup); err != nil {
+		return nil, fmt.Errorf("failed to decode backup: %w", err)
+	}
+
+	if len(backup.Rules) == 0 {
+		return nil, fmt.Errorf("backup has no ingress rules")
+	}
+
+	return &backup, nil
+}
+
+// Backup snapshots the ingress rules of the tunnel
+func (p CloudflareTunnelProvider) Backup(ctx context.Context) (*Backup, error) {
+	tunnel, err := p.Cloudflare.GetTunnelConfiguration(ctx, p.CloudflareAccountID, p.CloudflareTunnelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tunnel configuration: %w", err)
+	}
+
+	return &Backup{
+		TunnelID:  p.CloudflareTunnelID,
+		CreatedAt: time.Now().UTC(),
+		Rules:     NormaliseRules(tunnel.Config.Ingress),
+	}, nil
+}
+
+// Restore replaces the ingress rules of the tunnel with those of the backup,
+// which may be of another tunnel, and points their dns records to the tunnel.
+// Protected hostnames cannot be changed and conflicting records fail the
+// restore before anything is changed
+func (p CloudflareTunnelProvider) Restore(ctx context.Context, backup Backup) (*ApplyPlan, error) {
+	tunnel, err := p.Cloudflare.GetTunnelConfiguration(ctx, p.CloudflareAccountID, p.CloudflareTunnelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tunnel configuration: %w", err)
+	}
+
+	current := NormaliseRules(tunnel.Config.Ingress)
+	rules := NormaliseRules(backup.Rules)
+	errs := util.ErrorList{}
+	for _, ruleErr := range rules.Validate() {
+		errs.Add(ruleErr)
+	}
+
+	for _, diff := range DiffRules(current, rules) {
+		if err := p.ProtectedHostnames.Check(diff.rule().Hostname, diff.Action); err != nil {
+			errs.Add(err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("failed to validate backup: %w", &errs)
+	}
+
+	zoneMap, err := GenerateZoneMap(ctx, p.Cloudflare)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate zone map: %w", err)
+	}
+
+	opts, err := p.changeSetOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	changeset := TunnelDNSChangeSet(ctx, p.CloudflareTunnelID, rules, *zoneMap, opts)
+
+	for _, conflict := range changeset.Conflicts {
+		errs.Add(conflict)
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("failed to restore backup: %w", &errs)
+	}
+
+	applyPlan := ApplyPlan{
+		Current: current,
+		Rules:   rules,
+		Records: p.Policy.FilterChangeSet(changeset.Changes),
+	}
+
+	if p.DryRun {
+		log.Info().Any("rules", applyPlan.Rules).Any("records", applyPlan.Records).Msg("dry run, not restoring backup")
+		return &applyPlan, nil
+	}
+
+	if err := p.Cloudflare.UpdateTunnelIngress(ctx, p.CloudflareAccountID, p.CloudflareTunnelID, rules); err != nil {
+		return nil, fmt.Errorf("failed to update tunnel ingress rules: %w", err)
+	}
+
+	if err := BatchUpdateDNSRecords(ctx, p.Cloudflare, applyPlan.Records); err != nil {
+		return nil, fmt.Errorf("failed to update zone records: %w", err)
+	}
+
+	return &applyPlan, nil
+}
+
+// GarbageRecords returns the deletions of the dns record changes, i.e. the
+// records resolving to the tunnel without an ingress rule
+func GarbageRecords(changes []Change) []Change {
+	garbage := []Change{}
+	for _, change := range changes {
+		if change.Action == ChangeTypeDelete {
+			garbage = append(garbage, change)
+		}
+	}
+
+	return garbage
+}
+
+// GC deletes the dns records resolving to the tunnel and, if enabled, the
+// access applications which are left without an ingress rule
+func (p CloudflareTunnelProvider) GC(ctx context.Context) (*ApplyPlan, error) {
+	tunnel, err := p.Cloudflare.GetTunnelConfiguration(ctx, p.CloudflareAccountID, p.CloudflareTunnelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tunnel configuration: %w", err)
+	}
+
+	rules := NormaliseRules(tunnel.Config.Ingress)
+	zoneMap, err := GenerateZoneMap(ctx, p.Cloudflare)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate zone map: %w", err)
+	}
+
+	opts, err := p.changeSetOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	changeset := TunnelDNSChangeSet(ctx, p.CloudflareTunnelID, rules, *zoneMap, opts)
+
+	applyPlan := ApplyPlan{
+		Current: rules,
+		Rules:   rules,
+		Records: p.Policy.FilterChangeSet(GarbageRecords(changeset.Changes)),
+		Access:  []AccessChange{},
+	}
+
+	if p.AccessEnabled {
+		accessChanges, err := p.accessChangeSet(ctx, &plan.Changes{}, rules)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine access changes: %w", err)
+		}
+
+		_, applyPlan.Access = splitAccessChanges(accessChanges)
+	}
+
+	if p.DryRun {
+		log.Info().Any("records", applyPlan.Records).Any("access", applyPlan.Access).Msg("dry run, not collecting garbage")
+		return &applyPlan, nil
+	}
+
+	if err := BatchUpdateDNSRecords(ctx, p.Cloudflare, applyPlan.Records); err != nil {
+		return nil, fmt.Errorf("failed to delete zone records: %w", err)
+	}
+
+	if _, err := ApplyAccessChanges(ctx, p.Cloudflare, p.CloudflareAccountID, p.CloudflareTunnelID, applyPlan.Access); err != nil {
+		return nil, fmt.Errorf("failed to delete access applications: %w", err)
+	}
+
+	return &applyPlan, nil
+}
@@ -0,0 +1,52 @@
+package provider
+
+import (
+	"fmt"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyRefuse never changes existing records which do not resolve
+	// to the tunnel
+	ConflictPolicyRefuse ConflictPolicy = "refuse"
+	// ConflictPolicyAdopt takes over existing CNAME records which do not resolve
+	// to the tunnel
+	ConflictPolicyAdopt ConflictPolicy = "adopt"
+	// ConflictPolicyOwned only takes over existing CNAME records which were
+	// created by this provider
+	ConflictPolicyOwned ConflictPolicy = "owned"
+)
+
+// allowsTakeover reports whether an existing CNAME record which does not
+// resolve to the tunnel may be changed
+func (p ConflictPolicy) allowsTakeover(record cloudflare.DNSRecord) bool {
+	switch p {
+	case ConflictPolicyRefuse:
+		return false
+	case ConflictPolicyOwned:
+		return IsOwnedRecord(record)
+	default:
+		return true
+	}
+}
+
+// IsOwnedRecord reports whether the record was created by this provider
+func IsOwnedRecord(record cloudflare.DNSRecord) bool {
+	_, ok := ownedValue(record.Comment)
+	return ok
+}
+
+// Conflict is an existing dns record which prevents a hostname from being
+// routed to the tunnel
+type Conflict struct {
+	Name   string
+	Record cloudflare.DNSRecord
+	Reason string
+}
+
+func (c Conflict) Error() string {
+	return fmt.Sprintf("conflicting %s record %s for hostname %s: %s", c.Record.Type, c.Record.ID, c.Name, c.Reason)
+}
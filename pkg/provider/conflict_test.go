@@ -0,0 +1,89 @@
+package provider_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnelDNSChangeSet_ConflictPolicy(t *testing.T) {
+	rules := []cloudflare.UnvalidatedIngressRule{
+		{Hostname: "a.example.com", Service: "a"},
+		{Hostname: "owned.example.com", Service: "owned"},
+		{Hostname: "other.example.com", Service: "other"},
+		{Hostname: "mail.example.com", Service: "mail"},
+	}
+
+	zoneMap := provider.ZoneMap{
+		"example.com": provider.ZoneDetail{
+			Zone: cloudflare.Zone{ID: "zone123"},
+			Records: map[string]cloudflare.DNSRecord{
+				"owned.example.com": {
+					ID:      "record1",
+					ZoneID:  "zone123",
+					Type:    "CNAME",
+					Name:    "owned.example.com",
+					Content: "tunnel456.cfargotunnel.com",
+					Comment: "external-dns/owned",
+				},
+				"other.example.com": {
+					ID:      "record2",
+					ZoneID:  "zone123",
+					Type:    "CNAME",
+					Name:    "other.example.com",
+					Content: "elsewhere.example.net",
+				},
+			},
+			OtherRecords: map[string][]cloudflare.DNSRecord{
+				"a.example.com": {{
+					ID:      "record3",
+					ZoneID:  "zone123",
+					Type:    "A",
+					Name:    "a.example.com",
+					Content: "10.0.0.1",
+				}},
+				"mail.example.com": {{
+					ID:      "record4",
+					ZoneID:  "zone123",
+					Type:    "MX",
+					Name:    "mail.example.com",
+					Content: "mx.example.net",
+				}, {
+					ID:      "record5",
+					ZoneID:  "zone123",
+					Type:    "TXT",
+					Name:    "mail.example.com",
+					Content: "v=spf1 -all",
+				}},
+			},
+		},
+	}
+
+	names := func(changeset provider.ChangeSet) ([]string, []string) {
+		changed, conflicting := []string{}, []string{}
+		for _, change := range changeset.Changes {
+			changed = append(changed, change.Name)
+		}
+
+		for _, conflict := range changeset.Conflicts {
+			conflicting = append(conflicting, conflict.Name)
+		}
+
+		return changed, conflicting
+	}
+
+	changed, conflicting := names(provider.TunnelDNSChangeSet(context.Background(), "tunnel123", rules, zoneMap, provider.ChangeSetOptions{ConflictPolicy: provider.ConflictPolicyRefuse}))
+	assert.Empty(t, changed)
+	assert.ElementsMatch(t, []string{"a.example.com", "owned.example.com", "other.example.com", "mail.example.com", "mail.example.com"}, conflicting)
+
+	changed, conflicting = names(provider.TunnelDNSChangeSet(context.Background(), "tunnel123", rules, zoneMap, provider.ChangeSetOptions{ConflictPolicy: provider.ConflictPolicyOwned}))
+	assert.ElementsMatch(t, []string{"owned.example.com"}, changed)
+	assert.ElementsMatch(t, []string{"a.example.com", "other.example.com", "mail.example.com", "mail.example.com"}, conflicting)
+
+	changed, conflicting = names(provider.TunnelDNSChangeSet(context.Background(), "tunnel123", rules, zoneMap, provider.ChangeSetOptions{ConflictPolicy: provider.ConflictPolicyAdopt}))
+	assert.ElementsMatch(t, []string{"owned.example.com", "other.example.com"}, changed)
+	assert.ElementsMatch(t, []string{"a.example.com", "mail.example.com", "mail.example.com"}, conflicting)
+}
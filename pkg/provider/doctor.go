@@ -0,0 +1,277 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/rs/zerolog/log"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// DoctorCheck is the outcome of a single check of the credentials
+type DoctorCheck struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	// Skipped is set when the check could not be made, it does not fail
+	Skipped bool   `json:"skipped,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// DoctorReport lists the outcome of every check of the credentials
+type DoctorReport []DoctorCheck
+
+func (r *DoctorReport) pass(name, format string, args ...any) {
+	*r = append(*r, DoctorCheck{Name: name, Passed: true, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (r *DoctorReport) skip(name, format string, args ...any) {
+	*r = append(*r, DoctorCheck{Name: name, Passed: true, Skipped: true, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (r *DoctorReport) fail(name string, err error) {
+	*r = append(*r, DoctorCheck{Name: name, Passed: false, Detail: err.Error()})
+}
+
+// Passed reports whether every check passed
+func (r DoctorReport) Passed() bool {
+	for _, check := range r {
+		if !check.Passed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Print writes a line per check
+func (r DoctorReport) Print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, check := range r {
+		result := "PASS"
+		if check.Skipped {
+			result = "SKIP"
+		} else if !check.Passed {
+			result = "FAIL"
+		}
+
+		if _, err := fmt.Fprintf(tw, "%s\t%s\t%s\n", result, check.Name, check.Detail); err != nil {
+			return err
+		}
+	}
+
+	return tw.Flush()
+}
+
+// DoctorZones returns the zones matching the domain filter
+func DoctorZones(zones []cloudflare.Zone, domainFilter []string) []cloudflare.Zone {
+	filter := endpoint.NewDomainFilter(domainFilter)
+	matched := []cloudflare.Zone{}
+	for _, zone := range zones {
+		if filter.Match(zone.Name) {
+			matched = append(matched, zone)
+		}
+	}
+
+	return matched
+}
+
+// Permission groups of the api token needed to write what the provider manages
+var (
+	tunnelWritePermissions = []string{"Cloudflare Tunnel Write"}
+	dnsWritePermissions    = []string{"DNS Write"}
+	accessWritePermissions = []string{"Access: Apps and Policies Write"}
+	routesWritePermissions = []string{"Cloudflare Tunnel Write", "Cloudflare One Networks Write"}
+)
+
+// accountResource names the account in api token policies
+func accountResource(accountID string) string {
+	return "com.cloudflare.api.account." + accountID
+}
+
+// zoneResource names the zone in api token policies
+func zoneResource(zoneID string) string {
+	return "com.cloudflare.api.account.zone." + zoneID
+}
+
+// TokenAllows reports whether the api token policies grant one of the
+// permission groups on the resource, and none deny it. The resource is given
+// as its path of scopes, e.g. the account then the zone, as policies may nest
+// the zones of an account under it
+func TokenAllows(policies []cloudflare.APITokenPolicies, groups []string, scopes ...string) bool {
+	allowed := false
+	for _, policy := range policies {
+		granted := slices.ContainsFunc(policy.PermissionGroups, func(group cloudflare.APITokenPermissionGroups) bool {
+			return slices.Contains(groups, group.Name)
+		})
+
+		if !granted || !policyCovers(policy.Resources, scopes...) {
+			continue
+		}
+
+		if policy.Effect == "deny" {
+			return false
+		}
+
+		allowed = true
+	}
+
+	return allowed
+}
+
+// policyCovers reports whether the policy resources include the resource at
+// the end of the scopes, either directly or nested under the scopes before it
+func policyCovers(resources map[string]any, scopes ...string) bool {
+	for key, value := range resources {
+		if nested, ok := value.(map[string]any); ok {
+			if len(scopes) > 1 && resourceMatches(key, scopes[0]) && policyCovers(nested, scopes[1:]...) {
+				return true
+			}
+		} else if resourceMatches(key, scopes[len(scopes)-1]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resourceMatches reports whether the policy resource, which may end in a
+// wildcard, matches the resource
+func resourceMatches(key, resource string) bool {
+	prefix, wildcard := strings.CutSuffix(key, "*")
+	if !wildcard {
+		return key == resource
+	}
+
+	id, ok := strings.CutPrefix(resource, prefix)
+	return ok && id != "" && !strings.Contains(id, ".")
+}
+
+// Doctor checks the token is valid, the account and tunnel resolve, and the
+// token can read and write everything the provider manages, without mutating
+// anything. Write permissions are read from the policies of the token
+func (p CloudflareTunnelProvider) Doctor(ctx context.Context) DoctorReport {
+	report := DoctorReport{}
+
+	token, err := p.Cloudflare.VerifyToken(ctx)
+	if err != nil {
+		report.fail("token", err)
+	} else if token == nil {
+		report.pass("token", "using api key")
+	} else if token.Status != "active" {
+		report.fail("token", fmt.Errorf("token %s is %s", token.ID, token.Status))
+	} else if !token.ExpiresOn.IsZero() {
+		report.pass("token", "active, expires %s", token.ExpiresOn.Format(time.RFC3339))
+	} else {
+		report.pass("token", "active")
+	}
+
+	// unchecked is why write permissions could not be checked
+	var policies []cloudflare.APITokenPolicies
+	unchecked := ""
+	if err != nil || (token != nil && token.Status != "active") {
+		unchecked = "token is not valid"
+	} else if token == nil {
+		unchecked = "not checked when using an api key"
+	} else if policies, err = p.Cloudflare.GetTokenPolicies(ctx, token.ID); err != nil {
+		log.Debug().Err(err).Msg("failed to read the policies of the api token")
+		unchecked = "token cannot read its own policies, grant it the API Tokens Read permission to check"
+	}
+
+	write := func(name string, groups []string, scopes ...string) {
+		if unchecked != "" {
+			report.skip(name, "%s", unchecked)
+		} else if !TokenAllows(policies, groups, scopes...) {
+			report.fail(name, fmt.Errorf("token is missing the %s permission", strings.Join(groups, " or ")))
+		} else {
+			report.pass(name, "")
+		}
+	}
+
+	if tunnels, err := p.Cloudflare.ListTunnelsByName(ctx, p.CloudflareAccountID, ""); err != nil {
+		report.fail("account", err)
+	} else {
+		report.pass("account", "%s, %d tunnels", p.CloudflareAccountID, len(tunnels))
+	}
+
+	if p.CloudflareTunnelID == "" {
+		report.fail("tunnel", fmt.Errorf("tunnel does not exist yet"))
+	} else if tunnel, err := p.Cloudflare.GetTunnel(ctx, p.CloudflareAccountID, p.CloudflareTunnelID); err != nil {
+		report.fail("tunnel", err)
+	} else if tunnel.DeletedAt != nil {
+		report.fail("tunnel", fmt.Errorf("tunnel %s was deleted at %s", tunnel.ID, tunnel.DeletedAt))
+	} else if !tunnel.RemoteConfig {
+		report.fail("tunnel", fmt.Errorf("tunnel %s is locally managed", tunnel.ID))
+	} else {
+		report.pass("tunnel", "%s (%s), %s", tunnel.Name, tunnel.ID, tunnel.Status)
+	}
+
+	if p.CloudflareTunnelID != "" {
+		if tunnel, err := p.Cloudflare.GetTunnelConfiguration(ctx, p.CloudflareAccountID, p.CloudflareTunnelID); err != nil {
+			report.fail("tunnel read", err)
+		} else {
+			report.pass("tunnel read", "%d ingress rules", len(tunnel.Config.Ingress))
+		}
+	}
+
+	write("tunnel write", tunnelWritePermissions, accountResource(p.CloudflareAccountID))
+
+	zones, err := p.Cloudflare.ListZones(ctx)
+	if err != nil {
+		report.fail("zones", err)
+	} else if zones = DoctorZones(zones, p.DomainFilter); len(zones) == 0 {
+		report.fail("zones", fmt.Errorf("no zones matching the domain filter are visible"))
+	} else {
+		names := []string{}
+		for _, zone := range zones {
+			names = append(names, zone.Name)
+		}
+
+		report.pass("zones", "%s", strings.Join(names, ", "))
+	}
+
+	for _, zone := range zones {
+		if records, err := p.Cloudflare.ListZoneRecords(ctx, zone.ID); err != nil {
+			report.fail("dns read "+zone.Name, err)
+		} else {
+			report.pass("dns read "+zone.Name, "%d records", len(records))
+		}
+
+		write("dns write "+zone.Name, dnsWritePermissions, accountResource(p.CloudflareAccountID), zoneResource(zone.ID))
+	}
+
+	if p.AccessEnabled {
+		if applications, err := p.Cloudflare.ListAccessApplications(ctx, p.CloudflareAccountID); err != nil {
+			report.fail("access read", err)
+		} else {
+			report.pass("access read", "%d applications", len(applications))
+		}
+
+		write("access write", accessWritePermissions, accountResource(p.CloudflareAccountID))
+	}
+
+	if p.PrivateNetworksEnabled {
+		if networks, err := p.Cloudflare.ListVirtualNetworks(ctx, p.CloudflareAccountID); err != nil {
+			report.fail("virtual networks read", err)
+		} else {
+			report.pass("virtual networks read", "%d virtual networks", len(networks))
+		}
+
+		if p.CloudflareTunnelID != "" {
+			if routes, err := p.Cloudflare.ListTunnelRoutes(ctx, p.CloudflareAccountID, p.CloudflareTunnelID); err != nil {
+				report.fail("routes read", err)
+			} else {
+				report.pass("routes read", "%d routes", len(routes))
+			}
+		}
+
+		write("routes write", routesWritePermissions, accountResource(p.CloudflareAccountID))
+	}
+
+	return report
+}
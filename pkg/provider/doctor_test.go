@@ -0,0 +1,79 @@
+package provider_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDoctorReport(t *testing.T) {
+	report := provider.DoctorReport{
+		{Name: "token", Passed: true, Detail: "active"},
+		{Name: "dns write example.com", Passed: false, Detail: "forbidden"},
+		{Name: "access write", Passed: true, Skipped: true, Detail: "not checked"},
+	}
+
+	assert.False(t, report.Passed())
+	assert.True(t, report[:1].Passed())
+	assert.True(t, report[2:].Passed())
+
+	buf := bytes.Buffer{}
+	assert.NoError(t, report.Print(&buf))
+	assert.Equal(t, ""+
+		"PASS  token                  active\n"+
+		"FAIL  dns write example.com  forbidden\n"+
+		"SKIP  access write           not checked\n",
+		buf.String())
+}
+
+func TestDoctorZones(t *testing.T) {
+	zones := []cloudflare.Zone{{Name: "example.com"}, {Name: "example.net"}}
+	assert.Equal(t, zones, provider.DoctorZones(zones, nil))
+	assert.Equal(t, zones[1:], provider.DoctorZones(zones, []string{"example.net"}))
+}
+
+func TestTokenAllows(t *testing.T) {
+	account := "com.cloudflare.api.account.acc123"
+	zone := "com.cloudflare.api.account.zone.zone123"
+	dns := []string{"DNS Write"}
+	policy := func(effect, group string, resources map[string]any) cloudflare.APITokenPolicies {
+		return cloudflare.APITokenPolicies{
+			Effect:           effect,
+			Resources:        resources,
+			PermissionGroups: []cloudflare.APITokenPermissionGroups{{Name: group}},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		policies []cloudflare.APITokenPolicies
+		expected bool
+	}{
+		{"no policies", nil, false},
+		{"zone", []cloudflare.APITokenPolicies{policy("allow", "DNS Write", map[string]any{zone: "*"})}, true},
+		{"other zone", []cloudflare.APITokenPolicies{policy("allow", "DNS Write", map[string]any{"com.cloudflare.api.account.zone.zone456": "*"})}, false},
+		{"all zones", []cloudflare.APITokenPolicies{policy("allow", "DNS Write", map[string]any{"com.cloudflare.api.account.zone.*": "*"})}, true},
+		{"all zones of the account", []cloudflare.APITokenPolicies{policy("allow", "DNS Write", map[string]any{account: map[string]any{"com.cloudflare.api.account.zone.*": "*"}})}, true},
+		{"all zones of another account", []cloudflare.APITokenPolicies{policy("allow", "DNS Write", map[string]any{"com.cloudflare.api.account.acc456": map[string]any{"com.cloudflare.api.account.zone.*": "*"}})}, false},
+		{"account is not a zone", []cloudflare.APITokenPolicies{policy("allow", "DNS Write", map[string]any{"com.cloudflare.api.account.*": "*"})}, false},
+		{"read only", []cloudflare.APITokenPolicies{policy("allow", "DNS Read", map[string]any{zone: "*"})}, false},
+		{"denied", []cloudflare.APITokenPolicies{
+			policy("allow", "DNS Write", map[string]any{"com.cloudflare.api.account.zone.*": "*"}),
+			policy("deny", "DNS Write", map[string]any{zone: "*"}),
+		}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, provider.TokenAllows(test.policies, dns, account, zone))
+		})
+	}
+
+	tunnel := []string{"Cloudflare Tunnel Write"}
+	assert.True(t, provider.TokenAllows([]cloudflare.APITokenPolicies{policy("allow", "Cloudflare Tunnel Write", map[string]any{account: "*"})}, tunnel, account))
+	assert.True(t, provider.TokenAllows([]cloudflare.APITokenPolicies{policy("allow", "Cloudflare Tunnel Write", map[string]any{"com.cloudflare.api.account.*": "*"})}, tunnel, account))
+	assert.False(t, provider.TokenAllows([]cloudflare.APITokenPolicies{policy("allow", "Cloudflare Tunnel Write", map[string]any{zone: "*"})}, tunnel, account))
+}
@@ -0,0 +1,275 @@
+package provider_test
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/cf"
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// fakeCloudflare is an in memory account, calls it does not implement panic
+type fakeCloudflare struct {
+	cf.Cloudflare
+
+	mu       sync.Mutex
+	ingress  map[string][]cloudflare.UnvalidatedIngressRule
+	zones    []cloudflare.Zone
+	records  []cloudflare.DNSRecord
+	apps     []cloudflare.AccessApplication
+	routes   []cloudflare.TunnelRoute
+	networks []cloudflare.TunnelVirtualNetwork
+	tunnels  []cloudflare.Tunnel
+	nextID   int
+
+	connections []cloudflare.Connection
+	healthCalls int
+
+	// onUpdateIngress is called before the ingress rules of a tunnel are updated
+	onUpdateIngress func(tunnelID string, ingress []cloudflare.UnvalidatedIngressRule) error
+	// onChangeRecord is called before a dns record is changed
+	onChangeRecord func(name string) error
+}
+
+func newFakeCloudflare(zones ...string) *fakeCloudflare {
+	f := fakeCloudflare{ingress: map[string][]cloudflare.UnvalidatedIngressRule{}}
+	for _, zone := range zones {
+		f.zones = append(f.zones, cloudflare.Zone{ID: "zone-" + zone, Name: zone})
+	}
+
+	return &f
+}
+
+func (f *fakeCloudflare) id(prefix string) string {
+	f.nextID++
+	return fmt.Sprintf("%s%d", prefix, f.nextID)
+}
+
+func (f *fakeCloudflare) Ingress(tunnelID string) []cloudflare.UnvalidatedIngressRule {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.ingress[tunnelID])
+}
+
+func (f *fakeCloudflare) RecordNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	names := []string{}
+	for _, record := range f.records {
+		names = append(names, record.Name)
+	}
+
+	slices.Sort(names)
+	return names
+}
+
+func (f *fakeCloudflare) RecordContent(name string) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, record := range f.records {
+		if record.Name == name {
+			return record.Content
+		}
+	}
+
+	return ""
+}
+
+func (f *fakeCloudflare) AddRecord(zone, name, content string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records = append(f.records, cloudflare.DNSRecord{ID: f.id("record"), ZoneID: "zone-" + zone, Type: "CNAME", Name: name, Content: content})
+}
+
+func (f *fakeCloudflare) GetTunnelConfiguration(ctx context.Context, accountID, tunnelID string) (*cloudflare.TunnelConfigurationResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	result := cloudflare.TunnelConfigurationResult{TunnelID: tunnelID}
+	result.Config.Ingress = slices.Clone(f.ingress[tunnelID])
+	return &result, nil
+}
+
+func (f *fakeCloudflare) UpdateTunnelIngress(ctx context.Context, accountID, tunnelID string, ingress []cloudflare.UnvalidatedIngressRule) error {
+	if f.onUpdateIngress != nil {
+		if err := f.onUpdateIngress(tunnelID, ingress); err != nil {
+			return err
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ingress[tunnelID] = slices.Clone(ingress)
+	return nil
+}
+
+func (f *fakeCloudflare) ListZones(ctx context.Context) ([]cloudflare.Zone, error) {
+	return f.zones, nil
+}
+
+func (f *fakeCloudflare) ListAllZoneRecords(ctx context.Context) ([]cloudflare.DNSRecord, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.records), nil
+}
+
+func (f *fakeCloudflare) ListZoneRecords(ctx context.Context, zoneID string) ([]cloudflare.DNSRecord, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	records := []cloudflare.DNSRecord{}
+	for _, record := range f.records {
+		if record.ZoneID == zoneID {
+			records = append(records, record)
+		}
+	}
+
+	return records, nil
+}
+
+func (f *fakeCloudflare) changeRecord(ctx context.Context, name string) error {
+	if f.onChangeRecord != nil {
+		if err := f.onChangeRecord(name); err != nil {
+			return err
+		}
+	}
+
+	return ctx.Err()
+}
+
+func (f *fakeCloudflare) CreateDNSRecord(ctx context.Context, record cloudflare.DNSRecord) error {
+	if err := f.changeRecord(ctx, record.Name); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	record.ID = f.id("record")
+	f.records = append(f.records, record)
+	return nil
+}
+
+func (f *fakeCloudflare) DeleteDNSRecord(ctx context.Context, zoneID, recordID string) error {
+	f.mu.Lock()
+	index := slices.IndexFunc(f.records, func(r cloudflare.DNSRecord) bool { return r.ID == recordID })
+	name := ""
+	if index >= 0 {
+		name = f.records[index].Name
+	}
+	f.mu.Unlock()
+
+	if index < 0 {
+		return fmt.Errorf("record %s not found", recordID)
+	}
+
+	if err := f.changeRecord(ctx, name); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.records = slices.DeleteFunc(f.records, func(r cloudflare.DNSRecord) bool { return r.ID == recordID })
+	return nil
+}
+
+func (f *fakeCloudflare) UpdateDNSRecord(ctx context.Context, record cloudflare.DNSRecord) error {
+	if err := f.changeRecord(ctx, record.Name); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.records {
+		if f.records[i].ID == record.ID {
+			f.records[i] = record
+			return nil
+		}
+	}
+
+	return fmt.Errorf("record %s not found", record.ID)
+}
+
+func (f *fakeCloudflare) ListAccessApplications(ctx context.Context, accountID string) ([]cloudflare.AccessApplication, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.apps), nil
+}
+
+func (f *fakeCloudflare) UpdateAccessApplication(ctx context.Context, accountID string, params cloudflare.UpdateAccessApplicationParams) (*cloudflare.AccessApplication, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := range f.apps {
+		if f.apps[i].ID == params.ID {
+			f.apps[i].Name = params.Name
+			f.apps[i].Domain = params.Domain
+			f.apps[i].Type = params.Type
+			return &f.apps[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("access application %s not found", params.ID)
+}
+
+func (f *fakeCloudflare) ListAccessPolicies(ctx context.Context, accountID, applicationID string) ([]cloudflare.AccessPolicy, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, app := range f.apps {
+		if app.ID == applicationID {
+			return []cloudflare.AccessPolicy{{ID: "policy-" + app.ID, Name: app.Name, Decision: "allow"}}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("access application %s not found", applicationID)
+}
+
+func (f *fakeCloudflare) ListVirtualNetworks(ctx context.Context, accountID string) ([]cloudflare.TunnelVirtualNetwork, error) {
+	return f.networks, nil
+}
+
+func (f *fakeCloudflare) ListTunnelsByName(ctx context.Context, accountID, name string) ([]cloudflare.Tunnel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tunnels := []cloudflare.Tunnel{}
+	for _, tunnel := range f.tunnels {
+		if tunnel.Name == name {
+			tunnels = append(tunnels, tunnel)
+		}
+	}
+
+	return tunnels, nil
+}
+
+func (f *fakeCloudflare) CreateTunnel(ctx context.Context, accountID string, params cloudflare.TunnelCreateParams) (*cloudflare.Tunnel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tunnel := cloudflare.Tunnel{ID: f.id("tunnel"), Name: params.Name, Secret: params.Secret, RemoteConfig: params.ConfigSrc == "cloudflare"}
+	f.tunnels = append(f.tunnels, tunnel)
+	return &tunnel, nil
+}
+
+func (f *fakeCloudflare) GetTunnelToken(ctx context.Context, accountID, tunnelID string) (string, error) {
+	return "token-" + tunnelID, nil
+}
+
+func (f *fakeCloudflare) GetTunnel(ctx context.Context, accountID, tunnelID string) (*cloudflare.Tunnel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.healthCalls++
+	return &cloudflare.Tunnel{ID: tunnelID}, nil
+}
+
+func (f *fakeCloudflare) ListTunnelConnections(ctx context.Context, accountID, tunnelID string) ([]cloudflare.Connection, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.connections), nil
+}
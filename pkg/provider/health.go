@@ -0,0 +1,208 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/metrics"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/rs/zerolog/log"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+var ErrNoActiveConnections = errors.New("tunnel has no active connections")
+
+// HealthCacheTTL is how long the health of the tunnel is reused for, so
+// frequent readiness probes and applies do not each call the api
+const HealthCacheTTL = 5 * time.Second
+
+type ConnectorGuard string
+
+const (
+	// ConnectorGuardOff creates hostnames regardless of the connectors
+	ConnectorGuardOff ConnectorGuard = "off"
+	// ConnectorGuardWarn logs hostnames created while the tunnel has no active
+	// connections
+	ConnectorGuardWarn ConnectorGuard = "warn"
+	// ConnectorGuardRefuse skips creating hostnames while the tunnel has no
+	// active connections
+	ConnectorGuardRefuse ConnectorGuard = "refuse"
+)
+
+// ConnectorHealth describes a cloudflared connector of the tunnel
+type ConnectorHealth struct {
+	ID                string   `json:"id"`
+	Version           string   `json:"version"`
+	Arch              string   `json:"arch"`
+	ActiveConnections int      `json:"activeConnections"`
+	Colos             []string `json:"colos"`
+}
+
+// TunnelHealth describes the tunnel and its connectors
+type TunnelHealth struct {
+	TunnelID          string            `json:"tunnelId"`
+	Name              string            `json:"name"`
+	Status            string            `json:"status"`
+	Connected         bool              `json:"connected"`
+	ActiveConnections int               `json:"activeConnections"`
+	Connectors        []ConnectorHealth `json:"connectors"`
+}
+
+// NewTunnelHealth summarises the connectors of the tunnel, connections pending
+// reconnection are not active
+func NewTunnelHealth(tunnel cloudflare.Tunnel, connectors []cloudflare.Connection) TunnelHealth {
+	health := TunnelHealth{
+		TunnelID:   tunnel.ID,
+		Name:       tunnel.Name,
+		Status:     tunnel.Status,
+		Connectors: []ConnectorHealth{},
+	}
+
+	for _, connector := range connectors {
+		connectorHealth := ConnectorHealth{
+			ID:      connector.ID,
+			Version: connector.Version,
+			Arch:    connector.Arch,
+			Colos:   []string{},
+		}
+
+		for _, connection := range connector.Connections {
+			if connection.IsPendingReconnect {
+				continue
+			}
+
+			connectorHealth.ActiveConnections++
+			connectorHealth.Colos = append(connectorHealth.Colos, connection.ColoName)
+		}
+
+		slices.Sort(connectorHealth.Colos)
+		health.ActiveConnections += connectorHealth.ActiveConnections
+		health.Connectors = append(health.Connectors, connectorHealth)
+	}
+
+	health.Connected = health.ActiveConnections > 0
+	return health
+}
+
+func (h TunnelHealth) record() {
+	metrics.TunnelActiveConnections.Set(float64(h.ActiveConnections))
+	metrics.TunnelConnectorConnections.Reset()
+	for _, connector := range h.Connectors {
+		metrics.TunnelConnectorConnections.
+			WithLabelValues(connector.ID, connector.Version, connector.Arch).
+			Set(float64(connector.ActiveConnections))
+	}
+}
+
+// HealthCache holds the last health of the tunnel, it is shared by copies of
+// the provider
+type HealthCache struct {
+	TTL time.Duration
+
+	mu      sync.Mutex
+	health  TunnelHealth
+	fetched time.Time
+}
+
+func NewHealthCache(ttl time.Duration) *HealthCache {
+	return &HealthCache{TTL: ttl}
+}
+
+// Get returns the cached health, or fetches it if it has expired, errors are
+// not cached
+func (c *HealthCache) Get(ctx context.Context, fetch func(context.Context) (*TunnelHealth, error)) (*TunnelHealth, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.fetched.IsZero() && time.Since(c.fetched) < c.TTL {
+		health := c.health
+		return &health, nil
+	}
+
+	health, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.health, c.fetched = *health, time.Now()
+	return health, nil
+}
+
+// TunnelHealth checks the credentials, account and tunnel can be read, and
+// reports the connectors of the tunnel, reusing the cached health if any
+func (p CloudflareTunnelProvider) TunnelHealth(ctx context.Context) (*TunnelHealth, error) {
+	if p.HealthCache != nil {
+		return p.HealthCache.Get(ctx, p.tunnelHealth)
+	}
+
+	return p.tunnelHealth(ctx)
+}
+
+func (p CloudflareTunnelProvider) tunnelHealth(ctx context.Context) (*TunnelHealth, error) {
+	tunnel, err := p.Cloudflare.GetTunnel(ctx, p.CloudflareAccountID, p.CloudflareTunnelID)
+	if err != nil {
+		return nil, err
+	}
+
+	if tunnel.DeletedAt != nil {
+		return nil, fmt.Errorf("tunnel %s was deleted at %s", tunnel.ID, tunnel.DeletedAt)
+	}
+
+	connectors, err := p.Cloudflare.ListTunnelConnections(ctx, p.CloudflareAccountID, p.CloudflareTunnelID)
+	if err != nil {
+		return nil, err
+	}
+
+	health := NewTunnelHealth(*tunnel, connectors)
+	health.record()
+	return &health, nil
+}
+
+// Ready reports the health of the tunnel. It only fails for a tunnel without
+// active connections if required, as cloudflared may depend on the webhook
+// being ready, e.g. to fetch its token through a Service
+func (p CloudflareTunnelProvider) Ready(ctx context.Context) (*TunnelHealth, error) {
+	health, err := p.TunnelHealth(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !health.Connected && p.ReadinessRequireConnectors {
+		return health, ErrNoActiveConnections
+	}
+
+	return health, nil
+}
+
+// guardConnectors warns about or drops the hostnames being created while the
+// tunnel has no active connections, depending on the connector guard
+func (p CloudflareTunnelProvider) guardConnectors(ctx context.Context, changes *plan.Changes) error {
+	if p.ConnectorGuard == "" || p.ConnectorGuard == ConnectorGuardOff || len(changes.Create) == 0 {
+		return nil
+	}
+
+	health, err := p.TunnelHealth(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check tunnel health: %w", err)
+	}
+
+	if health.ActiveConnections > 0 {
+		return nil
+	}
+
+	hostnames := endpointNames(changes.Create)
+	if p.ConnectorGuard == ConnectorGuardWarn {
+		log.Warn().Strs("hostnames", hostnames).Msg("creating hostnames while the tunnel has no active connections")
+		return nil
+	}
+
+	log.Warn().Strs("hostnames", hostnames).Msg("not creating hostnames while the tunnel has no active connections")
+	metrics.ConnectorGuardRejections.Add(float64(len(hostnames)))
+	changes.Create = []*endpoint.Endpoint{}
+	return nil
+}
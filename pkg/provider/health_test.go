@@ -0,0 +1,121 @@
+package provider_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestNewTunnelHealth(t *testing.T) {
+	tunnel := cloudflare.Tunnel{ID: "tunnel456", Name: "tunnel", Status: "degraded"}
+	connectors := []cloudflare.Connection{
+		{
+			ID:      "connector1",
+			Version: "2024.6.1",
+			Arch:    "linux_amd64",
+			Connections: []cloudflare.TunnelConnection{
+				{ColoName: "syd01"},
+				{ColoName: "mel01"},
+				{ColoName: "syd02", IsPendingReconnect: true},
+			},
+		},
+		{
+			ID:      "connector2",
+			Version: "2024.6.1",
+			Arch:    "linux_arm64",
+		},
+	}
+
+	assert.Equal(t, provider.TunnelHealth{
+		TunnelID:          "tunnel456",
+		Name:              "tunnel",
+		Status:            "degraded",
+		Connected:         true,
+		ActiveConnections: 2,
+		Connectors: []provider.ConnectorHealth{
+			{ID: "connector1", Version: "2024.6.1", Arch: "linux_amd64", ActiveConnections: 2, Colos: []string{"mel01", "syd01"}},
+			{ID: "connector2", Version: "2024.6.1", Arch: "linux_arm64", ActiveConnections: 0, Colos: []string{}},
+		},
+	}, provider.NewTunnelHealth(tunnel, connectors))
+
+	assert.Equal(t, 0, provider.NewTunnelHealth(tunnel, nil).ActiveConnections)
+}
+
+func TestConnectorGuard(t *testing.T) {
+	create := func() *plan.Changes {
+		return &plan.Changes{Create: []*endpoint.Endpoint{
+			endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeCNAME, "http://a"),
+		}}
+	}
+
+	newFake := func() *fakeCloudflare {
+		fake := newFakeCloudflare("example.com")
+		fake.ingress["tunnel123"] = []cloudflare.UnvalidatedIngressRule{{Service: "http_status:404"}}
+		return fake
+	}
+
+	for _, guard := range []provider.ConnectorGuard{provider.ConnectorGuardOff, provider.ConnectorGuardWarn} {
+		fake := newFake()
+		p := provider.CloudflareTunnelProvider{Cloudflare: fake, CloudflareTunnelID: "tunnel123", ConnectorGuard: guard}
+
+		assert.NoError(t, p.ApplyChanges(context.Background(), create()), guard)
+		assert.Equal(t, []string{"a.example.com"}, fake.RecordNames(), guard)
+	}
+
+	fake := newFake()
+	p := provider.CloudflareTunnelProvider{Cloudflare: fake, CloudflareTunnelID: "tunnel123", ConnectorGuard: provider.ConnectorGuardRefuse}
+
+	assert.NoError(t, p.ApplyChanges(context.Background(), create()))
+	assert.Empty(t, fake.RecordNames())
+	assert.Equal(t, []cloudflare.UnvalidatedIngressRule{{Service: "http_status:404"}}, fake.Ingress("tunnel123"))
+
+	fake.connections = []cloudflare.Connection{{ID: "connector1", Connections: []cloudflare.TunnelConnection{{ColoName: "syd01"}}}}
+	assert.NoError(t, p.ApplyChanges(context.Background(), create()))
+	assert.Equal(t, []string{"a.example.com"}, fake.RecordNames())
+}
+
+func TestReady(t *testing.T) {
+	fake := newFakeCloudflare()
+	p := provider.CloudflareTunnelProvider{Cloudflare: fake, CloudflareTunnelID: "tunnel123"}
+
+	health, err := p.Ready(context.Background())
+	assert.NoError(t, err)
+	assert.False(t, health.Connected)
+
+	p.ReadinessRequireConnectors = true
+	health, err = p.Ready(context.Background())
+	assert.ErrorIs(t, err, provider.ErrNoActiveConnections)
+	assert.False(t, health.Connected)
+
+	fake.connections = []cloudflare.Connection{{ID: "connector1", Connections: []cloudflare.TunnelConnection{{ColoName: "syd01"}}}}
+	health, err = p.Ready(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, health.Connected)
+}
+
+func TestHealthCache(t *testing.T) {
+	fake := newFakeCloudflare()
+	fake.connections = []cloudflare.Connection{{ID: "connector1", Connections: []cloudflare.TunnelConnection{{ColoName: "syd01"}}}}
+	p := provider.CloudflareTunnelProvider{Cloudflare: fake, CloudflareTunnelID: "tunnel123", HealthCache: provider.NewHealthCache(time.Minute)}
+
+	for range 3 {
+		health, err := p.Ready(context.Background())
+		assert.NoError(t, err)
+		assert.Equal(t, 1, health.ActiveConnections)
+	}
+
+	assert.Equal(t, 1, fake.healthCalls)
+
+	p.HealthCache.TTL = 0
+	_, err := p.Ready(context.Background())
+	assert.NoError(t, err)
+	_, err = p.Ready(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, fake.healthCalls)
+}
@@ -0,0 +1,87 @@
+package provider
+
+import (
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/net/idna"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// idnaProfile converts internationalised hostnames to their ASCII form,
+// allowing wildcard and underscore labels
+var idnaProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// NormaliseHostname converts the hostname to the form used for comparison:
+// lowercase, ASCII (punycode) and without a trailing dot
+func NormaliseHostname(hostname string) string {
+	hostname = strings.TrimSuffix(hostname, ".")
+	ascii, err := idnaProfile.ToASCII(hostname)
+	if err != nil {
+		log.Debug().Err(err).Str("hostname", hostname).Msg("failed to convert hostname to ascii")
+		return strings.ToLower(hostname)
+	}
+
+	return strings.ToLower(ascii)
+}
+
+// isSubdomain reports whether the hostname is the domain or falls under it on
+// a label boundary, e.g. "app.example.com" is under "example.com" but
+// "notexample.com" is not
+func isSubdomain(hostname, domain string) bool {
+	hostname, domain = NormaliseHostname(hostname), NormaliseHostname(domain)
+	return hostname == domain || strings.HasSuffix(hostname, "."+domain)
+}
+
+// IsWildcard reports whether the hostname is a wildcard, e.g. "*.example.com"
+func IsWildcard(hostname string) bool {
+	return strings.HasPrefix(hostname, "*.")
+}
+
+// coveringWildcard returns the wildcard hostname which would match the
+// hostname, e.g. "app.example.com" is covered by "*.example.com"
+func coveringWildcard(hostname string) string {
+	_, parent, ok := strings.Cut(NormaliseHostname(hostname), ".")
+	if !ok {
+		return ""
+	}
+
+	return "*." + parent
+}
+
+// NormaliseRules returns a copy of the rules with normalised hostnames
+func NormaliseRules(rules Rules) Rules {
+	normalised := make(Rules, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Hostname != "" {
+			rule.Hostname = NormaliseHostname(rule.Hostname)
+		}
+
+		normalised = append(normalised, rule)
+	}
+
+	return normalised
+}
+
+// NormaliseEndpoints returns a copy of the endpoints with normalised dns names
+func NormaliseEndpoints(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+	normalised := make([]*endpoint.Endpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		copied := *e
+		copied.DNSName = NormaliseHostname(e.DNSName)
+		normalised = append(normalised, &copied)
+	}
+
+	return normalised
+}
+
+// NormaliseChanges returns a copy of the changes with normalised dns names
+func NormaliseChanges(changes *plan.Changes) *plan.Changes {
+	return &plan.Changes{
+		Create:    NormaliseEndpoints(changes.Create),
+		UpdateOld: NormaliseEndpoints(changes.UpdateOld),
+		UpdateNew: NormaliseEndpoints(changes.UpdateNew),
+		Delete:    NormaliseEndpoints(changes.Delete),
+	}
+}
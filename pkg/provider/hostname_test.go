@@ -0,0 +1,50 @@
+package provider_test
+
+import (
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestNormaliseHostname(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{input: "app.example.com", expected: "app.example.com"},
+		{input: "APP.Example.COM", expected: "app.example.com"},
+		{input: "app.example.com.", expected: "app.example.com"},
+		{input: "bücher.example.com", expected: "xn--bcher-kva.example.com"},
+		{input: "xn--bcher-kva.example.com", expected: "xn--bcher-kva.example.com"},
+		{input: "*.example.com", expected: "*.example.com"},
+		{input: "_acme.example.com", expected: "_acme.example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.input, func(t *testing.T) {
+			assert.Equal(t, test.expected, provider.NormaliseHostname(test.input))
+		})
+	}
+}
+
+func TestNormaliseEndpoints(t *testing.T) {
+	endpoints := []*endpoint.Endpoint{{DNSName: "Bücher.example.com."}}
+
+	normalised := provider.NormaliseEndpoints(endpoints)
+	assert.Equal(t, "xn--bcher-kva.example.com", normalised[0].DNSName)
+	assert.Equal(t, "Bücher.example.com.", endpoints[0].DNSName)
+}
+
+func TestRules_CreateRuleNormalised(t *testing.T) {
+	rules := provider.Rules{{Hostname: "App.Example.com", Service: "service1"}}
+
+	err := rules.CreateRule("app.example.com.", "service1", nil)
+	assert.NoError(t, err)
+	assert.Len(t, rules, 1)
+
+	err = rules.DeleteRule("APP.example.com", nil)
+	assert.NoError(t, err)
+	assert.Len(t, rules, 0)
+}
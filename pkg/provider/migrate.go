@@ -0,0 +1,576 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/cf"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/rs/zerolog/log"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+var (
+	ErrMigrationInProgress = errors.New("migration in progress, resume or roll it back first")
+	ErrMigrationRolledBack = errors.New("migration was rolled back, start a new migration instead")
+)
+
+// MigrationCheckpoint records the progress of moving hostnames from one tunnel
+// to another, the first Migrated hostnames have been moved
+type MigrationCheckpoint struct {
+	SourceTunnelID string   `json:"sourceTunnelId"`
+	TargetTunnelID string   `json:"targetTunnelId"`
+	Hostnames      []string `json:"hostnames"`
+	Migrated       int      `json:"migrated"`
+	// Pending is where the batch being migrated ends, the hostnames between
+	// Migrated and Pending may have been partially moved
+	Pending int `json:"pending"`
+	// Copied are the hostnames whose rules were added to the target tunnel,
+	// Replaced are the rules of the target tunnel which were replaced, so a
+	// rollback only undoes what the migration changed. Copied is nil for
+	// checkpoints which did not record them, every rule is then removed
+	Copied   []string `json:"copied"`
+	Replaced Rules    `json:"replaced,omitempty"`
+	// RolledBack is set once every hostname has been moved back
+	RolledBack bool `json:"rolledBack,omitempty"`
+}
+
+func (c MigrationCheckpoint) Complete() bool {
+	return c.Migrated >= len(c.Hostnames)
+}
+
+// InProgress reports whether hostnames may have been moved and not yet moved
+// back
+func (c MigrationCheckpoint) InProgress() bool {
+	return !c.Complete() && !c.RolledBack
+}
+
+// Moved returns the hostnames which may have been moved from the tunnel,
+// including the batch being migrated
+func (c MigrationCheckpoint) Moved(tunnelID string) []string {
+	if c.SourceTunnelID != tunnelID || c.RolledBack {
+		return nil
+	}
+
+	return c.Hostnames[:min(len(c.Hostnames), max(c.Migrated, c.Pending))]
+}
+
+// LoadMigrationCheckpoint reads the checkpoint, the error wraps os.ErrNotExist
+// if there is none
+func LoadMigrationCheckpoint(path string) (*MigrationCheckpoint, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migration checkpoint: %w", err)
+	}
+
+	var checkpoint MigrationCheckpoint
+	if err := json.Unmarshal(raw, &checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse migration checkpoint: %w", err)
+	}
+
+	return &checkpoint, nil
+}
+
+// SaveMigrationCheckpoint replaces the checkpoint, so it is never left
+// partially written
+func SaveMigrationCheckpoint(path string, checkpoint MigrationCheckpoint) error {
+	raw, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal migration checkpoint: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to save migration checkpoint: %w", err)
+	}
+
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save migration checkpoint: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save migration checkpoint: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to save migration checkpoint: %w", err)
+	}
+
+	return nil
+}
+
+// MigrationHostnames returns the hostnames of the rules which have a dns
+// record resolving to the tunnel, and of the rules without a record of their
+// own which resolve to the tunnel through a migrated wildcard record. Wildcards
+// are last, so the rules they cover are copied before they are repointed
+func MigrationHostnames(rules Rules, zoneMap ZoneMap, tunnelID string) []string {
+	rules = NormaliseRules(rules)
+	resolves := func(hostname string) bool {
+		record := zoneMap.GetRecordByName(hostname)
+		return record != nil && record.Content == TunnelURI(tunnelID)
+	}
+
+	migrated := map[string]bool{}
+	for _, rule := range rules {
+		if rule.Hostname != "" && resolves(rule.Hostname) {
+			migrated[rule.Hostname] = true
+		}
+	}
+
+	hostnames, wildcards := []string{}, []string{}
+	for _, rule := range rules {
+		switch {
+		case rule.Hostname == "" || slices.Contains(hostnames, rule.Hostname) || slices.Contains(wildcards, rule.Hostname):
+		case IsWildcard(rule.Hostname) && migrated[rule.Hostname]:
+			wildcards = append(wildcards, rule.Hostname)
+		case migrated[rule.Hostname]:
+			hostnames = append(hostnames, rule.Hostname)
+		case zoneMap.GetRecordByName(rule.Hostname) == nil && migrated[coveringWildcard(rule.Hostname)]:
+			hostnames = append(hostnames, rule.Hostname)
+		}
+	}
+
+	return append(hostnames, wildcards...)
+}
+
+// CopyRules copies the rules for the hostnames, replacing any existing rules
+// for them. A catch-all rule is added if there are no rules to copy to
+func CopyRules(from, to Rules, hostnames []string) Rules {
+	copied := slices.Clone(NormaliseRules(to))
+	if len(copied) == 0 {
+		copied = Rules{{Service: "http_status:404"}}
+	}
+
+	rules := Rules{}
+	for _, rule := range NormaliseRules(from) {
+		if rule.Hostname != "" && slices.Contains(hostnames, rule.Hostname) {
+			rules = append(rules, rule)
+		}
+	}
+
+	copied = append(rules, RemoveRules(copied, hostnames)...)
+	copied.Order()
+	return copied
+}
+
+// RemoveRules removes the rules for the hostnames
+func RemoveRules(rules Rules, hostnames []string) Rules {
+	return slices.DeleteFunc(slices.Clone(NormaliseRules(rules)), func(rule cloudflare.UnvalidatedIngressRule) bool {
+		return rule.Hostname != "" && slices.Contains(hostnames, rule.Hostname)
+	})
+}
+
+// MigrationDNSChanges repoints the records of the hostnames which resolve to
+// one tunnel to the other, the services of the rules are kept in the record
+// comments
+func MigrationDNSChanges(zoneMap ZoneMap, rules Rules, from, to string, hostnames []string) []Change {
+	services := map[string]string{}
+	for _, rule := range NormaliseRules(rules) {
+		services[rule.Hostname] = rule.Service
+	}
+
+	changes := []Change{}
+	for _, hostname := range hostnames {
+		record := zoneMap.GetRecordByName(hostname)
+		if record == nil || record.Content != TunnelURI(from) {
+			continue
+		}
+
+		changes = append(changes, Change{
+			Action:    ChangeTypeUpdate,
+			ZoneID:    record.ZoneID,
+			RecordID:  record.ID,
+			Name:      hostname,
+			TunnelURI: TunnelURI(to),
+			Service:   services[hostname],
+		})
+	}
+
+	return changes
+}
+
+// Migration moves hostnames from one tunnel to another in batches, saving a
+// checkpoint after each batch so it can be resumed or rolled back. Ingress
+// rules are copied to the target tunnel before the dns records are repointed,
+// the rules of the source tunnel are left in place, and the provider of the
+// source tunnel leaves the moved hostnames unchanged. The access applications
+// of the hostnames are transferred to the tunnel they are moved to
+type Migration struct {
+	Cloudflare     cf.Cloudflare
+	AccountID      string
+	BatchSize      int
+	CheckpointFile string
+	AccessEnabled  bool
+}
+
+// Start plans and runs a migration of every hostname of the source tunnel
+func (m Migration) Start(ctx context.Context, source, target string) (*MigrationCheckpoint, error) {
+	if err := m.CanStart(source, target); err != nil {
+		return nil, err
+	}
+
+	tunnel, err := m.Cloudflare.GetTunnelConfiguration(ctx, m.AccountID, source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get source tunnel configuration: %w", err)
+	}
+
+	zoneMap, err := GenerateZoneMap(ctx, m.Cloudflare)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate zone map: %w", err)
+	}
+
+	checkpoint := MigrationCheckpoint{
+		SourceTunnelID: source,
+		TargetTunnelID: target,
+		Hostnames:      MigrationHostnames(tunnel.Config.Ingress, *zoneMap, source),
+		Copied:         []string{},
+	}
+
+	if err := SaveMigrationCheckpoint(m.CheckpointFile, checkpoint); err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("source", source).Str("target", target).Strs("hostnames", checkpoint.Hostnames).Msg("starting migration")
+	return m.run(ctx, checkpoint)
+}
+
+// CanStart returns an error if a migration from the source to the target
+// cannot be started
+func (m Migration) CanStart(source, target string) error {
+	if source == target {
+		return fmt.Errorf("source and target tunnel are the same")
+	}
+
+	existing, err := LoadMigrationCheckpoint(m.CheckpointFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if existing != nil && existing.InProgress() {
+		return ErrMigrationInProgress
+	}
+
+	return nil
+}
+
+// Resumable returns the last checkpoint if the migration can be resumed
+func (m Migration) Resumable() (*MigrationCheckpoint, error) {
+	checkpoint, err := LoadMigrationCheckpoint(m.CheckpointFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if checkpoint.RolledBack {
+		return checkpoint, ErrMigrationRolledBack
+	}
+
+	return checkpoint, nil
+}
+
+// Resume continues the migration from the last checkpoint
+func (m Migration) Resume(ctx context.Context) (*MigrationCheckpoint, error) {
+	checkpoint, err := m.Resumable()
+	if err != nil {
+		return checkpoint, err
+	}
+
+	log.Info().Int("migrated", checkpoint.Migrated).Int("total", len(checkpoint.Hostnames)).Msg("resuming migration")
+	return m.run(ctx, *checkpoint)
+}
+
+// Rollback moves the migrated hostnames back to the source tunnel, most
+// recent batch first
+func (m Migration) Rollback(ctx context.Context) (*MigrationCheckpoint, error) {
+	checkpoint, err := LoadMigrationCheckpoint(m.CheckpointFile)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info().Int("migrated", checkpoint.Migrated).Int("total", len(checkpoint.Hostnames)).Msg("rolling back migration")
+
+	// include the batch which was interrupted
+	checkpoint.Migrated = min(len(checkpoint.Hostnames), max(checkpoint.Migrated, checkpoint.Pending))
+	checkpoint.Pending = 0
+
+	for checkpoint.Migrated > 0 {
+		start := max(0, checkpoint.Migrated-m.batchSize())
+		batch := checkpoint.Hostnames[start:checkpoint.Migrated]
+
+		if err := m.moveRecords(ctx, checkpoint.TargetTunnelID, checkpoint.SourceTunnelID, batch); err != nil {
+			return checkpoint, err
+		}
+
+		if err := m.transferAccess(ctx, checkpoint.SourceTunnelID, batch); err != nil {
+			return checkpoint, err
+		}
+
+		if err := m.removeRules(ctx, *checkpoint, batch); err != nil {
+			return checkpoint, err
+		}
+
+		checkpoint.Migrated = start
+		if err := SaveMigrationCheckpoint(m.CheckpointFile, *checkpoint); err != nil {
+			return checkpoint, err
+		}
+
+		log.Info().Strs("hostnames", batch).Int("migrated", checkpoint.Migrated).Msg("rolled back batch")
+	}
+
+	checkpoint.RolledBack = true
+	if err := SaveMigrationCheckpoint(m.CheckpointFile, *checkpoint); err != nil {
+		return checkpoint, err
+	}
+
+	return checkpoint, nil
+}
+
+func (m Migration) run(ctx context.Context, checkpoint MigrationCheckpoint) (*MigrationCheckpoint, error) {
+	for !checkpoint.Complete() {
+		end := min(len(checkpoint.Hostnames), checkpoint.Migrated+m.batchSize())
+		batch := checkpoint.Hostnames[checkpoint.Migrated:end]
+
+		checkpoint.Pending = end
+		if err := SaveMigrationCheckpoint(m.CheckpointFile, checkpoint); err != nil {
+			return &checkpoint, err
+		}
+
+		if err := m.copyRules(ctx, &checkpoint, batch); err != nil {
+			return &checkpoint, err
+		}
+
+		if err := m.moveRecords(ctx, checkpoint.SourceTunnelID, checkpoint.TargetTunnelID, batch); err != nil {
+			return &checkpoint, err
+		}
+
+		if err := m.transferAccess(ctx, checkpoint.TargetTunnelID, batch); err != nil {
+			return &checkpoint, err
+		}
+
+		checkpoint.Migrated = end
+		if err := SaveMigrationCheckpoint(m.CheckpointFile, checkpoint); err != nil {
+			return &checkpoint, err
+		}
+
+		log.Info().Strs("hostnames", batch).Int("migrated", checkpoint.Migrated).Int("total", len(checkpoint.Hostnames)).Msg("migrated batch")
+	}
+
+	return &checkpoint, nil
+}
+
+func (m Migration) batchSize() int {
+	if m.BatchSize < 1 {
+		return 1
+	}
+
+	return m.BatchSize
+}
+
+// copyRules copies the rules of the hostnames to the target tunnel, recording
+// in the checkpoint which rules are added and which are replaced before
+// changing them
+func (m Migration) copyRules(ctx context.Context, checkpoint *MigrationCheckpoint, hostnames []string) error {
+	source, err := m.Cloudflare.GetTunnelConfiguration(ctx, m.AccountID, checkpoint.SourceTunnelID)
+	if err != nil {
+		return fmt.Errorf("failed to get tunnel configuration: %w", err)
+	}
+
+	target, err := m.Cloudflare.GetTunnelConfiguration(ctx, m.AccountID, checkpoint.TargetTunnelID)
+	if err != nil {
+		return fmt.Errorf("failed to get tunnel configuration: %w", err)
+	}
+
+	existing := map[string]cloudflare.UnvalidatedIngressRule{}
+	for _, rule := range NormaliseRules(target.Config.Ingress) {
+		existing[rule.Hostname] = rule
+	}
+
+	replaced := map[string]bool{}
+	for _, rule := range checkpoint.Replaced {
+		replaced[rule.Hostname] = true
+	}
+
+	for _, hostname := range hostnames {
+		if slices.Contains(checkpoint.Copied, hostname) || replaced[hostname] {
+			continue
+		}
+
+		if rule, ok := existing[hostname]; ok {
+			checkpoint.Replaced = append(checkpoint.Replaced, rule)
+		} else if checkpoint.Copied != nil {
+			checkpoint.Copied = append(checkpoint.Copied, hostname)
+		}
+	}
+
+	if err := SaveMigrationCheckpoint(m.CheckpointFile, *checkpoint); err != nil {
+		return err
+	}
+
+	rules := CopyRules(source.Config.Ingress, target.Config.Ingress, hostnames)
+	if err := m.Cloudflare.UpdateTunnelIngress(ctx, m.AccountID, checkpoint.TargetTunnelID, rules); err != nil {
+		return fmt.Errorf("failed to update tunnel ingress rules: %w", err)
+	}
+
+	return nil
+}
+
+// removeRules removes the rules of the hostnames which were copied to the
+// target tunnel, and restores the rules which were replaced
+func (m Migration) removeRules(ctx context.Context, checkpoint MigrationCheckpoint, hostnames []string) error {
+	tunnel, err := m.Cloudflare.GetTunnelConfiguration(ctx, m.AccountID, checkpoint.TargetTunnelID)
+	if err != nil {
+		return fmt.Errorf("failed to get tunnel configuration: %w", err)
+	}
+
+	copied := hostnames
+	if checkpoint.Copied != nil {
+		copied = slices.DeleteFunc(slices.Clone(hostnames), func(hostname string) bool {
+			return !slices.Contains(checkpoint.Copied, hostname)
+		})
+	}
+
+	replaced := Rules{}
+	for _, rule := range checkpoint.Replaced {
+		if slices.Contains(hostnames, rule.Hostname) {
+			replaced = append(replaced, rule)
+		}
+	}
+
+	rules := CopyRules(replaced, RemoveRules(tunnel.Config.Ingress, copied), hostnamesOf(replaced))
+	if err := m.Cloudflare.UpdateTunnelIngress(ctx, m.AccountID, checkpoint.TargetTunnelID, rules); err != nil {
+		return fmt.Errorf("failed to update tunnel ingress rules: %w", err)
+	}
+
+	return nil
+}
+
+func hostnamesOf(rules Rules) []string {
+	hostnames := []string{}
+	for _, rule := range rules {
+		hostnames = append(hostnames, rule.Hostname)
+	}
+
+	return hostnames
+}
+
+func (m Migration) moveRecords(ctx context.Context, from, to string, hostnames []string) error {
+	tunnel, err := m.Cloudflare.GetTunnelConfiguration(ctx, m.AccountID, from)
+	if err != nil {
+		return fmt.Errorf("failed to get tunnel configuration: %w", err)
+	}
+
+	zoneMap, err := GenerateZoneMap(ctx, m.Cloudflare)
+	if err != nil {
+		return fmt.Errorf("failed to generate zone map: %w", err)
+	}
+
+	changes := MigrationDNSChanges(*zoneMap, tunnel.Config.Ingress, from, to, hostnames)
+	if err := BatchUpdateDNSRecords(ctx, m.Cloudflare, changes); err != nil {
+		return fmt.Errorf("failed to update zone records: %w", err)
+	}
+
+	return nil
+}
+
+func (m Migration) transferAccess(ctx context.Context, to string, hostnames []string) error {
+	if !m.AccessEnabled {
+		return nil
+	}
+
+	return TransferAccessApplications(ctx, m.Cloudflare, m.AccountID, to, hostnames)
+}
+
+// changeSetOptions returns the options for the dns record changes of the
+// tunnel, leaving the hostnames moved from it by a migration unchanged
+func (p CloudflareTunnelProvider) changeSetOptions() (ChangeSetOptions, error) {
+	opts := ChangeSetOptions{
+		Protected:      p.ProtectedHostnames,
+		ConflictPolicy: p.ConflictPolicy,
+	}
+
+	if p.MigrationCheckpointFile == "" {
+		return opts, nil
+	}
+
+	checkpoint, err := LoadMigrationCheckpoint(p.MigrationCheckpointFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return opts, nil
+	}
+
+	if err != nil {
+		return opts, err
+	}
+
+	opts.Migrated = checkpoint.Moved(p.CloudflareTunnelID)
+	return opts, nil
+}
+
+// filterMigrated drops the changes to hostnames moved to another tunnel by a
+// migration, the provider of that tunnel manages them instead
+func filterMigrated(changes *plan.Changes, migrated []string) *plan.Changes {
+	if len(migrated) == 0 {
+		return changes
+	}
+
+	dropped := []string{}
+	keep := func(endpoints []*endpoint.Endpoint) []*endpoint.Endpoint {
+		return slices.DeleteFunc(slices.Clone(endpoints), func(e *endpoint.Endpoint) bool {
+			if !slices.Contains(migrated, e.DNSName) {
+				return false
+			}
+
+			dropped = append(dropped, e.DNSName)
+			return true
+		})
+	}
+
+	filtered := plan.Changes{
+		Create:    keep(changes.Create),
+		UpdateOld: keep(changes.UpdateOld),
+		UpdateNew: keep(changes.UpdateNew),
+		Delete:    keep(changes.Delete),
+	}
+
+	if len(dropped) > 0 {
+		log.Warn().Strs("hostnames", slices.Compact(dropped)).Msg("hostnames were migrated to another tunnel, dropping changes")
+	}
+
+	return &filtered
+}
+
+func (p CloudflareTunnelProvider) migration() Migration {
+	return Migration{
+		Cloudflare:     p.Cloudflare,
+		AccountID:      p.CloudflareAccountID,
+		BatchSize:      p.MigrationBatchSize,
+		CheckpointFile: p.MigrationCheckpointFile,
+		AccessEnabled:  p.AccessEnabled,
+	}
+}
+
+// MigrateTunnel moves the hostnames of this tunnel to the target tunnel
+func (p CloudflareTunnelProvider) MigrateTunnel(ctx context.Context, target string) (*MigrationCheckpoint, error) {
+	return p.migration().Start(ctx, p.CloudflareTunnelID, target)
+}
+
+// ResumeMigration continues the migration from the last checkpoint
+func (p CloudflareTunnelProvider) ResumeMigration(ctx context.Context) (*MigrationCheckpoint, error) {
+	return p.migration().Resume(ctx)
+}
+
+// RollbackMigration moves the migrated hostnames back to the source tunnel
+func (p CloudflareTunnelProvider) RollbackMigration(ctx context.Context) (*MigrationCheckpoint, error) {
+	return p.migration().Rollback(ctx)
+}
+
+// MigrationStatus returns the last checkpoint of the migration
+func (p CloudflareTunnelProvider) MigrationStatus(ctx context.Context) (*MigrationCheckpoint, error) {
+	return LoadMigrationCheckpoint(p.MigrationCheckpointFile)
+}
@@ -0,0 +1,306 @@
+package provider_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestMigrationHostnames(t *testing.T) {
+	rules := provider.Rules{
+		{Hostname: "a.example.com", Service: "http://a"},
+		{Hostname: "b.example.com", Service: "http://b"},
+		{Hostname: "c.example.com", Service: "http://c"},
+		{Service: "http_status:404"},
+	}
+
+	zoneMap := provider.ZoneMap{
+		"example.com": provider.ZoneDetail{
+			Zone: cloudflare.Zone{ID: "zone123"},
+			Records: map[string]cloudflare.DNSRecord{
+				"a.example.com": {ID: "record1", Name: "a.example.com", Content: "old.cfargotunnel.com"},
+				"b.example.com": {ID: "record2", Name: "b.example.com", Content: "elsewhere.example.net"},
+			},
+		},
+	}
+
+	assert.Equal(t, []string{"a.example.com"}, provider.MigrationHostnames(rules, zoneMap, "old"))
+}
+
+func TestCopyRules(t *testing.T) {
+	from := provider.Rules{
+		{Hostname: "a.example.com", Service: "http://a"},
+		{Hostname: "b.example.com", Service: "http://b"},
+		{Hostname: "*.example.com", Service: "http://wildcard"},
+		{Service: "http_status:404"},
+	}
+
+	assert.Equal(t, provider.Rules{
+		{Hostname: "a.example.com", Service: "http://a"},
+		{Hostname: "*.example.com", Service: "http://wildcard"},
+		{Service: "http_status:404"},
+	}, provider.CopyRules(from, nil, []string{"*.example.com", "a.example.com"}))
+
+	to := provider.Rules{
+		{Hostname: "b.example.com", Service: "http://stale"},
+		{Hostname: "c.example.com", Service: "http://c"},
+		{Service: "http_status:503"},
+	}
+
+	assert.Equal(t, provider.Rules{
+		{Hostname: "b.example.com", Service: "http://b"},
+		{Hostname: "c.example.com", Service: "http://c"},
+		{Service: "http_status:503"},
+	}, provider.CopyRules(from, to, []string{"b.example.com"}))
+
+	assert.Equal(t, provider.Rules{
+		{Hostname: "c.example.com", Service: "http://c"},
+		{Service: "http_status:503"},
+	}, provider.RemoveRules(to, []string{"b.example.com"}))
+}
+
+func TestMigrationDNSChanges(t *testing.T) {
+	rules := provider.Rules{
+		{Hostname: "a.example.com", Service: "http://a"},
+		{Hostname: "b.example.com", Service: "http://b"},
+	}
+
+	zoneMap := provider.ZoneMap{
+		"example.com": provider.ZoneDetail{
+			Zone: cloudflare.Zone{ID: "zone123"},
+			Records: map[string]cloudflare.DNSRecord{
+				"a.example.com": {ID: "record1", ZoneID: "zone123", Name: "a.example.com", Content: "old.cfargotunnel.com"},
+				"b.example.com": {ID: "record2", ZoneID: "zone123", Name: "b.example.com", Content: "new.cfargotunnel.com"},
+			},
+		},
+	}
+
+	assert.Equal(t, []provider.Change{{
+		Action:    provider.ChangeTypeUpdate,
+		ZoneID:    "zone123",
+		RecordID:  "record1",
+		Name:      "a.example.com",
+		TunnelURI: "new.cfargotunnel.com",
+		Service:   "http://a",
+	}}, provider.MigrationDNSChanges(zoneMap, rules, "old", "new", []string{"a.example.com", "b.example.com"}))
+}
+
+func TestMigrationCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "migration.json")
+
+	_, err := provider.LoadMigrationCheckpoint(path)
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+
+	checkpoint := provider.MigrationCheckpoint{
+		SourceTunnelID: "old",
+		TargetTunnelID: "new",
+		Hostnames:      []string{"a.example.com", "b.example.com"},
+		Migrated:       1,
+		Pending:        2,
+	}
+
+	assert.NoError(t, provider.SaveMigrationCheckpoint(path, checkpoint))
+	loaded, err := provider.LoadMigrationCheckpoint(path)
+	assert.NoError(t, err)
+	assert.Equal(t, &checkpoint, loaded)
+	assert.False(t, loaded.Complete())
+}
+
+func TestMigrationHostnames_Wildcard(t *testing.T) {
+	rules := provider.Rules{
+		{Hostname: "*.example.com", Service: "http://wildcard"},
+		{Hostname: "a.example.com", Service: "http://a"},
+		{Hostname: "b.example.com", Service: "http://b"},
+		{Hostname: "c.other.com", Service: "http://c"},
+		{Service: "http_status:404"},
+	}
+
+	zoneMap := provider.ZoneMap{
+		"example.com": provider.ZoneDetail{
+			Zone: cloudflare.Zone{ID: "zone123"},
+			Records: map[string]cloudflare.DNSRecord{
+				"*.example.com": {ID: "record1", Name: "*.example.com", Content: "old.cfargotunnel.com"},
+				"b.example.com": {ID: "record2", Name: "b.example.com", Content: "elsewhere.example.net"},
+			},
+		},
+	}
+
+	assert.Equal(t, []string{"a.example.com", "*.example.com"}, provider.MigrationHostnames(rules, zoneMap, "old"))
+}
+
+func newMigrationFake() *fakeCloudflare {
+	fake := newFakeCloudflare("example.com")
+	fake.ingress["source"] = []cloudflare.UnvalidatedIngressRule{
+		{Hostname: "a.example.com", Service: "http://a"},
+		{Hostname: "b.example.com", Service: "http://b"},
+		{Hostname: "c.example.com", Service: "http://c"},
+		{Hostname: "*.example.com", Service: "http://wildcard"},
+		{Hostname: "d.example.com", Service: "http://d"},
+		{Service: "http_status:404"},
+	}
+	fake.ingress["target"] = []cloudflare.UnvalidatedIngressRule{
+		{Hostname: "b.example.com", Service: "http://existing"},
+		{Hostname: "e.example.com", Service: "http://e"},
+		{Service: "http_status:404"},
+	}
+
+	fake.AddRecord("example.com", "a.example.com", "source.cfargotunnel.com")
+	fake.AddRecord("example.com", "b.example.com", "source.cfargotunnel.com")
+	fake.AddRecord("example.com", "c.example.com", "source.cfargotunnel.com")
+	fake.AddRecord("example.com", "*.example.com", "source.cfargotunnel.com")
+	fake.AddRecord("example.com", "e.example.com", "target.cfargotunnel.com")
+	return fake
+}
+
+func TestMigration_Start(t *testing.T) {
+	fake := newMigrationFake()
+	migration := provider.Migration{Cloudflare: fake, BatchSize: 2, CheckpointFile: filepath.Join(t.TempDir(), "migration.json")}
+
+	checkpoint, err := migration.Start(context.Background(), "source", "target")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.example.com", "b.example.com", "c.example.com", "d.example.com", "*.example.com"}, checkpoint.Hostnames)
+	assert.True(t, checkpoint.Complete())
+
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com", "*.example.com", "e.example.com"} {
+		assert.Equal(t, "target.cfargotunnel.com", fake.RecordContent(name), name)
+	}
+
+	assert.Equal(t, []cloudflare.UnvalidatedIngressRule{
+		{Hostname: "c.example.com", Service: "http://c"},
+		{Hostname: "d.example.com", Service: "http://d"},
+		{Hostname: "a.example.com", Service: "http://a"},
+		{Hostname: "b.example.com", Service: "http://b"},
+		{Hostname: "e.example.com", Service: "http://e"},
+		{Hostname: "*.example.com", Service: "http://wildcard"},
+		{Service: "http_status:404"},
+	}, fake.Ingress("target"))
+
+	_, err = migration.Start(context.Background(), "target", "source")
+	assert.NotErrorIs(t, err, provider.ErrMigrationInProgress)
+}
+
+func TestMigration_StartPending(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "migration.json")
+	assert.NoError(t, provider.SaveMigrationCheckpoint(path, provider.MigrationCheckpoint{
+		SourceTunnelID: "source",
+		TargetTunnelID: "target",
+		Hostnames:      []string{"a.example.com"},
+		Pending:        1,
+	}))
+
+	migration := provider.Migration{Cloudflare: newMigrationFake(), CheckpointFile: path}
+	_, err := migration.Start(context.Background(), "source", "target")
+	assert.ErrorIs(t, err, provider.ErrMigrationInProgress)
+}
+
+func TestMigration_Resume(t *testing.T) {
+	fake := newMigrationFake()
+	migration := provider.Migration{Cloudflare: fake, BatchSize: 2, CheckpointFile: filepath.Join(t.TempDir(), "migration.json")}
+
+	fake.onChangeRecord = func(name string) error {
+		if name == "c.example.com" {
+			return errors.New("interrupted")
+		}
+		return nil
+	}
+
+	checkpoint, err := migration.Start(context.Background(), "source", "target")
+	assert.Error(t, err)
+	assert.Equal(t, 2, checkpoint.Migrated)
+	assert.Equal(t, 4, checkpoint.Pending)
+	assert.Equal(t, "source.cfargotunnel.com", fake.RecordContent("c.example.com"))
+
+	_, err = migration.Start(context.Background(), "source", "target")
+	assert.ErrorIs(t, err, provider.ErrMigrationInProgress)
+
+	fake.onChangeRecord = nil
+	checkpoint, err = migration.Resume(context.Background())
+	assert.NoError(t, err)
+	assert.True(t, checkpoint.Complete())
+	assert.Equal(t, "target.cfargotunnel.com", fake.RecordContent("c.example.com"))
+	assert.Equal(t, "target.cfargotunnel.com", fake.RecordContent("*.example.com"))
+}
+
+func TestMigration_Rollback(t *testing.T) {
+	fake := newMigrationFake()
+	target := fake.Ingress("target")
+	migration := provider.Migration{Cloudflare: fake, BatchSize: 2, CheckpointFile: filepath.Join(t.TempDir(), "migration.json")}
+
+	fake.onChangeRecord = func(name string) error {
+		if name == "*.example.com" {
+			return errors.New("interrupted")
+		}
+		return nil
+	}
+
+	_, err := migration.Start(context.Background(), "source", "target")
+	assert.Error(t, err)
+
+	fake.onChangeRecord = nil
+	checkpoint, err := migration.Rollback(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, checkpoint.Migrated)
+	assert.True(t, checkpoint.RolledBack)
+
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com", "*.example.com"} {
+		assert.Equal(t, "source.cfargotunnel.com", fake.RecordContent(name), name)
+	}
+
+	assert.Equal(t, "target.cfargotunnel.com", fake.RecordContent("e.example.com"))
+	assert.Equal(t, target, fake.Ingress("target"))
+
+	_, err = migration.Resume(context.Background())
+	assert.ErrorIs(t, err, provider.ErrMigrationRolledBack)
+
+	_, err = migration.Start(context.Background(), "source", "target")
+	assert.NoError(t, err)
+}
+
+func TestMigration_ApplyChanges(t *testing.T) {
+	fake := newMigrationFake()
+	path := filepath.Join(t.TempDir(), "migration.json")
+	migration := provider.Migration{Cloudflare: fake, BatchSize: 2, CheckpointFile: path}
+
+	fake.onChangeRecord = func(name string) error {
+		if name == "c.example.com" {
+			return errors.New("interrupted")
+		}
+		return nil
+	}
+
+	// the webhook of the source tunnel keeps running between batches
+	_, err := migration.Start(context.Background(), "source", "target")
+	assert.Error(t, err)
+	fake.onChangeRecord = nil
+
+	p := provider.CloudflareTunnelProvider{Cloudflare: fake, CloudflareTunnelID: "source", MigrationCheckpointFile: path}
+	assert.NoError(t, p.ApplyChanges(context.Background(), &plan.Changes{
+		Create:    []*endpoint.Endpoint{endpoint.NewEndpoint("f.example.com", endpoint.RecordTypeCNAME, "http://f")},
+		UpdateOld: []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeCNAME, "http://a")},
+		UpdateNew: []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeCNAME, "http://changed")},
+	}))
+
+	assert.Equal(t, "target.cfargotunnel.com", fake.RecordContent("a.example.com"))
+	assert.Equal(t, "target.cfargotunnel.com", fake.RecordContent("b.example.com"))
+	assert.Contains(t, fake.Ingress("source"), cloudflare.UnvalidatedIngressRule{Hostname: "f.example.com", Service: "http://f"})
+	assert.Contains(t, fake.Ingress("source"), cloudflare.UnvalidatedIngressRule{Hostname: "a.example.com", Service: "http://a"})
+
+	_, err = migration.Resume(context.Background())
+	assert.NoError(t, err)
+
+	assert.NoError(t, p.ApplyChanges(context.Background(), &plan.Changes{
+		Create: []*endpoint.Endpoint{endpoint.NewEndpoint("g.example.com", endpoint.RecordTypeCNAME, "http://g")},
+	}))
+
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com", "*.example.com"} {
+		assert.Equal(t, "target.cfargotunnel.com", fake.RecordContent(name), name)
+	}
+}
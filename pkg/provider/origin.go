@@ -0,0 +1,97 @@
+package provider
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/cloudflare/cloudflare-go"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+const PropertyAccessAUD = "access-aud"
+
+// AccessAUDFromEndpoint reads the "cloudflare-tunnel/access-aud" property, a
+// comma delimited list of access audience tags
+func AccessAUDFromEndpoint(e *endpoint.Endpoint) []string {
+	raw, _ := GetProperty(e, PropertyAccessAUD)
+
+	audTags := []string{}
+	for _, aud := range strings.Split(raw, ",") {
+		if aud = strings.TrimSpace(aud); aud != "" {
+			audTags = append(audTags, aud)
+		}
+	}
+
+	slices.Sort(audTags)
+	return slices.Compact(audTags)
+}
+
+// SetOriginAccess makes cloudflared reject requests for the hostname without an
+// access jwt for one of the audience tags, or removes the requirement if there
+// are no audience tags
+func (r Rules) SetOriginAccess(hostname, teamName string, audTags []string) {
+	for i, rule := range r {
+		if rule.Hostname != hostname {
+			continue
+		}
+
+		origin := cloudflare.OriginRequestConfig{}
+		if rule.OriginRequest != nil {
+			origin = *rule.OriginRequest
+		} else if len(audTags) == 0 {
+			continue
+		}
+
+		origin.Access = nil
+		if len(audTags) > 0 {
+			origin.Access = &cloudflare.AccessConfig{
+				Required: true,
+				TeamName: teamName,
+				AudTag:   audTags,
+			}
+		}
+
+		r[i].OriginRequest = &origin
+	}
+}
+
+// reportedAUD is the "cloudflare-tunnel/access-aud" property reported for the
+// rule, which is omitted if the rule only requires the audience tag of the
+// access application for the hostname. A rule which does not require the
+// audience tag of the access application for the hostname is reported with an
+// empty property, which no desired endpoint has, so external-dns updates it
+func reportedAUD(rule cloudflare.UnvalidatedIngressRule, applicationAUD string) (string, bool) {
+	if rule.OriginRequest == nil || rule.OriginRequest.Access == nil {
+		return "", applicationAUD != ""
+	}
+
+	audTags := slices.Clone(rule.OriginRequest.Access.AudTag)
+	if applicationAUD != "" && len(audTags) == 1 && audTags[0] == applicationAUD {
+		return "", false
+	}
+
+	slices.Sort(audTags)
+	audTags = slices.Compact(audTags)
+	return strings.Join(audTags, ","), len(audTags) > 0
+}
+
+// setOriginAccess sets the origin access requirement of the rules for created
+// and updated endpoints, using the audience tags of the endpoint, or otherwise
+// the audience tag of the access application for the hostname
+func (p CloudflareTunnelProvider) setOriginAccess(rules Rules, changes *plan.Changes, audiences map[string]string) {
+	for _, endpoints := range [][]*endpoint.Endpoint{changes.Create, changes.UpdateNew} {
+		for _, e := range endpoints {
+			if p.ProtectedHostnames.Match(e.DNSName) {
+				continue
+			}
+
+			audTags := AccessAUDFromEndpoint(e)
+			if aud, ok := audiences[e.DNSName]; ok && len(audTags) == 0 {
+				audTags = []string{aud}
+			}
+
+			rules.SetOriginAccess(e.DNSName, p.AccessTeamName, audTags)
+		}
+	}
+}
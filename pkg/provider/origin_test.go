@@ -0,0 +1,80 @@
+package provider_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestAccessAUDFromEndpoint(t *testing.T) {
+	e := endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeCNAME, "http://a")
+	assert.Empty(t, provider.AccessAUDFromEndpoint(e))
+
+	e.SetProviderSpecificProperty("cloudflare-tunnel/access-aud", "aud2, aud1,aud2")
+	assert.Equal(t, []string{"aud1", "aud2"}, provider.AccessAUDFromEndpoint(e))
+}
+
+func TestRules_SetOriginAccess(t *testing.T) {
+	proxyType := "socks"
+	rules := provider.Rules{
+		{Hostname: "a.example.com", Service: "http://a", OriginRequest: &cloudflare.OriginRequestConfig{ProxyType: &proxyType}},
+		{Hostname: "b.example.com", Service: "http://b"},
+		{Service: "http_status:404"},
+	}
+
+	rules.SetOriginAccess("a.example.com", "team", []string{"aud1"})
+	assert.Equal(t, &cloudflare.OriginRequestConfig{
+		ProxyType: &proxyType,
+		Access:    &cloudflare.AccessConfig{Required: true, TeamName: "team", AudTag: []string{"aud1"}},
+	}, rules[0].OriginRequest)
+
+	rules.SetOriginAccess("a.example.com", "team", nil)
+	assert.Equal(t, &cloudflare.OriginRequestConfig{ProxyType: &proxyType}, rules[0].OriginRequest)
+
+	rules.SetOriginAccess("b.example.com", "team", nil)
+	assert.Nil(t, rules[1].OriginRequest)
+	assert.Nil(t, rules[2].OriginRequest)
+}
+
+func TestRecordsOriginAccess(t *testing.T) {
+	fake := newFakeCloudflare("example.com")
+	fake.ingress["tunnel123"] = []cloudflare.UnvalidatedIngressRule{
+		{Hostname: "required.example.com", Service: "http://required", OriginRequest: &cloudflare.OriginRequestConfig{
+			Access: &cloudflare.AccessConfig{Required: true, TeamName: "team", AudTag: []string{"aud1"}},
+		}},
+		{Hostname: "missing.example.com", Service: "http://missing"},
+		{Hostname: "unprotected.example.com", Service: "http://unprotected"},
+		{Service: "http_status:404"},
+	}
+	fake.apps = []cloudflare.AccessApplication{
+		{ID: "app1", Name: "external-dns/tunnel123/required.example.com", Domain: "required.example.com", AUD: "aud1"},
+		{ID: "app2", Name: "external-dns/tunnel123/missing.example.com", Domain: "missing.example.com", AUD: "aud2"},
+	}
+	for _, name := range []string{"required.example.com", "missing.example.com", "unprotected.example.com"} {
+		fake.AddRecord("example.com", name, "tunnel123.cfargotunnel.com")
+	}
+
+	p := provider.CloudflareTunnelProvider{Cloudflare: fake, CloudflareTunnelID: "tunnel123", AccessEnabled: true, AccessTeamName: "team"}
+	endpoints, err := p.Records(context.Background())
+	assert.NoError(t, err)
+
+	reported := map[string]*string{}
+	for _, e := range endpoints {
+		if aud, ok := e.GetProviderSpecificProperty("cloudflare-tunnel/access-aud"); ok {
+			reported[e.DNSName] = &aud
+		} else {
+			reported[e.DNSName] = nil
+		}
+	}
+
+	empty := ""
+	assert.Equal(t, map[string]*string{
+		"required.example.com":    nil,
+		"missing.example.com":     &empty,
+		"unprotected.example.com": nil,
+	}, reported)
+}
@@ -0,0 +1,19 @@
+package provider
+
+import "strings"
+
+// OwnerPrefix marks the dns records, access applications and tunnel routes
+// created by this provider, prefixing their comment or name
+const OwnerPrefix = "external-dns/"
+
+// ownerMark returns the comment or name marking the value as created by this
+// provider
+func ownerMark(value string) string {
+	return OwnerPrefix + value
+}
+
+// ownedValue returns the value of a comment or name, reporting whether it was
+// created by this provider
+func ownedValue(mark string) (string, bool) {
+	return strings.CutPrefix(mark, OwnerPrefix)
+}
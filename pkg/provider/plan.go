@@ -0,0 +1,158 @@
+package provider
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// ApplyPlan describes the changes made to the tunnel, its dns records, access
+// applications and routes
+type ApplyPlan struct {
+	// Current are the ingress rules before the changes
+	Current Rules
+	Rules   Rules
+	Records []Change
+	Access  []AccessChange
+	Routes  []RouteChange
+}
+
+// RuleDiff describes a change to the ingress rule of a hostname and path
+type RuleDiff struct {
+	Action ChangeType
+	From   *cloudflare.UnvalidatedIngressRule
+	To     *cloudflare.UnvalidatedIngressRule
+}
+
+func ruleKey(rule cloudflare.UnvalidatedIngressRule) string {
+	return rule.Hostname + rule.Path
+}
+
+// DiffRules determines the rules which are created, updated or deleted going
+// from the current to the desired rules, ordered by hostname and path
+func DiffRules(current, desired Rules) []RuleDiff {
+	currentMap := map[string]cloudflare.UnvalidatedIngressRule{}
+	for _, rule := range current {
+		currentMap[ruleKey(rule)] = rule
+	}
+
+	diffs := []RuleDiff{}
+	desiredMap := map[string]bool{}
+	for _, rule := range desired {
+		rule := rule
+		desiredMap[ruleKey(rule)] = true
+
+		existing, ok := currentMap[ruleKey(rule)]
+		if !ok {
+			diffs = append(diffs, RuleDiff{Action: ChangeTypeCreate, To: &rule})
+			continue
+		}
+
+		if existing.Service != rule.Service || !reflect.DeepEqual(existing.OriginRequest, rule.OriginRequest) {
+			diffs = append(diffs, RuleDiff{Action: ChangeTypeUpdate, From: &existing, To: &rule})
+		}
+	}
+
+	for _, rule := range current {
+		rule := rule
+		if !desiredMap[ruleKey(rule)] {
+			diffs = append(diffs, RuleDiff{Action: ChangeTypeDelete, From: &rule})
+		}
+	}
+
+	sort.SliceStable(diffs, func(i, j int) bool { return diffs[i].key() < diffs[j].key() })
+	return diffs
+}
+
+// rule returns the desired rule, or the current rule if it is deleted
+func (d RuleDiff) rule() cloudflare.UnvalidatedIngressRule {
+	if d.To != nil {
+		return *d.To
+	}
+
+	return *d.From
+}
+
+func (d RuleDiff) key() string {
+	return ruleKey(d.rule())
+}
+
+func (d RuleDiff) String() string {
+	name := d.key()
+	if name == "" {
+		name = "<catch-all>"
+	}
+
+	switch d.Action {
+	case ChangeTypeCreate:
+		return fmt.Sprintf("+ rule %s %s", name, d.To.Service)
+	case ChangeTypeUpdate:
+		if d.From.Service == d.To.Service {
+			return fmt.Sprintf("~ rule %s %s (origin request)", name, d.To.Service)
+		}
+
+		return fmt.Sprintf("~ rule %s %s -> %s", name, d.From.Service, d.To.Service)
+	default:
+		return fmt.Sprintf("- rule %s %s", name, d.From.Service)
+	}
+}
+
+func changeSymbol(action ChangeType) string {
+	switch action {
+	case ChangeTypeCreate:
+		return "+"
+	case ChangeTypeUpdate:
+		return "~"
+	case ChangeTypeDelete:
+		return "-"
+	default:
+		return " "
+	}
+}
+
+// Print writes a line per changed rule, record, access application and route
+func (a ApplyPlan) Print(w io.Writer) error {
+	lines := []string{}
+	for _, diff := range DiffRules(a.Current, a.Rules) {
+		lines = append(lines, diff.String())
+	}
+
+	records := append([]Change{}, a.Records...)
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Name < records[j].Name })
+	for _, change := range records {
+		lines = append(lines, fmt.Sprintf("%s record %s %s", changeSymbol(change.Action), change.Name, change.TunnelURI))
+	}
+
+	for _, change := range a.Access {
+		line := fmt.Sprintf("%s access %s", changeSymbol(change.Action), change.Hostname)
+		if change.Spec != nil {
+			line += " " + change.Spec.Decision
+		}
+
+		lines = append(lines, line)
+	}
+
+	for _, change := range a.Routes {
+		line := fmt.Sprintf("%s route %s %s", changeSymbol(change.Action), change.Hostname, change.Network)
+		if change.VirtualNetwork != "" {
+			line += " (" + change.VirtualNetwork + ")"
+		}
+
+		lines = append(lines, line)
+	}
+
+	if len(lines) == 0 {
+		lines = append(lines, "no changes")
+	}
+
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
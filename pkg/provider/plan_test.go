@@ -0,0 +1,90 @@
+package provider_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffRules(t *testing.T) {
+	current := provider.Rules{
+		{Hostname: "a.example.com", Service: "http://a"},
+		{Hostname: "b.example.com", Service: "http://b"},
+		{Hostname: "c.example.com", Service: "http://c"},
+		{Service: "http_status:404"},
+	}
+
+	desired := provider.Rules{
+		{Hostname: "a.example.com", Service: "http://a"},
+		{Hostname: "b.example.com", Service: "http://b2"},
+		{Hostname: "d.example.com", Service: "http://d"},
+		{Service: "http_status:404"},
+	}
+
+	assert.Equal(t, []provider.RuleDiff{
+		{Action: provider.ChangeTypeUpdate, From: &current[1], To: &desired[1]},
+		{Action: provider.ChangeTypeDelete, From: &current[2]},
+		{Action: provider.ChangeTypeCreate, To: &desired[2]},
+	}, provider.DiffRules(current, desired))
+
+	assert.Empty(t, provider.DiffRules(current, current))
+}
+
+func TestApplyPlanPrint(t *testing.T) {
+	applyPlan := provider.ApplyPlan{
+		Current: provider.Rules{{Hostname: "b.example.com", Service: "http://b"}, {Service: "http_status:404"}},
+		Rules:   provider.Rules{{Hostname: "a.example.com", Service: "http://a"}, {Service: "http_status:404"}},
+		Records: []provider.Change{
+			{Action: provider.ChangeTypeDelete, Name: "b.example.com", TunnelURI: "tunnel.cfargotunnel.com"},
+			{Action: provider.ChangeTypeCreate, Name: "a.example.com", TunnelURI: "tunnel.cfargotunnel.com"},
+		},
+		Access: []provider.AccessChange{
+			{Action: provider.ChangeTypeCreate, Hostname: "a.example.com", Spec: &provider.AccessSpec{Decision: "allow"}},
+		},
+		Routes: []provider.RouteChange{
+			{Action: provider.ChangeTypeCreate, Route: provider.Route{Hostname: "lan.example.com", Network: "10.0.0.0/8", VirtualNetwork: "office"}},
+		},
+	}
+
+	buf := bytes.Buffer{}
+	assert.NoError(t, applyPlan.Print(&buf))
+	assert.Equal(t, strings.Join([]string{
+		"+ rule a.example.com http://a",
+		"- rule b.example.com http://b",
+		"+ record a.example.com tunnel.cfargotunnel.com",
+		"- record b.example.com tunnel.cfargotunnel.com",
+		"+ access a.example.com allow",
+		"+ route lan.example.com 10.0.0.0/8 (office)",
+		"",
+	}, "\n"), buf.String())
+
+	buf.Reset()
+	assert.NoError(t, provider.ApplyPlan{}.Print(&buf))
+	assert.Equal(t, "no changes\n", buf.String())
+}
+
+func TestReadBackup(t *testing.T) {
+	backup, err := provider.ReadBackup(strings.NewReader(`{"tunnelId":"tunnel123","rules":[{"hostname":"a.example.com","service":"http://a"},{"service":"http_status:404"}]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "tunnel123", backup.TunnelID)
+	assert.Equal(t, provider.Rules{
+		cloudflare.UnvalidatedIngressRule{Hostname: "a.example.com", Service: "http://a"},
+		cloudflare.UnvalidatedIngressRule{Service: "http_status:404"},
+	}, backup.Rules)
+
+	_, err = provider.ReadBackup(strings.NewReader(`{"tunnelId":"tunnel123"}`))
+	assert.Error(t, err)
+}
+
+func TestGarbageRecords(t *testing.T) {
+	changes := []provider.Change{
+		{Action: provider.ChangeTypeCreate, Name: "a.example.com"},
+		{Action: provider.ChangeTypeDelete, Name: "b.example.com"},
+	}
+
+	assert.Equal(t, changes[1:], provider.GarbageRecords(changes))
+}
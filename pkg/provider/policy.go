@@ -0,0 +1,76 @@
+package provider
+
+import (
+	"github.com/rs/zerolog/log"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+type Policy string
+
+const (
+	// PolicySync allows all changes
+	PolicySync Policy = "sync"
+	// PolicyUpsertOnly allows creates and updates, but never deletes
+	PolicyUpsertOnly Policy = "upsert-only"
+	// PolicyCreateOnly allows creates, but never updates or deletes
+	PolicyCreateOnly Policy = "create-only"
+)
+
+func (p Policy) allowsUpdate() bool {
+	return p != PolicyCreateOnly
+}
+
+func (p Policy) allowsDelete() bool {
+	return p == PolicySync || p == ""
+}
+
+// FilterChanges drops the external-dns changes that are not permitted by the
+// policy
+func (p Policy) FilterChanges(changes *plan.Changes) *plan.Changes {
+	filtered := plan.Changes{
+		Create:    changes.Create,
+		UpdateOld: changes.UpdateOld,
+		UpdateNew: changes.UpdateNew,
+		Delete:    changes.Delete,
+	}
+
+	if !p.allowsUpdate() && len(changes.UpdateNew) > 0 {
+		log.Info().Str("policy", string(p)).Strs("hostnames", endpointNames(changes.UpdateNew)).Msg("policy does not allow updates, dropping changes")
+		filtered.UpdateOld = []*endpoint.Endpoint{}
+		filtered.UpdateNew = []*endpoint.Endpoint{}
+	}
+
+	if !p.allowsDelete() && len(changes.Delete) > 0 {
+		log.Info().Str("policy", string(p)).Strs("hostnames", endpointNames(changes.Delete)).Msg("policy does not allow deletes, dropping changes")
+		filtered.Delete = []*endpoint.Endpoint{}
+	}
+
+	return &filtered
+}
+
+// FilterChangeSet drops the dns record changes that are not permitted by the
+// policy
+func (p Policy) FilterChangeSet(changes []Change) []Change {
+	filtered := make([]Change, 0, len(changes))
+	for _, change := range changes {
+		if (change.Action == ChangeTypeUpdate && !p.allowsUpdate()) ||
+			(change.Action == ChangeTypeDelete && !p.allowsDelete()) {
+			log.Info().Str("policy", string(p)).Str("hostname", change.Name).Str("action", string(change.Action)).Msg("policy does not allow change, skipping")
+			continue
+		}
+
+		filtered = append(filtered, change)
+	}
+
+	return filtered
+}
+
+func endpointNames(endpoints []*endpoint.Endpoint) []string {
+	names := make([]string, 0, len(endpoints))
+	for _, e := range endpoints {
+		names = append(names, e.DNSName)
+	}
+
+	return names
+}
@@ -0,0 +1,49 @@
+package provider_test
+
+import (
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestPolicy_FilterChanges(t *testing.T) {
+	changes := &plan.Changes{
+		Create:    []*endpoint.Endpoint{{DNSName: "create.example.com", Targets: []string{"service1"}}},
+		UpdateOld: []*endpoint.Endpoint{{DNSName: "update.example.com", Targets: []string{"service2"}}},
+		UpdateNew: []*endpoint.Endpoint{{DNSName: "update.example.com", Targets: []string{"service3"}}},
+		Delete:    []*endpoint.Endpoint{{DNSName: "delete.example.com", Targets: []string{"service4"}}},
+	}
+
+	sync := provider.PolicySync.FilterChanges(changes)
+	assert.Equal(t, changes, sync)
+
+	upsertOnly := provider.PolicyUpsertOnly.FilterChanges(changes)
+	assert.Len(t, upsertOnly.Create, 1)
+	assert.Len(t, upsertOnly.UpdateOld, 1)
+	assert.Len(t, upsertOnly.UpdateNew, 1)
+	assert.Len(t, upsertOnly.Delete, 0)
+
+	createOnly := provider.PolicyCreateOnly.FilterChanges(changes)
+	assert.Len(t, createOnly.Create, 1)
+	assert.Len(t, createOnly.UpdateOld, 0)
+	assert.Len(t, createOnly.UpdateNew, 0)
+	assert.Len(t, createOnly.Delete, 0)
+
+	// original is untouched
+	assert.Len(t, changes.Delete, 1)
+}
+
+func TestPolicy_FilterChangeSet(t *testing.T) {
+	changes := []provider.Change{
+		{Action: provider.ChangeTypeCreate, Name: "create.example.com"},
+		{Action: provider.ChangeTypeUpdate, Name: "update.example.com"},
+		{Action: provider.ChangeTypeDelete, Name: "delete.example.com"},
+	}
+
+	assert.Equal(t, changes, provider.PolicySync.FilterChangeSet(changes))
+	assert.Equal(t, changes[:2], provider.PolicyUpsertOnly.FilterChangeSet(changes))
+	assert.Equal(t, changes[:1], provider.PolicyCreateOnly.FilterChangeSet(changes))
+}
@@ -0,0 +1,42 @@
+package provider
+
+import (
+	"strings"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// PropertyPrefix is the prefix of the provider specific properties read from
+// endpoints, e.g. "cloudflare-tunnel/scheme"
+const PropertyPrefix = "cloudflare-tunnel/"
+
+const (
+	PropertyScheme = "scheme"
+	PropertyPort   = "port"
+)
+
+// GetProperty looks up a provider specific property on the endpoint, accepting
+// both "cloudflare-tunnel/<key>" and the "webhook/cloudflare-tunnel-<key>"
+// form produced by external-dns webhook annotations
+func GetProperty(e *endpoint.Endpoint, key string) (string, bool) {
+	if value, ok := e.GetProviderSpecificProperty(PropertyPrefix + key); ok {
+		return strings.TrimSpace(value), true
+	}
+
+	if value, ok := e.GetProviderSpecificProperty(webhookPropertyName(key)); ok {
+		return strings.TrimSpace(value), true
+	}
+
+	return "", false
+}
+
+// DeleteProperty removes a provider specific property from the endpoint in
+// both of the forms accepted by GetProperty
+func DeleteProperty(e *endpoint.Endpoint, key string) {
+	e.DeleteProviderSpecificProperty(PropertyPrefix + key)
+	e.DeleteProviderSpecificProperty(webhookPropertyName(key))
+}
+
+func webhookPropertyName(key string) string {
+	return "webhook/" + strings.TrimSuffix(PropertyPrefix, "/") + "-" + key
+}
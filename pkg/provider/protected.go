@@ -0,0 +1,40 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrProtectedHostname = errors.New("hostname is protected")
+
+// HostnamePatterns is a list of hostnames which may contain wildcards, e.g.
+// "sso.example.com" or "*.internal.example.com"
+type HostnamePatterns []string
+
+// Match reports whether the hostname matches any of the patterns
+func (p HostnamePatterns) Match(hostname string) bool {
+	hostname = NormaliseHostname(hostname)
+	for _, pattern := range p {
+		if matched, err := path.Match(NormaliseHostname(pattern), hostname); err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check returns an error if the hostname is protected, logging and counting
+// the rejected action
+func (p HostnamePatterns) Check(hostname string, action ChangeType) error {
+	if !p.Match(hostname) {
+		return nil
+	}
+
+	log.Warn().Str("hostname", hostname).Str("action", string(action)).Msg("refusing to change protected hostname")
+	metrics.ProtectedHostnameRejections.WithLabelValues(string(action)).Inc()
+	return fmt.Errorf("%w: %s", ErrProtectedHostname, hostname)
+}
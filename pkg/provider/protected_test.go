@@ -0,0 +1,85 @@
+package provider_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/metrics"
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestHostnamePatterns_Match(t *testing.T) {
+	protected := provider.HostnamePatterns{"sso.example.com", "*.internal.example.com"}
+
+	assert.True(t, protected.Match("sso.example.com"))
+	assert.True(t, protected.Match("SSO.example.com."))
+	assert.True(t, protected.Match("db.internal.example.com"))
+	assert.False(t, protected.Match("internal.example.com"))
+	assert.False(t, protected.Match("status.example.com"))
+}
+
+func TestRules_ProtectedHostnames(t *testing.T) {
+	protected := provider.HostnamePatterns{"sso.example.com"}
+	rules := provider.Rules{{Hostname: "sso.example.com", Service: "service1"}}
+
+	err := rules.CreateRule("sso.example.com", "service2", protected)
+	assert.ErrorIs(t, err, provider.ErrProtectedHostname)
+
+	err = rules.UpdateRule("sso.example.com", "service2", protected)
+	assert.ErrorIs(t, err, provider.ErrProtectedHostname)
+
+	err = rules.DeleteRule("sso.example.com", protected)
+	assert.ErrorIs(t, err, provider.ErrProtectedHostname)
+
+	changes := &plan.Changes{
+		Create: []*endpoint.Endpoint{{DNSName: "app.example.com", Targets: []string{"service3"}}},
+		Delete: []*endpoint.Endpoint{{DNSName: "sso.example.com", Targets: []string{"service1"}}},
+	}
+
+	err = rules.ApplyChanges(changes, protected)
+	assert.NoError(t, err)
+	assert.Equal(t, provider.Rules{
+		{Hostname: "app.example.com", Service: "service3"},
+		{Hostname: "sso.example.com", Service: "service1"},
+	}, rules)
+}
+
+func TestTunnelDNSChangeSet_ProtectedHostnames(t *testing.T) {
+	rules := []cloudflare.UnvalidatedIngressRule{
+		{Hostname: "sso.example.com", Service: "sso"},
+	}
+
+	zoneMap := provider.ZoneMap{
+		"example.com": provider.ZoneDetail{
+			Zone: cloudflare.Zone{ID: "zone123"},
+			Records: map[string]cloudflare.DNSRecord{
+				"status.example.com": {
+					ID:      "record1",
+					ZoneID:  "zone123",
+					Name:    "status.example.com",
+					Content: "tunnel123.cfargotunnel.com",
+				},
+			},
+		},
+	}
+
+	rejections := func() float64 {
+		total := 0.0
+		for _, action := range []provider.ChangeType{provider.ChangeTypeCreate, provider.ChangeTypeDelete} {
+			total += testutil.ToFloat64(metrics.ProtectedHostnameRejections.WithLabelValues(string(action)))
+		}
+		return total
+	}
+
+	before := rejections()
+	protected := provider.HostnamePatterns{"sso.example.com", "status.example.com"}
+	actual := provider.TunnelDNSChangeSet(context.Background(), "tunnel123", rules, zoneMap, provider.ChangeSetOptions{Protected: protected})
+	assert.Empty(t, actual.Changes)
+	// nothing was requested for the protected hostnames, so nothing is refused
+	assert.Equal(t, before, rejections())
+}
@@ -2,9 +2,14 @@ package provider
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"maps"
+	"strings"
+	"time"
 
 	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/cf"
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/util"
 	"github.com/rs/zerolog/log"
 	"sigs.k8s.io/external-dns/endpoint"
 	"sigs.k8s.io/external-dns/plan"
@@ -13,12 +18,38 @@ import (
 
 var _ provider.Provider = (*CloudflareTunnelProvider)(nil)
 
+// RollbackTimeout bounds restoring the ingress rules of an interrupted apply
+const RollbackTimeout = 10 * time.Second
+
 type CloudflareTunnelProvider struct {
 	Cloudflare          cf.Cloudflare
 	CloudflareAccountID string
 	CloudflareTunnelID  string
 	DryRun              bool
 	DomainFilter        []string
+	Policy              Policy
+	ProtectedHostnames  HostnamePatterns
+	ConflictPolicy      ConflictPolicy
+	ServiceInference    ServiceInference
+	ShadowedRules       ShadowedRulesMode
+	AccessEnabled       bool
+	// AccessTeamName enables origin access validation when set
+	AccessTeamName string
+
+	PrivateNetworksEnabled bool
+	// DefaultVirtualNetwork is the name of the virtual network used for routes
+	// which do not specify one, the default of the account is used if empty
+	DefaultVirtualNetwork string
+
+	MigrationBatchSize      int
+	MigrationCheckpointFile string
+
+	ConnectorGuard ConnectorGuard
+	// ReadinessRequireConnectors fails readiness while the tunnel has no
+	// active connections
+	ReadinessRequireConnectors bool
+	// HealthCache reuses the health of the tunnel for a short time if set
+	HealthCache *HealthCache
 }
 
 // Records returns the list of live DNS records
@@ -35,24 +66,68 @@ func (p CloudflareTunnelProvider) Records(ctx context.Context) ([]*endpoint.Endp
 		return nil, fmt.Errorf("failed to list all zone records: %w", err)
 	}
 
+	for i := range records {
+		records[i].Name = NormaliseHostname(records[i].Name)
+	}
+
+	accessSpecs := map[string]AccessSpec{}
+	if p.AccessEnabled {
+		if accessSpecs, err = GetAccessSpecs(ctx, p.Cloudflare, p.CloudflareAccountID); err != nil {
+			return nil, fmt.Errorf("failed to get access specs: %w", err)
+		}
+	}
+
 	recordMap := cf.RecordMapByName(records)
 	endpoints := []*endpoint.Endpoint{}
 
-	for _, ingress := range tunnel.Config.Ingress {
+	rules := NormaliseRules(tunnel.Config.Ingress)
+	hostnames := map[string]bool{}
+	for _, ingress := range rules {
+		hostnames[ingress.Hostname] = true
+	}
+
+	tunnelURI := TunnelURI(p.CloudflareTunnelID)
+	for _, ingress := range rules {
 		if ingress.Hostname == "" {
 			continue
 		}
 
-		if r, ok := recordMap[ingress.Hostname]; !ok || r == nil {
+		if r, ok := recordMap[ingress.Hostname]; (!ok || r == nil) && !resolvesThroughWildcard(recordMap, hostnames, ingress.Hostname, tunnelURI) {
 			continue
 		}
 
-		endpoints = append(endpoints, &endpoint.Endpoint{
+		e := &endpoint.Endpoint{
 			DNSName:    ingress.Hostname,
 			RecordType: endpoint.RecordTypeCNAME,
 			Targets:    []string{ingress.Service},
 			RecordTTL:  endpoint.TTL(1),
-		})
+		}
+
+		spec, hasSpec := accessSpecs[ingress.Hostname]
+		if hasSpec {
+			spec.SetProperties(e)
+		}
+
+		if p.AccessTeamName != "" {
+			if aud, ok := reportedAUD(ingress, spec.AUD); ok {
+				e.SetProviderSpecificProperty(PropertyPrefix+PropertyAccessAUD, aud)
+			}
+		}
+
+		endpoints = append(endpoints, e)
+	}
+
+	if p.PrivateNetworksEnabled {
+		routes, err := GetRoutes(ctx, p.Cloudflare, p.CloudflareAccountID, p.CloudflareTunnelID, p.DefaultVirtualNetwork)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get tunnel routes: %w", err)
+		}
+
+		for _, route := range routes {
+			e := &endpoint.Endpoint{DNSName: route.Hostname, RecordTTL: endpoint.TTL(1)}
+			route.SetEndpoint(e)
+			endpoints = append(endpoints, e)
+		}
 	}
 
 	return endpoints, nil
@@ -61,14 +136,33 @@ func (p CloudflareTunnelProvider) Records(ctx context.Context) ([]*endpoint.Endp
 // AdjustEndpoints adjusts a given set of endpoints
 //
 // required to satisfy the external-dns provider interface
-func (CloudflareTunnelProvider) AdjustEndpoints(endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+func (p CloudflareTunnelProvider) AdjustEndpoints(endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
 	adjusted := []*endpoint.Endpoint{}
-	for _, e := range endpoints {
+	defaultVirtualNetwork := p.defaultVirtualNetwork()
+	for _, e := range NormaliseEndpoints(endpoints) {
+		if route, err := p.adjustRoute(e, defaultVirtualNetwork); err != nil {
+			log.Warn().Err(err).Str("hostname", e.DNSName).Msg("dropping endpoint")
+			continue
+		} else if route {
+			adjusted = append(adjusted, e)
+			continue
+		}
+
 		if e.RecordType != endpoint.RecordTypeCNAME &&
 			e.RecordType != endpoint.RecordTypeTXT {
 			continue
 		}
 
+		if err := p.inferService(e); err != nil {
+			log.Warn().Err(err).Str("hostname", e.DNSName).Msg("dropping endpoint")
+			continue
+		}
+
+		if err := p.adjustAccess(e); err != nil {
+			log.Warn().Err(err).Str("hostname", e.DNSName).Msg("dropping endpoint")
+			continue
+		}
+
 		adjusted = append(adjusted, e)
 	}
 
@@ -83,34 +177,358 @@ func (p CloudflareTunnelProvider) GetDomainFilter() endpoint.DomainFilter {
 //
 // required to satisfy the external-dns provider interface
 func (p CloudflareTunnelProvider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
+	applyPlan, changes, err := p.planChanges(ctx, changes)
+	if err != nil {
+		return err
+	}
+
+	accessUpserts, accessDeletes := splitAccessChanges(applyPlan.Access)
+	audiences := accessAudiences(accessUpserts)
+
+	// protect hostnames before they are routed to the tunnel
+	if !p.DryRun {
+		upserted, err := ApplyAccessChanges(ctx, p.Cloudflare, p.CloudflareAccountID, p.CloudflareTunnelID, accessUpserts)
+		if err != nil {
+			return fmt.Errorf("failed to update access applications: %w", err)
+		}
+
+		maps.Copy(audiences, upserted)
+	}
+
+	if p.AccessTeamName != "" {
+		p.setOriginAccess(applyPlan.Rules, changes, audiences)
+	}
+
+	if p.DryRun {
+		log.Info().Any("rules", applyPlan.Rules).Any("records", applyPlan.Records).Any("access", applyPlan.Access).Any("routes", applyPlan.Routes).Msg("dry run, not applying changes")
+		return nil
+	}
+
+	if ctx.Err() != nil {
+		log.Warn().Err(context.Cause(ctx)).Any("records", applyPlan.Records).Msg("apply interrupted before changing the tunnel")
+		return fmt.Errorf("apply interrupted: %w", context.Cause(ctx))
+	}
+
+	if err := p.Cloudflare.UpdateTunnelIngress(context.WithoutCancel(ctx), p.CloudflareAccountID, p.CloudflareTunnelID, applyPlan.Rules); err != nil {
+		return fmt.Errorf("failed to update tunnel ingress rules: %w", err)
+	}
+
+	if err := BatchUpdateDNSRecords(ctx, p.Cloudflare, applyPlan.Records); err != nil {
+		if ctx.Err() != nil {
+			return p.rollbackIngress(ctx, applyPlan, err)
+		}
+
+		return fmt.Errorf("failed to update zone records: %w", err)
+	}
+
+	if ctx.Err() != nil {
+		return p.rollbackIngress(ctx, applyPlan, context.Cause(ctx))
+	}
+
+	if err := ApplyRouteChanges(ctx, p.Cloudflare, p.CloudflareAccountID, p.CloudflareTunnelID, applyPlan.Routes); err != nil {
+		return fmt.Errorf("failed to update tunnel routes: %w", err)
+	}
+
+	// only unprotect hostnames once they are no longer routed to the tunnel
+	if _, err := ApplyAccessChanges(ctx, p.Cloudflare, p.CloudflareAccountID, p.CloudflareTunnelID, accessDeletes); err != nil {
+		return fmt.Errorf("failed to delete access applications: %w", err)
+	}
+
+	return nil
+}
+
+// rollbackIngress restores the ingress rules from before an interrupted apply.
+// Records are derived from the ingress rules, so the interrupted changes are
+// reported as not made and external-dns makes them again on its next sync
+func (p CloudflareTunnelProvider) rollbackIngress(ctx context.Context, applyPlan *ApplyPlan, cause error) error {
+	log.Warn().Err(cause).Any("records", applyPlan.Records).Any("routes", applyPlan.Routes).Msg("apply interrupted, rolling back tunnel ingress rules")
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), RollbackTimeout)
+	defer cancel()
+
+	if err := p.Cloudflare.UpdateTunnelIngress(ctx, p.CloudflareAccountID, p.CloudflareTunnelID, applyPlan.Current); err != nil {
+		return fmt.Errorf("failed to roll back interrupted apply: %w", errors.Join(cause, err))
+	}
+
+	return fmt.Errorf("rolled back interrupted apply: %w", cause)
+}
+
+// Plan determines the changes ApplyChanges would make without making them,
+// origin access of hostnames without an access application yet is omitted
+func (p CloudflareTunnelProvider) Plan(ctx context.Context, changes *plan.Changes) (*ApplyPlan, error) {
+	applyPlan, changes, err := p.planChanges(ctx, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.AccessTeamName != "" {
+		accessUpserts, _ := splitAccessChanges(applyPlan.Access)
+		p.setOriginAccess(applyPlan.Rules, changes, accessAudiences(accessUpserts))
+	}
+
+	return applyPlan, nil
+}
+
+// planChanges determines the changes to the tunnel, its dns records, access
+// applications and routes, returning them along with the filtered changes
+func (p CloudflareTunnelProvider) planChanges(ctx context.Context, changes *plan.Changes) (*ApplyPlan, *plan.Changes, error) {
 	tunnel, err := p.Cloudflare.GetTunnelConfiguration(ctx, p.CloudflareAccountID, p.CloudflareTunnelID)
 	if err != nil {
-		return fmt.Errorf("failed to get tunnel configuration: %w", err)
+		return nil, nil, fmt.Errorf("failed to get tunnel configuration: %w", err)
+	}
+
+	opts, err := p.changeSetOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	changes = filterMigrated(p.Policy.FilterChanges(NormaliseChanges(changes)), opts.Migrated)
+
+	routeChanges := []RouteChange{}
+	if p.PrivateNetworksEnabled {
+		var routeEndpoints *plan.Changes
+		routeEndpoints, changes = splitRouteChanges(changes)
+		if routeChanges, err = p.routeChangeSet(ctx, routeEndpoints); err != nil {
+			return nil, nil, fmt.Errorf("failed to determine route changes: %w", err)
+		}
+	}
+
+	if err := p.guardConnectors(ctx, changes); err != nil {
+		return nil, nil, err
+	}
+
+	for _, endpoints := range [][]*endpoint.Endpoint{changes.Create, changes.UpdateNew} {
+		for _, e := range endpoints {
+			if err := p.inferService(e); err != nil {
+				return nil, nil, fmt.Errorf("failed to infer service: %w", err)
+			}
+		}
 	}
 
-	rules := Rules(tunnel.Config.Ingress)
-	if err := rules.ApplyChanges(changes); err != nil {
-		return fmt.Errorf("failed to apply changes: %w", err)
+	current := NormaliseRules(tunnel.Config.Ingress)
+	rules := append(Rules{}, current...)
+	if err := rules.ApplyChanges(changes, p.ProtectedHostnames); err != nil {
+		return nil, nil, fmt.Errorf("failed to apply changes: %w", err)
+	}
+
+	if err := validateRules(rules, changes); err != nil {
+		return nil, nil, err
+	}
+
+	if err := p.checkShadowedRules(rules); err != nil {
+		return nil, nil, err
 	}
 
 	zoneMap, err := GenerateZoneMap(ctx, p.Cloudflare)
 	if err != nil {
-		return fmt.Errorf("failed to generate zone map: %w", err)
+		return nil, nil, fmt.Errorf("failed to generate zone map: %w", err)
 	}
 
-	changeset := TunnelDNSChangeSet(p.CloudflareTunnelID, rules, *zoneMap)
+	changeset := TunnelDNSChangeSet(ctx, p.CloudflareTunnelID, rules, *zoneMap, opts)
 
-	if p.DryRun {
-		log.Info().Any("rules", rules).Any("records", changeset).Msg("dry run, not applying changes")
+	if err := checkChangeSet(changes, changeset); err != nil {
+		return nil, nil, err
+	}
+
+	accessChanges := []AccessChange{}
+	if p.AccessEnabled {
+		if accessChanges, err = p.accessChangeSet(ctx, changes, rules); err != nil {
+			return nil, nil, fmt.Errorf("failed to determine access changes: %w", err)
+		}
+	}
+
+	return &ApplyPlan{
+		Current: current,
+		Rules:   rules,
+		Records: p.Policy.FilterChangeSet(changeset.Changes),
+		Access:  accessChanges,
+		Routes:  routeChanges,
+	}, changes, nil
+}
+
+// adjustAccess replaces the access properties of a CNAME endpoint with their
+// canonical form, or removes them if access or origin access validation is not
+// enabled
+func (p CloudflareTunnelProvider) adjustAccess(e *endpoint.Endpoint) error {
+	if e.RecordType != endpoint.RecordTypeCNAME {
 		return nil
 	}
 
-	if err := p.Cloudflare.UpdateTunnelIngress(ctx, p.CloudflareAccountID, p.CloudflareTunnelID, rules); err != nil {
-		return fmt.Errorf("failed to update tunnel ingress rules: %w", err)
+	e.ProviderSpecific = append(endpoint.ProviderSpecific{}, e.ProviderSpecific...)
+
+	audTags := AccessAUDFromEndpoint(e)
+	DeleteProperty(e, PropertyAccessAUD)
+	if p.AccessTeamName != "" && len(audTags) > 0 {
+		e.SetProviderSpecificProperty(PropertyPrefix+PropertyAccessAUD, strings.Join(audTags, ","))
 	}
 
-	if err := BatchUpdateDNSRecords(ctx, p.Cloudflare, changeset); err != nil {
-		return fmt.Errorf("failed to update zone records: %w", err)
+	if !p.AccessEnabled {
+		DeleteProperty(e, PropertyAccessPolicy)
+		DeleteProperty(e, PropertyAccessGroups)
+		return nil
+	}
+
+	spec, err := AccessSpecFromEndpoint(e)
+	if err != nil || spec == nil {
+		return err
+	}
+
+	spec.SetProperties(e)
+	return nil
+}
+
+// accessChangeSet determines the access application changes for the changes
+// being applied to the rules
+func (p CloudflareTunnelProvider) accessChangeSet(ctx context.Context, changes *plan.Changes, rules Rules) ([]AccessChange, error) {
+	applications, err := p.Cloudflare.ListAccessApplications(ctx, p.CloudflareAccountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list access applications: %w", err)
+	}
+
+	desired := map[string]AccessSpec{}
+	removed := []string{}
+	for _, e := range append(append([]*endpoint.Endpoint{}, changes.Create...), changes.UpdateNew...) {
+		if p.ProtectedHostnames.Match(e.DNSName) {
+			continue
+		}
+
+		spec, err := AccessSpecFromEndpoint(e)
+		if err != nil {
+			return nil, err
+		}
+
+		if spec == nil {
+			removed = append(removed, e.DNSName)
+			continue
+		}
+
+		desired[e.DNSName] = *spec
+	}
+
+	for _, e := range changes.Delete {
+		if !p.ProtectedHostnames.Match(e.DNSName) {
+			removed = append(removed, e.DNSName)
+		}
+	}
+
+	live := map[string]bool{}
+	for _, rule := range rules {
+		live[rule.Hostname] = true
+	}
+
+	accessChanges := []AccessChange{}
+	for _, change := range AccessChangeSet(applications, desired, removed, live, p.CloudflareTunnelID, p.GetDomainFilter()) {
+		if change.Action == ChangeTypeDelete && (!p.Policy.allowsDelete() || p.ProtectedHostnames.Match(change.Hostname)) {
+			continue
+		}
+
+		accessChanges = append(accessChanges, change)
+	}
+
+	return accessChanges, nil
+}
+
+// validateRules validates the rules, attributing each invalid rule to the
+// endpoint which produced it
+func validateRules(rules Rules, changes *plan.Changes) error {
+	ruleErrs := rules.Validate()
+	if len(ruleErrs) == 0 {
+		return nil
+	}
+
+	endpoints := map[string]*endpoint.Endpoint{}
+	for _, e := range changes.Create {
+		endpoints[e.DNSName] = e
+	}
+
+	for _, e := range changes.UpdateNew {
+		endpoints[e.DNSName] = e
+	}
+
+	errs := util.ErrorList{}
+	for _, ruleErr := range ruleErrs {
+		if e, ok := endpoints[NormaliseHostname(ruleErr.Hostname)]; ok && ruleErr.Hostname != "" {
+			ruleErr.Endpoint = fmt.Sprintf("%s %s %s", e.DNSName, e.RecordType, e.Targets)
+		}
+
+		log.Error().Err(ruleErr).Int("index", ruleErr.Index).Str("hostname", ruleErr.Hostname).Str("endpoint", ruleErr.Endpoint).Msg("invalid ingress rule")
+		errs.Add(ruleErr)
+	}
+
+	return fmt.Errorf("invalid ingress rules: %w", &errs)
+}
+
+// checkShadowedRules logs every shadowed rule, failing if configured to reject
+// them
+func (p CloudflareTunnelProvider) checkShadowedRules(rules Rules) error {
+	shadows := rules.Analyse()
+	if len(shadows) == 0 {
+		return nil
+	}
+
+	errs := util.ErrorList{}
+	for _, shadow := range shadows {
+		log.Warn().Err(shadow).Int("index", shadow.Index).Int("shadowed_by", shadow.ShadowedBy).Str("hostname", shadow.Hostname).Msg("shadowed ingress rule")
+		errs.Add(shadow)
+	}
+
+	if p.ShadowedRules == ShadowedRulesReject {
+		return fmt.Errorf("shadowed ingress rules: %w", &errs)
+	}
+
+	return nil
+}
+
+// inferService replaces the first target of a CNAME endpoint with the inferred
+// ingress service url. The properties used for inference are removed as they
+// are represented by the target and are never reported by Records
+func (p CloudflareTunnelProvider) inferService(e *endpoint.Endpoint) error {
+	if e.RecordType != endpoint.RecordTypeCNAME {
+		return nil
+	}
+
+	service, err := p.ServiceInference.Infer(e)
+	if err != nil {
+		return err
+	}
+
+	targets := append(endpoint.Targets{service}, e.Targets[1:]...)
+	e.Targets = targets
+	e.ProviderSpecific = append(endpoint.ProviderSpecific{}, e.ProviderSpecific...)
+	DeleteProperty(e, PropertyScheme)
+	DeleteProperty(e, PropertyPort)
+	return nil
+}
+
+// checkChangeSet logs every conflict and unowned hostname, and fails if any of
+// them affect the hostnames being created or updated, so nothing is mutated
+func checkChangeSet(changes *plan.Changes, changeset ChangeSet) error {
+	changed := map[string]bool{}
+	for _, e := range changes.Create {
+		changed[e.DNSName] = true
+	}
+
+	for _, e := range changes.UpdateNew {
+		changed[e.DNSName] = true
+	}
+
+	errs := util.ErrorList{}
+	for _, conflict := range changeset.Conflicts {
+		log.Warn().Err(conflict).Str("hostname", conflict.Name).Any("record", conflict.Record).Msg("conflicting dns record")
+		if changed[conflict.Name] {
+			errs.Add(conflict)
+		}
+	}
+
+	for _, hostname := range changeset.Unowned {
+		log.Warn().Str("hostname", hostname).Msg("no zone owns hostname")
+		if changed[hostname] {
+			errs.Add(fmt.Errorf("no zone owns hostname %s", hostname))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("cannot route hostnames to tunnel: %w", &errs)
 	}
 
 	return nil
@@ -3,11 +3,13 @@ package provider
 import (
 	"context"
 	"fmt"
-	"strings"
+	"slices"
 
 	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/cf"
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/tracing"
 	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/util"
 	"github.com/cloudflare/cloudflare-go"
+	"go.opentelemetry.io/otel/attribute"
 	"sigs.k8s.io/external-dns/endpoint"
 )
 
@@ -30,45 +32,88 @@ type Change struct {
 }
 
 type ZoneDetail struct {
-	Zone    cloudflare.Zone
-	Records map[string]cloudflare.DNSRecord
+	Zone         cloudflare.Zone
+	Records      map[string]cloudflare.DNSRecord
+	OtherRecords map[string][]cloudflare.DNSRecord
 }
 
 type ZoneMap map[string]ZoneDetail
 
-// GetMatchingZone finds the longest matching zone for the hostname
+// GetMatchingZone finds the longest zone which owns the hostname, matching on
+// label boundaries so delegated subzones take precedence over their parent
 func (z ZoneMap) GetMatchingZone(hostname string) *ZoneDetail {
 	longestName := ""
+	found := false
 	for name := range z {
-		if len(name) > len(longestName) && strings.HasSuffix(hostname, name) {
+		if len(name) >= len(longestName) && isSubdomain(hostname, name) {
 			longestName = name
+			found = true
 		}
 	}
 
-	if matching, ok := z[longestName]; ok {
-		return &matching
+	if !found {
+		return nil
 	}
 
-	return nil
+	matching := z[longestName]
+	return &matching
 }
 
-// GetRecordByName finds a record by name in the zone map
+// GetRecordByName finds a record by its literal name in the zone which owns the
+// hostname, a wildcard record is only returned when looking up the wildcard
+// hostname itself
 func (z ZoneMap) GetRecordByName(hostname string) *cloudflare.DNSRecord {
-	for _, zone := range z {
-		if record, ok := zone.Records[hostname]; ok {
-			return &record
-		}
+	zone := z.GetMatchingZone(hostname)
+	if zone == nil {
+		return nil
+	}
+
+	if record, ok := zone.Records[NormaliseHostname(hostname)]; ok {
+		return &record
 	}
 
 	return nil
 }
 
-func GenerateZoneMap(ctx context.Context, cf cf.Cloudflare) (*ZoneMap, error) {
+// GetWildcardRecord finds the wildcard record which covers the hostname, if
+// the hostname is not itself a wildcard
+func (z ZoneMap) GetWildcardRecord(hostname string) *cloudflare.DNSRecord {
+	if IsWildcard(hostname) {
+		return nil
+	}
+
+	wildcard := coveringWildcard(hostname)
+	if wildcard == "" {
+		return nil
+	}
+
+	return z.GetRecordByName(wildcard)
+}
+
+// GetConflictingRecordsByName finds the records which would prevent a CNAME
+// record from being created for the hostname, a CNAME record cannot exist
+// alongside a record of any other type
+func (z ZoneMap) GetConflictingRecordsByName(hostname string) []cloudflare.DNSRecord {
+	conflicting := []cloudflare.DNSRecord{}
+	zone := z.GetMatchingZone(hostname)
+	if zone == nil {
+		return conflicting
+	}
+
+	return append(conflicting, zone.OtherRecords[NormaliseHostname(hostname)]...)
+}
+
+func GenerateZoneMap(ctx context.Context, cf cf.Cloudflare) (_ *ZoneMap, err error) {
+	ctx, span := tracing.Start(ctx, "GenerateZoneMap")
+	defer func() { tracing.End(span, err) }()
+
 	zones, err := cf.ListZones(ctx)
 	if err != nil {
 		return nil, fmt.Errorf("failed to list zones: %w", err)
 	}
 
+	span.SetAttributes(attribute.Int("zones", len(zones)))
+
 	zoneMap := ZoneMap{}
 	for _, zone := range zones {
 		records, err := cf.ListZoneRecords(ctx, zone.ID)
@@ -77,26 +122,66 @@ func GenerateZoneMap(ctx context.Context, cf cf.Cloudflare) (*ZoneMap, error) {
 		}
 
 		recordMap := map[string]cloudflare.DNSRecord{}
+		otherRecordMap := map[string][]cloudflare.DNSRecord{}
 		for _, record := range records {
+			record.Name = NormaliseHostname(record.Name)
+			if record.Type != endpoint.RecordTypeCNAME {
+				otherRecordMap[record.Name] = append(otherRecordMap[record.Name], record)
+				continue
+			}
+
 			recordMap[record.Name] = record
 		}
 
-		zoneMap[zone.Name] = ZoneDetail{zone, recordMap}
+		zoneMap[NormaliseHostname(zone.Name)] = ZoneDetail{zone, recordMap, otherRecordMap}
 	}
 
 	return &zoneMap, nil
 }
 
-func TunnelDNSChangeSet(tunnelID string, rules []cloudflare.UnvalidatedIngressRule, zoneMap ZoneMap) []Change {
-	tunnelURI := fmt.Sprintf("%s.cfargotunnel.com", tunnelID)
+type ChangeSetOptions struct {
+	Protected      HostnamePatterns
+	ConflictPolicy ConflictPolicy
+	// Migrated are the hostnames moved to another tunnel by a migration,
+	// which are left unchanged
+	Migrated []string
+}
+
+type ChangeSet struct {
+	Changes   []Change
+	Conflicts []Conflict
+	// Unowned contains the hostnames which do not fall under any zone
+	Unowned []string
+}
+
+// TunnelURI is the content of the CNAME records which resolve to the tunnel
+func TunnelURI(tunnelID string) string {
+	return fmt.Sprintf("%s.cfargotunnel.com", tunnelID)
+}
+
+// TunnelDNSChangeSet determines the dns record changes required for the rules
+// to resolve to the tunnel, protected and migrated hostnames are never changed
+// and existing records which cannot be taken over are reported as conflicts
+func TunnelDNSChangeSet(ctx context.Context, tunnelID string, rules []cloudflare.UnvalidatedIngressRule, zoneMap ZoneMap, opts ChangeSetOptions) ChangeSet {
+	_, span := tracing.Start(ctx, "TunnelDNSChangeSet", attribute.Int("rules", len(rules)))
+	defer span.End()
+
+	tunnelURI := TunnelURI(tunnelID)
 
+	rules = NormaliseRules(rules)
 	ruleMap := map[string]cloudflare.UnvalidatedIngressRule{}
 	for _, rule := range rules {
 		ruleMap[rule.Hostname] = rule
 	}
 
+	conflicts := []Conflict{}
+	unowned := []string{}
 	changes := map[string]Change{}
 	for _, rule := range rules {
+		if rule.Hostname == "" {
+			continue
+		}
+
 		change := Change{
 			Action:    ChangeTypeNoop,
 			Name:      rule.Hostname,
@@ -104,13 +189,32 @@ func TunnelDNSChangeSet(tunnelID string, rules []cloudflare.UnvalidatedIngressRu
 			Service:   rule.Service,
 		}
 
-		record := zoneMap.GetRecordByName(rule.Hostname)
-		if record == nil {
-			zone := zoneMap.GetMatchingZone(rule.Hostname)
-			if zone == nil {
-				continue
+		if opts.Protected.Match(rule.Hostname) || slices.Contains(opts.Migrated, rule.Hostname) {
+			changes[rule.Hostname] = change
+			continue
+		}
+
+		if conflicting := zoneMap.GetConflictingRecordsByName(rule.Hostname); len(conflicting) > 0 {
+			for _, record := range conflicting {
+				conflicts = append(conflicts, Conflict{rule.Hostname, record, "cannot create CNAME record alongside existing record"})
 			}
 
+			continue
+		}
+
+		zone := zoneMap.GetMatchingZone(rule.Hostname)
+		if zone == nil {
+			unowned = append(unowned, rule.Hostname)
+			continue
+		}
+
+		record := zoneMap.GetRecordByName(rule.Hostname)
+		if record == nil && coveredByWildcard(zoneMap, ruleMap, rule.Hostname, tunnelURI) {
+			changes[rule.Hostname] = change
+			continue
+		}
+
+		if record == nil {
 			change.Action = ChangeTypeCreate
 			change.ZoneID = zone.Zone.ID
 			changes[rule.Hostname] = change
@@ -122,6 +226,12 @@ func TunnelDNSChangeSet(tunnelID string, rules []cloudflare.UnvalidatedIngressRu
 			continue
 		}
 
+		if !opts.ConflictPolicy.allowsTakeover(*record) {
+			reason := fmt.Sprintf("record resolves to %s and conflict policy is %s", record.Content, opts.ConflictPolicy)
+			conflicts = append(conflicts, Conflict{rule.Hostname, *record, reason})
+			continue
+		}
+
 		change.Action = ChangeTypeUpdate
 		change.ZoneID = record.ZoneID
 		change.RecordID = record.ID
@@ -130,26 +240,70 @@ func TunnelDNSChangeSet(tunnelID string, rules []cloudflare.UnvalidatedIngressRu
 
 	for _, zone := range zoneMap {
 		for name, record := range zone.Records {
-			if _, ok := ruleMap[name]; !ok && record.Content == tunnelURI {
-				changes[name] = Change{
-					Action:    ChangeTypeDelete,
-					ZoneID:    record.ZoneID,
-					RecordID:  record.ID,
-					Name:      record.Name,
-					TunnelURI: record.Content,
-				}
+			if _, ok := ruleMap[name]; ok || record.Content != tunnelURI {
+				continue
+			}
+
+			if opts.ConflictPolicy == ConflictPolicyOwned && !IsOwnedRecord(record) {
+				continue
+			}
+
+			changes[name] = Change{
+				Action:    ChangeTypeDelete,
+				ZoneID:    record.ZoneID,
+				RecordID:  record.ID,
+				Name:      record.Name,
+				TunnelURI: record.Content,
 			}
 		}
 	}
 
 	changeList := make([]Change, 0, len(changes))
 	for _, change := range changes {
-		if change.Action != ChangeTypeNoop {
-			changeList = append(changeList, change)
+		if change.Action == ChangeTypeNoop {
+			continue
+		}
+
+		// changes to protected hostnames which external-dns requested were
+		// already refused and counted, these were derived from the live state
+		if opts.Protected.Match(change.Name) || slices.Contains(opts.Migrated, change.Name) {
+			continue
+		}
+
+		changeList = append(changeList, change)
+	}
+
+	span.SetAttributes(attribute.Int("changes", len(changeList)), attribute.Int("conflicts", len(conflicts)))
+	return ChangeSet{changeList, conflicts, unowned}
+}
+
+// coveredByWildcard reports whether the hostname already resolves to the tunnel
+// through a wildcard record which is being kept
+func coveredByWildcard(zoneMap ZoneMap, ruleMap map[string]cloudflare.UnvalidatedIngressRule, hostname, tunnelURI string) bool {
+	wildcard := zoneMap.GetWildcardRecord(hostname)
+	if wildcard == nil || wildcard.Content != tunnelURI {
+		return false
+	}
+
+	_, kept := ruleMap[wildcard.Name]
+	return kept
+}
+
+// resolvesThroughWildcard reports whether the hostname without a record of its
+// own resolves to the tunnel through a wildcard record with an ingress rule
+func resolvesThroughWildcard(recordMap map[string][]cloudflare.DNSRecord, hostnames map[string]bool, hostname, tunnelURI string) bool {
+	wildcard := coveringWildcard(hostname)
+	if IsWildcard(hostname) || wildcard == "" || !hostnames[wildcard] {
+		return false
+	}
+
+	for _, record := range recordMap[wildcard] {
+		if record.Type == endpoint.RecordTypeCNAME && record.Content == tunnelURI {
+			return true
 		}
 	}
 
-	return changeList
+	return false
 }
 
 func ApplyChanges(ctx context.Context, cf cf.Cloudflare, changes []Change) error {
@@ -192,36 +346,19 @@ func ApplyChanges(ctx context.Context, cf cf.Cloudflare, changes []Change) error
 	return nil
 }
 
+// BatchUpdateDNSRecords makes the dns record changes, stopping between
+// changes if the context is cancelled, rather than cutting a change off
 func BatchUpdateDNSRecords(ctx context.Context, cf cf.Cloudflare, changes []Change) error {
 	errs := util.ErrorList{}
 
-	for _, change := range changes {
-		record := cloudflare.DNSRecord{
-			ID:      change.RecordID,
-			ZoneID:  change.ZoneID,
-			Name:    change.Name,
-			Content: change.TunnelURI,
-			Type:    endpoint.RecordTypeCNAME,
-			TTL:     1,
-			Proxied: cloudflare.BoolPtr(true),
-			Comment: fmt.Sprintf("external-dns/%s", change.Service),
+	for i, change := range changes {
+		if ctx.Err() != nil {
+			errs = append(errs, fmt.Errorf("interrupted with %d of %d changes remaining: %w", len(changes)-i, len(changes), context.Cause(ctx)))
+			break
 		}
 
-		switch change.Action {
-		case ChangeTypeCreate:
-			if err := cf.CreateDNSRecord(ctx, record); err != nil {
-				errs = append(errs, err)
-			}
-
-		case ChangeTypeUpdate:
-			if err := cf.UpdateDNSRecord(ctx, record); err != nil {
-				errs = append(errs, err)
-			}
-
-		case ChangeTypeDelete:
-			if err := cf.DeleteDNSRecord(ctx, change.ZoneID, change.RecordID); err != nil {
-				errs = append(errs, err)
-			}
+		if err := applyDNSChange(context.WithoutCancel(ctx), cf, change); err != nil {
+			errs = append(errs, err)
 		}
 	}
 
@@ -231,3 +368,35 @@ func BatchUpdateDNSRecords(ctx context.Context, cf cf.Cloudflare, changes []Chan
 
 	return nil
 }
+
+// applyDNSChange makes the dns record change, recording a span for it
+func applyDNSChange(ctx context.Context, cf cf.Cloudflare, change Change) (err error) {
+	ctx, span := tracing.Start(ctx, "Change",
+		attribute.String("change.action", string(change.Action)),
+		attribute.String("change.name", change.Name),
+		attribute.String("change.zone_id", change.ZoneID),
+	)
+	defer func() { tracing.End(span, err) }()
+
+	record := cloudflare.DNSRecord{
+		ID:      change.RecordID,
+		ZoneID:  change.ZoneID,
+		Name:    change.Name,
+		Content: change.TunnelURI,
+		Type:    endpoint.RecordTypeCNAME,
+		TTL:     1,
+		Proxied: cloudflare.BoolPtr(true),
+		Comment: ownerMark(change.Service),
+	}
+
+	switch change.Action {
+	case ChangeTypeCreate:
+		return cf.CreateDNSRecord(ctx, record)
+	case ChangeTypeUpdate:
+		return cf.UpdateDNSRecord(ctx, record)
+	case ChangeTypeDelete:
+		return cf.DeleteDNSRecord(ctx, change.ZoneID, change.RecordID)
+	}
+
+	return nil
+}
@@ -1,6 +1,8 @@
 package provider_test
 
 import (
+	"context"
+	"errors"
 	"testing"
 
 	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
@@ -79,6 +81,70 @@ func TestTunnelDNSChangeSet(t *testing.T) {
 		},
 	}
 
-	actual := provider.TunnelDNSChangeSet(tunnelID, rules, zoneMap)
-	assert.ElementsMatch(t, expected, actual)
+	actual := provider.TunnelDNSChangeSet(context.Background(), tunnelID, rules, zoneMap, provider.ChangeSetOptions{})
+	assert.ElementsMatch(t, expected, actual.Changes)
+	assert.Empty(t, actual.Conflicts)
+}
+
+func TestZoneMap_GetMatchingZone(t *testing.T) {
+	zoneMap := provider.ZoneMap{
+		"example.com":     provider.ZoneDetail{Zone: cloudflare.Zone{ID: "zone1"}},
+		"sub.example.com": provider.ZoneDetail{Zone: cloudflare.Zone{ID: "zone2"}},
+	}
+
+	tests := []struct {
+		hostname string
+		expected string
+	}{
+		{hostname: "example.com", expected: "zone1"},
+		{hostname: "app.example.com", expected: "zone1"},
+		{hostname: "APP.Example.com.", expected: "zone1"},
+		{hostname: "app.sub.example.com", expected: "zone2"},
+		{hostname: "sub.example.com", expected: "zone2"},
+		{hostname: "notexample.com", expected: ""},
+		{hostname: "example.com.au", expected: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.hostname, func(t *testing.T) {
+			zone := zoneMap.GetMatchingZone(test.hostname)
+			if test.expected == "" {
+				assert.Nil(t, zone)
+				return
+			}
+
+			if assert.NotNil(t, zone) {
+				assert.Equal(t, test.expected, zone.Zone.ID)
+			}
+		})
+	}
+}
+
+func TestTunnelDNSChangeSet_Unowned(t *testing.T) {
+	rules := []cloudflare.UnvalidatedIngressRule{
+		{Hostname: "app.notexample.com", Service: "app"},
+		{Service: "http_status:404"},
+	}
+
+	zoneMap := provider.ZoneMap{
+		"example.com": provider.ZoneDetail{Zone: cloudflare.Zone{ID: "zone123"}},
+	}
+
+	actual := provider.TunnelDNSChangeSet(context.Background(), "tunnel123", rules, zoneMap, provider.ChangeSetOptions{})
+	assert.Empty(t, actual.Changes)
+	assert.Equal(t, []string{"app.notexample.com"}, actual.Unowned)
+}
+
+func TestBatchUpdateDNSRecords_Interrupted(t *testing.T) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(errors.New("shutting down"))
+
+	changes := []provider.Change{
+		{Action: provider.ChangeTypeCreate, ZoneID: "zone123", Name: "a.example.com"},
+		{Action: provider.ChangeTypeCreate, ZoneID: "zone123", Name: "b.example.com"},
+	}
+
+	// no change is attempted, so the client is never used
+	err := provider.BatchUpdateDNSRecords(ctx, nil, changes)
+	assert.ErrorContains(t, err, "interrupted with 2 of 2 changes remaining: shutting down")
 }
@@ -0,0 +1,211 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+	"sigs.k8s.io/external-dns/provider"
+)
+
+var _ provider.Provider = (*ReloadableProvider)(nil)
+
+// ReloadableProvider delegates to the current provider, which can be replaced
+// at any time. Each call uses the provider current when it started, so
+// requests in flight are not affected by a replacement
+type ReloadableProvider struct {
+	current atomic.Pointer[CloudflareTunnelProvider]
+
+	// Background is the context of the migrations run in the background, they
+	// are interrupted when it is cancelled
+	Background context.Context
+
+	// running tracks the applies and migrations in progress
+	running    sync.WaitGroup
+	mu         sync.Mutex
+	inFlight   map[*plan.Changes]struct{}
+	migrations int
+}
+
+func NewReloadableProvider(p CloudflareTunnelProvider) *ReloadableProvider {
+	r := ReloadableProvider{}
+	r.Store(p)
+	return &r
+}
+
+// Load returns the current provider
+func (r *ReloadableProvider) Load() CloudflareTunnelProvider {
+	return *r.current.Load()
+}
+
+// Store replaces the current provider
+func (r *ReloadableProvider) Store(p CloudflareTunnelProvider) {
+	r.current.Store(&p)
+}
+
+func (r *ReloadableProvider) Records(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	return r.Load().Records(ctx)
+}
+
+func (r *ReloadableProvider) AdjustEndpoints(endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, error) {
+	return r.Load().AdjustEndpoints(endpoints)
+}
+
+func (r *ReloadableProvider) GetDomainFilter() endpoint.DomainFilter {
+	return r.Load().GetDomainFilter()
+}
+
+// ApplyChanges applies the changes, tracking them as in flight until done
+func (r *ReloadableProvider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
+	r.running.Add(1)
+	defer r.running.Done()
+
+	r.mu.Lock()
+	if r.inFlight == nil {
+		r.inFlight = map[*plan.Changes]struct{}{}
+	}
+	r.inFlight[changes] = struct{}{}
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		delete(r.inFlight, changes)
+		r.mu.Unlock()
+	}()
+
+	return r.Load().ApplyChanges(ctx, changes)
+}
+
+// InFlight returns the changes of the applies in progress
+func (r *ReloadableProvider) InFlight() []*plan.Changes {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changes := make([]*plan.Changes, 0, len(r.inFlight))
+	for c := range r.inFlight {
+		changes = append(changes, c)
+	}
+
+	return changes
+}
+
+// InFlightMigrations returns the number of migrations in progress
+func (r *ReloadableProvider) InFlightMigrations() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.migrations
+}
+
+// Drain waits for the applies in progress to finish or roll back, and the
+// migrations in progress to save their checkpoint
+func (r *ReloadableProvider) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		r.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%d applies and %d migrations still in progress: %w", len(r.InFlight()), r.InFlightMigrations(), ctx.Err())
+	}
+}
+
+// migrate runs the migration step in the background, tracking it as in flight
+// until done, and returns the checkpoint it starts from. Only one migration
+// runs at a time
+func (r *ReloadableProvider) migrate(checkpoint *MigrationCheckpoint, step func(context.Context) (*MigrationCheckpoint, error)) (*MigrationCheckpoint, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.migrations > 0 {
+		return nil, ErrMigrationInProgress
+	}
+
+	r.migrations++
+	r.running.Add(1)
+
+	ctx := r.Background
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	go func() {
+		defer r.running.Done()
+		defer func() {
+			r.mu.Lock()
+			r.migrations--
+			r.mu.Unlock()
+		}()
+
+		checkpoint, err := step(ctx)
+		if err != nil {
+			log.Error().Err(fmt.Errorf("failed to migrate tunnel: %w", err)).Any("checkpoint", checkpoint).Send()
+			return
+		}
+
+		log.Info().Any("checkpoint", checkpoint).Msg("migration finished")
+	}()
+
+	return checkpoint, nil
+}
+
+func (r *ReloadableProvider) AnalyseRules(ctx context.Context) ([]Shadow, error) {
+	return r.Load().AnalyseRules(ctx)
+}
+
+func (r *ReloadableProvider) TunnelToken(ctx context.Context) (string, error) {
+	return r.Load().TunnelToken(ctx)
+}
+
+// MigrateTunnel starts moving the hostnames of the tunnel to the target tunnel
+// in the background
+func (r *ReloadableProvider) MigrateTunnel(ctx context.Context, target string) (*MigrationCheckpoint, error) {
+	p := r.Load()
+	if err := p.migration().CanStart(p.CloudflareTunnelID, target); err != nil {
+		return nil, err
+	}
+
+	checkpoint := MigrationCheckpoint{SourceTunnelID: p.CloudflareTunnelID, TargetTunnelID: target, Hostnames: []string{}}
+	return r.migrate(&checkpoint, func(ctx context.Context) (*MigrationCheckpoint, error) {
+		return p.MigrateTunnel(ctx, target)
+	})
+}
+
+// ResumeMigration continues the migration from the last checkpoint in the
+// background
+func (r *ReloadableProvider) ResumeMigration(ctx context.Context) (*MigrationCheckpoint, error) {
+	p := r.Load()
+	checkpoint, err := p.migration().Resumable()
+	if err != nil {
+		return nil, err
+	}
+
+	return r.migrate(checkpoint, p.ResumeMigration)
+}
+
+// RollbackMigration moves the migrated hostnames back to the source tunnel in
+// the background
+func (r *ReloadableProvider) RollbackMigration(ctx context.Context) (*MigrationCheckpoint, error) {
+	p := r.Load()
+	checkpoint, err := LoadMigrationCheckpoint(p.MigrationCheckpointFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.migrate(checkpoint, p.RollbackMigration)
+}
+
+func (r *ReloadableProvider) MigrationStatus(ctx context.Context) (*MigrationCheckpoint, error) {
+	return r.Load().MigrationStatus(ctx)
+}
+
+func (r *ReloadableProvider) Ready(ctx context.Context) (*TunnelHealth, error) {
+	return r.Load().Ready(ctx)
+}
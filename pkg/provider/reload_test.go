@@ -0,0 +1,117 @@
+package provider_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+// blockingProvider returns a provider whose dns record changes block until
+// released, signalling when one has started
+func blockingProvider() (*provider.ReloadableProvider, *fakeCloudflare, chan struct{}, chan struct{}) {
+	fake := newFakeCloudflare("example.com")
+	fake.ingress["tunnel123"] = []cloudflare.UnvalidatedIngressRule{{Service: "http_status:404"}}
+
+	started, release := make(chan struct{}), make(chan struct{})
+	fake.onChangeRecord = func(name string) error {
+		close(started)
+		<-release
+		return nil
+	}
+
+	r := provider.NewReloadableProvider(provider.CloudflareTunnelProvider{Cloudflare: fake, CloudflareTunnelID: "tunnel123"})
+	return r, fake, started, release
+}
+
+func drainWithin(r *provider.ReloadableProvider, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return r.Drain(ctx)
+}
+
+func TestReloadableProvider_Drain(t *testing.T) {
+	r, fake, started, release := blockingProvider()
+	assert.Empty(t, r.InFlight())
+	assert.NoError(t, r.Drain(context.Background()))
+
+	changes := &plan.Changes{Create: []*endpoint.Endpoint{endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeCNAME, "http://a")}}
+	applied := make(chan error)
+	go func() { applied <- r.ApplyChanges(context.Background(), changes) }()
+
+	<-started
+	assert.Equal(t, []*plan.Changes{changes}, r.InFlight())
+	assert.ErrorContains(t, drainWithin(r, 50*time.Millisecond), "1 applies and 0 migrations still in progress")
+
+	close(release)
+	assert.NoError(t, r.Drain(context.Background()))
+	assert.NoError(t, <-applied)
+	assert.Empty(t, r.InFlight())
+	assert.Equal(t, []string{"a.example.com"}, fake.RecordNames())
+}
+
+func TestReloadableProvider_DrainInterrupted(t *testing.T) {
+	r, fake, started, release := blockingProvider()
+	current := fake.Ingress("tunnel123")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := &plan.Changes{Create: []*endpoint.Endpoint{
+		endpoint.NewEndpoint("a.example.com", endpoint.RecordTypeCNAME, "http://a"),
+		endpoint.NewEndpoint("b.example.com", endpoint.RecordTypeCNAME, "http://b"),
+	}}
+	applied := make(chan error)
+	go func() { applied <- r.ApplyChanges(ctx, changes) }()
+
+	<-started
+	assert.Len(t, fake.Ingress("tunnel123"), 3)
+
+	cancel()
+	close(release)
+	assert.NoError(t, drainWithin(r, time.Second))
+	assert.ErrorContains(t, <-applied, "rolled back interrupted apply")
+	assert.Equal(t, current, fake.Ingress("tunnel123"))
+	// the change in progress finishes, the remaining change is not made
+	assert.Len(t, fake.RecordNames(), 1)
+}
+
+func TestReloadableProvider_DrainMigration(t *testing.T) {
+	fake := newFakeCloudflare("example.com")
+	fake.ingress["tunnel123"] = []cloudflare.UnvalidatedIngressRule{{Hostname: "a.example.com", Service: "http://a"}, {Service: "http_status:404"}}
+	fake.AddRecord("example.com", "a.example.com", "tunnel123.cfargotunnel.com")
+
+	started, release := make(chan struct{}), make(chan struct{})
+	fake.onChangeRecord = func(name string) error {
+		close(started)
+		<-release
+		return nil
+	}
+
+	r := provider.NewReloadableProvider(provider.CloudflareTunnelProvider{
+		Cloudflare:              fake,
+		CloudflareTunnelID:      "tunnel123",
+		MigrationCheckpointFile: filepath.Join(t.TempDir(), "migration.json"),
+	})
+
+	checkpoint, err := r.MigrateTunnel(context.Background(), "tunnel456")
+	require.NoError(t, err)
+	assert.Equal(t, "tunnel123", checkpoint.SourceTunnelID)
+	assert.Equal(t, "tunnel456", checkpoint.TargetTunnelID)
+
+	<-started
+	assert.Equal(t, 1, r.InFlightMigrations())
+	_, err = r.MigrateTunnel(context.Background(), "tunnel789")
+	assert.ErrorIs(t, err, provider.ErrMigrationInProgress)
+	assert.ErrorContains(t, drainWithin(r, 50*time.Millisecond), "0 applies and 1 migrations still in progress")
+
+	close(release)
+	assert.NoError(t, r.Drain(context.Background()))
+	assert.Equal(t, 0, r.InFlightMigrations())
+	assert.Equal(t, "tunnel456.cfargotunnel.com", fake.RecordContent("a.example.com"))
+}
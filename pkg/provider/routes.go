@@ -0,0 +1,424 @@
+package provider
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/cf"
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/util"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/rs/zerolog/log"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+const (
+	PropertyPrivateCIDR    = "private-cidr"
+	PropertyVirtualNetwork = "virtual-network"
+)
+
+// Route is a private network routed through the tunnel
+type Route struct {
+	Hostname string
+	Network  string
+	// VirtualNetwork is the name of the virtual network, the default virtual
+	// network is used if empty
+	VirtualNetwork string
+}
+
+// RouteFromEndpoint reads the "cloudflare-tunnel/private-cidr" and
+// "cloudflare-tunnel/virtual-network" properties, returning nil if the
+// endpoint is not a route
+func RouteFromEndpoint(e *endpoint.Endpoint) (*Route, error) {
+	cidr, ok := GetProperty(e, PropertyPrivateCIDR)
+	if !ok {
+		return nil, nil
+	}
+
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private cidr for endpoint %s: %w", e.DNSName, err)
+	}
+
+	virtualNetwork, _ := GetProperty(e, PropertyVirtualNetwork)
+	return &Route{Hostname: e.DNSName, Network: network.String(), VirtualNetwork: virtualNetwork}, nil
+}
+
+// SetEndpoint replaces the record type, targets and route properties of the
+// endpoint with the same form reported by Records
+func (r Route) SetEndpoint(e *endpoint.Endpoint) {
+	e.RecordType = endpoint.RecordTypeCNAME
+	e.Targets = endpoint.Targets{r.Network}
+
+	DeleteProperty(e, PropertyPrivateCIDR)
+	DeleteProperty(e, PropertyVirtualNetwork)
+	e.SetProviderSpecificProperty(PropertyPrefix+PropertyPrivateCIDR, r.Network)
+	if r.VirtualNetwork != "" {
+		e.SetProviderSpecificProperty(PropertyPrefix+PropertyVirtualNetwork, r.VirtualNetwork)
+	}
+}
+
+// routeComment marks the tunnel routes created by this provider with the
+// hostname of the endpoint
+func routeComment(hostname string) string {
+	return ownerMark(hostname)
+}
+
+// VirtualNetworks resolves the names of virtual networks
+type VirtualNetworks struct {
+	ids       map[string]string
+	names     map[string]string
+	defaultID string
+}
+
+// NewVirtualNetworks indexes the virtual networks, using the named virtual
+// network as the default if set, otherwise the default of the account
+func NewVirtualNetworks(networks []cloudflare.TunnelVirtualNetwork, defaultName string) (*VirtualNetworks, error) {
+	v := VirtualNetworks{ids: map[string]string{}, names: map[string]string{}}
+	for _, network := range networks {
+		v.ids[network.Name] = network.ID
+		v.names[network.ID] = network.Name
+		if network.IsDefaultNetwork {
+			v.defaultID = network.ID
+		}
+	}
+
+	if defaultName != "" {
+		id, ok := v.ids[defaultName]
+		if !ok {
+			return nil, fmt.Errorf("virtual network %s does not exist", defaultName)
+		}
+
+		v.defaultID = id
+	}
+
+	return &v, nil
+}
+
+// ID returns the id of the named virtual network, or of the default virtual
+// network if the name is empty
+func (v VirtualNetworks) ID(name string) (string, error) {
+	if name == "" {
+		return v.defaultID, nil
+	}
+
+	id, ok := v.ids[name]
+	if !ok {
+		return "", fmt.Errorf("virtual network %s does not exist", name)
+	}
+
+	return id, nil
+}
+
+// Name returns the name of the virtual network, or nothing for the default
+// virtual network
+func (v VirtualNetworks) Name(id string) string {
+	if id == "" || id == v.defaultID {
+		return ""
+	}
+
+	return v.names[id]
+}
+
+// GetRoutes reads the tunnel routes created by this provider
+func GetRoutes(ctx context.Context, cf cf.Cloudflare, accountID, tunnelID, defaultVirtualNetwork string) ([]Route, error) {
+	tunnelRoutes, err := cf.ListTunnelRoutes(ctx, accountID, tunnelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tunnel routes: %w", err)
+	}
+
+	networks, err := cf.ListVirtualNetworks(ctx, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list virtual networks: %w", err)
+	}
+
+	virtualNetworks, err := NewVirtualNetworks(networks, defaultVirtualNetwork)
+	if err != nil {
+		return nil, err
+	}
+
+	routes := []Route{}
+	for _, tunnelRoute := range tunnelRoutes {
+		hostname, ok := ownedValue(tunnelRoute.Comment)
+		if !ok {
+			continue
+		}
+
+		routes = append(routes, Route{
+			Hostname:       hostname,
+			Network:        tunnelRoute.Network,
+			VirtualNetwork: virtualNetworks.Name(tunnelRoute.VirtualNetworkID),
+		})
+	}
+
+	return routes, nil
+}
+
+type RouteChange struct {
+	Action ChangeType
+	Route
+	VirtualNetworkID string
+}
+
+// RouteChangeSet determines the tunnel route changes required so that every
+// desired route exists and every removed route does not. Routes are identified
+// by their network and virtual network, the routes of the account are given so
+// existing routes through another tunnel or for another hostname are conflicts
+func RouteChangeSet(accountRoutes []cloudflare.TunnelRoute, desired, removed []Route, virtualNetworks VirtualNetworks, tunnelID string) ([]RouteChange, error) {
+	key := func(network, virtualNetworkID string) string {
+		return virtualNetworkID + "/" + network
+	}
+
+	existing := map[string]cloudflare.TunnelRoute{}
+	for _, tunnelRoute := range accountRoutes {
+		existing[key(tunnelRoute.Network, tunnelRoute.VirtualNetworkID)] = tunnelRoute
+	}
+
+	errs := util.ErrorList{}
+	changes := []RouteChange{}
+	kept := map[string]bool{}
+
+	for _, route := range desired {
+		virtualNetworkID, err := virtualNetworks.ID(route.VirtualNetwork)
+		if err != nil {
+			errs.Add(fmt.Errorf("route %s for endpoint %s: %w", route.Network, route.Hostname, err))
+			continue
+		}
+
+		k := key(route.Network, virtualNetworkID)
+		kept[k] = true
+
+		if tunnelRoute, ok := existing[k]; ok {
+			if tunnelRoute.TunnelID != tunnelID {
+				errs.Add(fmt.Errorf("route %s for endpoint %s already exists through tunnel %s: %q", route.Network, route.Hostname, tunnelRoute.TunnelID, tunnelRoute.Comment))
+			} else if tunnelRoute.Comment != routeComment(route.Hostname) {
+				errs.Add(fmt.Errorf("route %s for endpoint %s already exists: %q", route.Network, route.Hostname, tunnelRoute.Comment))
+			}
+
+			continue
+		}
+
+		changes = append(changes, RouteChange{ChangeTypeCreate, route, virtualNetworkID})
+	}
+
+	for _, route := range removed {
+		virtualNetworkID, err := virtualNetworks.ID(route.VirtualNetwork)
+		if err != nil {
+			log.Warn().Err(err).Str("hostname", route.Hostname).Str("network", route.Network).Msg("cannot delete route")
+			continue
+		}
+
+		k := key(route.Network, virtualNetworkID)
+		if tunnelRoute, ok := existing[k]; ok && !kept[k] && tunnelRoute.TunnelID == tunnelID && tunnelRoute.Comment == routeComment(route.Hostname) {
+			changes = append(changes, RouteChange{ChangeTypeDelete, route, virtualNetworkID})
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, &errs
+	}
+
+	return changes, nil
+}
+
+// ApplyRouteChanges creates or deletes the tunnel routes
+func ApplyRouteChanges(ctx context.Context, cf cf.Cloudflare, accountID, tunnelID string, changes []RouteChange) error {
+	errs := util.ErrorList{}
+
+	for _, change := range changes {
+		var err error
+		switch change.Action {
+		case ChangeTypeCreate:
+			err = cf.CreateTunnelRoute(ctx, accountID, cloudflare.TunnelRoutesCreateParams{
+				Network:          change.Network,
+				TunnelID:         tunnelID,
+				Comment:          routeComment(change.Hostname),
+				VirtualNetworkID: change.VirtualNetworkID,
+			})
+		case ChangeTypeDelete:
+			err = cf.DeleteTunnelRoute(ctx, accountID, cloudflare.TunnelRoutesDeleteParams{
+				Network:          change.Network,
+				VirtualNetworkID: change.VirtualNetworkID,
+			})
+		}
+
+		if err != nil {
+			errs.Add(err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return &errs
+	}
+
+	return nil
+}
+
+// isRoute reports whether the endpoint is a private network route rather than
+// a hostname
+func isRoute(e *endpoint.Endpoint) bool {
+	_, ok := GetProperty(e, PropertyPrivateCIDR)
+	return ok
+}
+
+// splitRouteChanges separates the changes to routes from the changes to
+// hostnames
+func splitRouteChanges(changes *plan.Changes) (*plan.Changes, *plan.Changes) {
+	routes, hostnames := &plan.Changes{}, &plan.Changes{}
+	split := func(endpoints []*endpoint.Endpoint) ([]*endpoint.Endpoint, []*endpoint.Endpoint) {
+		routes, hostnames := []*endpoint.Endpoint{}, []*endpoint.Endpoint{}
+		for _, e := range endpoints {
+			if isRoute(e) {
+				routes = append(routes, e)
+			} else {
+				hostnames = append(hostnames, e)
+			}
+		}
+
+		return routes, hostnames
+	}
+
+	routes.Create, hostnames.Create = split(changes.Create)
+	routes.UpdateOld, hostnames.UpdateOld = split(changes.UpdateOld)
+	routes.UpdateNew, hostnames.UpdateNew = split(changes.UpdateNew)
+	routes.Delete, hostnames.Delete = split(changes.Delete)
+	return routes, hostnames
+}
+
+// adjustRoute replaces a route endpoint with its canonical form, reporting
+// whether the endpoint is a route. Route properties are removed if private
+// networks are not enabled. The default virtual network is omitted, as it is
+// by Records, defaultVirtualNetwork returns its name
+func (p CloudflareTunnelProvider) adjustRoute(e *endpoint.Endpoint, defaultVirtualNetwork func() string) (bool, error) {
+	if !isRoute(e) {
+		return false, nil
+	}
+
+	e.ProviderSpecific = append(endpoint.ProviderSpecific{}, e.ProviderSpecific...)
+	if !p.PrivateNetworksEnabled {
+		DeleteProperty(e, PropertyPrivateCIDR)
+		DeleteProperty(e, PropertyVirtualNetwork)
+		return false, nil
+	}
+
+	route, err := RouteFromEndpoint(e)
+	if err != nil {
+		return true, err
+	}
+
+	if route.VirtualNetwork != "" && route.VirtualNetwork == defaultVirtualNetwork() {
+		route.VirtualNetwork = ""
+	}
+
+	route.SetEndpoint(e)
+	return true, nil
+}
+
+// defaultVirtualNetwork returns the name of the virtual network used by routes
+// which do not name one, DEFAULT_VIRTUAL_NETWORK if set, otherwise the default
+// virtual network of the account, which is looked up once
+func (p CloudflareTunnelProvider) defaultVirtualNetwork() func() string {
+	return sync.OnceValue(func() string {
+		if p.DefaultVirtualNetwork != "" {
+			return p.DefaultVirtualNetwork
+		}
+
+		networks, err := p.Cloudflare.ListVirtualNetworks(context.Background(), p.CloudflareAccountID)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to look up the default virtual network")
+			return ""
+		}
+
+		for _, network := range networks {
+			if network.IsDefaultNetwork {
+				return network.Name
+			}
+		}
+
+		return ""
+	})
+}
+
+// routeChangeSet determines the tunnel route changes for the changes to route
+// endpoints, changes to protected hostnames are refused
+func (p CloudflareTunnelProvider) routeChangeSet(ctx context.Context, changes *plan.Changes) ([]RouteChange, error) {
+	// the old endpoints of updates are only matched, the update is refused
+	// for the new endpoint
+	routes := func(action ChangeType, endpoints []*endpoint.Endpoint) ([]Route, error) {
+		routes := []Route{}
+		for _, e := range endpoints {
+			if action == ChangeTypeNoop && p.ProtectedHostnames.Match(e.DNSName) {
+				continue
+			}
+
+			if err := p.ProtectedHostnames.Check(e.DNSName, action); err != nil {
+				continue
+			}
+
+			route, err := RouteFromEndpoint(e)
+			if err != nil {
+				return nil, err
+			}
+
+			routes = append(routes, *route)
+		}
+
+		return routes, nil
+	}
+
+	desired, removed := []Route{}, []Route{}
+	for _, group := range []struct {
+		action    ChangeType
+		endpoints []*endpoint.Endpoint
+		routes    *[]Route
+	}{
+		{ChangeTypeCreate, changes.Create, &desired},
+		{ChangeTypeUpdate, changes.UpdateNew, &desired},
+		{ChangeTypeNoop, changes.UpdateOld, &removed},
+		{ChangeTypeDelete, changes.Delete, &removed},
+	} {
+		routes, err := routes(group.action, group.endpoints)
+		if err != nil {
+			return nil, err
+		}
+
+		*group.routes = append(*group.routes, routes...)
+	}
+
+	if len(desired) == 0 && len(removed) == 0 {
+		return nil, nil
+	}
+
+	accountRoutes, err := p.Cloudflare.ListTunnelRoutes(ctx, p.CloudflareAccountID, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tunnel routes: %w", err)
+	}
+
+	networks, err := p.Cloudflare.ListVirtualNetworks(ctx, p.CloudflareAccountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list virtual networks: %w", err)
+	}
+
+	virtualNetworks, err := NewVirtualNetworks(networks, p.DefaultVirtualNetwork)
+	if err != nil {
+		return nil, err
+	}
+
+	routeChanges, err := RouteChangeSet(accountRoutes, desired, removed, *virtualNetworks, p.CloudflareTunnelID)
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := []RouteChange{}
+	for _, change := range routeChanges {
+		if change.Action == ChangeTypeDelete && !p.Policy.allowsDelete() {
+			continue
+		}
+
+		filtered = append(filtered, change)
+	}
+
+	return filtered, nil
+}
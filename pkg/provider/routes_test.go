@@ -0,0 +1,135 @@
+package provider_test
+
+import (
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestRouteFromEndpoint(t *testing.T) {
+	e := endpoint.NewEndpoint("internal.example.com", endpoint.RecordTypeA, "10.0.0.1")
+	route, err := provider.RouteFromEndpoint(e)
+	assert.NoError(t, err)
+	assert.Nil(t, route)
+
+	e.SetProviderSpecificProperty("webhook/cloudflare-tunnel-private-cidr", "10.0.0.1/24")
+	e.SetProviderSpecificProperty("cloudflare-tunnel/virtual-network", "staging")
+	route, err = provider.RouteFromEndpoint(e)
+	assert.NoError(t, err)
+	assert.Equal(t, &provider.Route{Hostname: "internal.example.com", Network: "10.0.0.0/24", VirtualNetwork: "staging"}, route)
+
+	route.SetEndpoint(e)
+	assert.Equal(t, endpoint.RecordTypeCNAME, e.RecordType)
+	assert.Equal(t, endpoint.Targets{"10.0.0.0/24"}, e.Targets)
+	cidr, _ := e.GetProviderSpecificProperty("cloudflare-tunnel/private-cidr")
+	assert.Equal(t, "10.0.0.0/24", cidr)
+
+	e.SetProviderSpecificProperty("cloudflare-tunnel/private-cidr", "10.0.0.300/24")
+	_, err = provider.RouteFromEndpoint(e)
+	assert.Error(t, err)
+}
+
+func TestVirtualNetworks(t *testing.T) {
+	networks := []cloudflare.TunnelVirtualNetwork{
+		{ID: "vnet1", Name: "default", IsDefaultNetwork: true},
+		{ID: "vnet2", Name: "staging"},
+	}
+
+	virtualNetworks, err := provider.NewVirtualNetworks(networks, "")
+	assert.NoError(t, err)
+	id, err := virtualNetworks.ID("")
+	assert.NoError(t, err)
+	assert.Equal(t, "vnet1", id)
+	assert.Equal(t, "", virtualNetworks.Name("vnet1"))
+	assert.Equal(t, "staging", virtualNetworks.Name("vnet2"))
+
+	virtualNetworks, err = provider.NewVirtualNetworks(networks, "staging")
+	assert.NoError(t, err)
+	id, err = virtualNetworks.ID("")
+	assert.NoError(t, err)
+	assert.Equal(t, "vnet2", id)
+	assert.Equal(t, "default", virtualNetworks.Name("vnet1"))
+
+	_, err = virtualNetworks.ID("missing")
+	assert.Error(t, err)
+
+	_, err = provider.NewVirtualNetworks(networks, "missing")
+	assert.Error(t, err)
+}
+
+func TestRouteChangeSet(t *testing.T) {
+	virtualNetworks, err := provider.NewVirtualNetworks([]cloudflare.TunnelVirtualNetwork{
+		{ID: "vnet1", Name: "default", IsDefaultNetwork: true},
+		{ID: "vnet2", Name: "staging"},
+	}, "")
+	assert.NoError(t, err)
+
+	accountRoutes := []cloudflare.TunnelRoute{
+		{Network: "10.0.0.0/24", VirtualNetworkID: "vnet1", TunnelID: "tunnel123", Comment: "external-dns/a.example.com"},
+		{Network: "10.0.1.0/24", VirtualNetworkID: "vnet1", TunnelID: "tunnel123", Comment: "external-dns/b.example.com"},
+		{Network: "10.0.2.0/24", VirtualNetworkID: "vnet1", TunnelID: "tunnel123", Comment: "manual"},
+		{Network: "10.0.3.0/24", VirtualNetworkID: "vnet1", TunnelID: "tunnel456", Comment: "external-dns/f.example.com"},
+	}
+
+	desired := []provider.Route{
+		{Hostname: "a.example.com", Network: "10.0.0.0/24"},
+		{Hostname: "c.example.com", Network: "10.0.0.0/24", VirtualNetwork: "staging"},
+	}
+
+	removed := []provider.Route{
+		{Hostname: "a.example.com", Network: "10.0.0.0/24"},
+		{Hostname: "b.example.com", Network: "10.0.1.0/24"},
+		{Hostname: "d.example.com", Network: "10.0.2.0/24"},
+		{Hostname: "f.example.com", Network: "10.0.3.0/24"},
+	}
+
+	changes, err := provider.RouteChangeSet(accountRoutes, desired, removed, *virtualNetworks, "tunnel123")
+	assert.NoError(t, err)
+	assert.Equal(t, []provider.RouteChange{
+		{Action: provider.ChangeTypeCreate, Route: desired[1], VirtualNetworkID: "vnet2"},
+		{Action: provider.ChangeTypeDelete, Route: removed[1], VirtualNetworkID: "vnet1"},
+	}, changes)
+
+	_, err = provider.RouteChangeSet(accountRoutes, []provider.Route{{Hostname: "e.example.com", Network: "10.0.2.0/24"}}, nil, *virtualNetworks, "tunnel123")
+	assert.ErrorContains(t, err, `already exists: "manual"`)
+
+	_, err = provider.RouteChangeSet(accountRoutes, []provider.Route{{Hostname: "f.example.com", Network: "10.0.3.0/24"}}, nil, *virtualNetworks, "tunnel123")
+	assert.ErrorContains(t, err, "already exists through tunnel tunnel456")
+}
+
+func TestAdjustEndpointsDefaultVirtualNetwork(t *testing.T) {
+	fake := newFakeCloudflare()
+	fake.networks = []cloudflare.TunnelVirtualNetwork{
+		{ID: "vnet1", Name: "default", IsDefaultNetwork: true},
+		{ID: "vnet2", Name: "staging"},
+	}
+
+	route := func(virtualNetwork string) *endpoint.Endpoint {
+		e := endpoint.NewEndpoint("internal.example.com", endpoint.RecordTypeA, "10.0.0.1")
+		e.SetProviderSpecificProperty("cloudflare-tunnel/private-cidr", "10.0.0.0/24")
+		e.SetProviderSpecificProperty("cloudflare-tunnel/virtual-network", virtualNetwork)
+		return e
+	}
+
+	virtualNetwork := func(p provider.CloudflareTunnelProvider, e *endpoint.Endpoint) string {
+		adjusted, err := p.AdjustEndpoints([]*endpoint.Endpoint{e})
+		assert.NoError(t, err)
+		if !assert.Len(t, adjusted, 1) {
+			return ""
+		}
+
+		name, _ := adjusted[0].GetProviderSpecificProperty("cloudflare-tunnel/virtual-network")
+		return name
+	}
+
+	p := provider.CloudflareTunnelProvider{Cloudflare: fake, PrivateNetworksEnabled: true}
+	assert.Equal(t, "", virtualNetwork(p, route("default")))
+	assert.Equal(t, "staging", virtualNetwork(p, route("staging")))
+
+	p.DefaultVirtualNetwork = "staging"
+	assert.Equal(t, "default", virtualNetwork(p, route("default")))
+	assert.Equal(t, "", virtualNetwork(p, route("staging")))
+}
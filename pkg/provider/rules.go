@@ -1,7 +1,10 @@
 package provider
 
 import (
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
 
 	"github.com/cloudflare/cloudflare-go"
 	"github.com/rs/zerolog/log"
@@ -10,14 +13,19 @@ import (
 
 type Rules []cloudflare.UnvalidatedIngressRule
 
-func (r *Rules) CreateRule(hostname, service string) error {
+func (r *Rules) CreateRule(hostname, service string, protected HostnamePatterns) error {
+	hostname = NormaliseHostname(hostname)
+	if err := protected.Check(hostname, ChangeTypeCreate); err != nil {
+		return err
+	}
+
 	for _, rule := range *r {
-		if rule.Hostname == hostname && rule.Service == service {
+		if NormaliseHostname(rule.Hostname) == hostname && rule.Service == service {
 			log.Debug().Str("hostname", hostname).Str("service", service).Msg("rule already exists, skipping")
 			return nil
 		}
 
-		if rule.Hostname == hostname && rule.Service != service {
+		if NormaliseHostname(rule.Hostname) == hostname && rule.Service != service {
 			return fmt.Errorf("rule for hostname %s already exists: %s", hostname, service)
 		}
 	}
@@ -32,9 +40,14 @@ func (r *Rules) CreateRule(hostname, service string) error {
 	return nil
 }
 
-func (r *Rules) UpdateRule(hostname, service string) error {
+func (r *Rules) UpdateRule(hostname, service string, protected HostnamePatterns) error {
+	hostname = NormaliseHostname(hostname)
+	if err := protected.Check(hostname, ChangeTypeUpdate); err != nil {
+		return err
+	}
+
 	for i, rule := range *r {
-		if rule.Hostname == hostname {
+		if NormaliseHostname(rule.Hostname) == hostname {
 			(*r)[i].Service = service
 			return nil
 		}
@@ -43,9 +56,14 @@ func (r *Rules) UpdateRule(hostname, service string) error {
 	return fmt.Errorf("rule for hostname %s does not exist", hostname)
 }
 
-func (r *Rules) DeleteRule(hostname string) error {
+func (r *Rules) DeleteRule(hostname string, protected HostnamePatterns) error {
+	hostname = NormaliseHostname(hostname)
+	if err := protected.Check(hostname, ChangeTypeDelete); err != nil {
+		return err
+	}
+
 	for i, rule := range *r {
-		if rule.Hostname == hostname {
+		if NormaliseHostname(rule.Hostname) == hostname {
 			*r = append((*r)[:i], (*r)[i+1:]...)
 			return nil
 		}
@@ -54,24 +72,57 @@ func (r *Rules) DeleteRule(hostname string) error {
 	return fmt.Errorf("rule for hostname %s does not exist", hostname)
 }
 
-func (r *Rules) ApplyChanges(changes *plan.Changes) error {
+// Order moves wildcard rules after the rules for specific hostnames, with more
+// specific wildcards first, so they do not shadow them. The catch-all stays
+// last, rules matching only a path keep their place among specific hostnames
+func (r *Rules) Order() {
+	rank := func(rule cloudflare.UnvalidatedIngressRule) int {
+		switch {
+		case isCatchAll(rule):
+			return 2
+		case IsWildcard(rule.Hostname):
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	slices.SortStableFunc(*r, func(a, b cloudflare.UnvalidatedIngressRule) int {
+		if rankA, rankB := rank(a), rank(b); rankA != rankB {
+			return rankA - rankB
+		}
+
+		if rank(a) == 1 {
+			// more labels is more specific
+			return strings.Count(b.Hostname, ".") - strings.Count(a.Hostname, ".")
+		}
+
+		return 0
+	})
+}
+
+// ApplyChanges applies the external-dns changes to the ingress rules, changes
+// to protected hostnames are skipped
+func (r *Rules) ApplyChanges(changes *plan.Changes, protected HostnamePatterns) error {
 	for _, change := range changes.Create {
-		if err := r.CreateRule(change.DNSName, change.Targets[0]); err != nil {
+		if err := r.CreateRule(change.DNSName, change.Targets[0], protected); err != nil && !errors.Is(err, ErrProtectedHostname) {
 			return err
 		}
 	}
 
 	for _, change := range changes.UpdateNew {
-		if err := r.UpdateRule(change.DNSName, change.Targets[0]); err != nil {
+		if err := r.UpdateRule(change.DNSName, change.Targets[0], protected); err != nil && !errors.Is(err, ErrProtectedHostname) {
 			return err
 		}
 	}
 
 	for _, change := range changes.Delete {
-		if err := r.DeleteRule(change.DNSName); err != nil {
+		if err := r.DeleteRule(change.DNSName, protected); err != nil && !errors.Is(err, ErrProtectedHostname) {
 			return err
 		}
 	}
 
+	r.Order()
+
 	return nil
 }
@@ -19,12 +19,12 @@ func TestRules_CreateRule(t *testing.T) {
 	}
 
 	// same
-	err := rules.CreateRule("example.com", "service1")
+	err := rules.CreateRule("example.com", "service1", nil)
 	assert.NoError(t, err)
 	assert.Len(t, rules, 1)
 
 	// new
-	err = rules.CreateRule("example2.com", "service2")
+	err = rules.CreateRule("example2.com", "service2", nil)
 	assert.NoError(t, err)
 	assert.Len(t, rules, 2)
 }
@@ -37,11 +37,11 @@ func TestRules_UpdateRule(t *testing.T) {
 		},
 	}
 
-	err := rules.UpdateRule("example.com", "service2")
+	err := rules.UpdateRule("example.com", "service2", nil)
 	assert.NoError(t, err)
 	assert.Len(t, rules, 1)
 
-	err = rules.UpdateRule("example2.com", "service3")
+	err = rules.UpdateRule("example2.com", "service3", nil)
 	assert.EqualError(t, err, "rule for hostname example2.com does not exist")
 	assert.Len(t, rules, 1)
 }
@@ -54,11 +54,11 @@ func TestRules_DeleteRule(t *testing.T) {
 		},
 	}
 
-	err := rules.DeleteRule("example.com")
+	err := rules.DeleteRule("example.com", nil)
 	assert.NoError(t, err)
 	assert.Len(t, rules, 0)
 
-	err = rules.DeleteRule("example2.com")
+	err = rules.DeleteRule("example2.com", nil)
 	assert.EqualError(t, err, "rule for hostname example2.com does not exist")
 	assert.Len(t, rules, 0)
 }
@@ -93,7 +93,7 @@ func TestRules_ApplyChanges(t *testing.T) {
 		},
 	}
 
-	err := rules.ApplyChanges(changes)
+	err := rules.ApplyChanges(changes, nil)
 	assert.NoError(t, err)
 	assert.Equal(t, provider.Rules{{
 		Hostname: "example.com",
@@ -0,0 +1,154 @@
+package provider
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+// ServiceSchemes are the url schemes cloudflared accepts for an ingress service
+var ServiceSchemes = []string{"http", "https", "tcp", "ssh", "rdp", "smb", "unix", "unix+tls"}
+
+// IsServiceURL reports whether the target is already usable as an ingress
+// service without inference
+func IsServiceURL(target string) bool {
+	if target == "hello_world" || target == "bastion" || strings.HasPrefix(target, "http_status:") {
+		return true
+	}
+
+	scheme, _, ok := strings.Cut(target, ":")
+	return ok && slices.Contains(ServiceSchemes, scheme) && (strings.HasPrefix(target, scheme+"://") || strings.HasPrefix(scheme, "unix"))
+}
+
+// ServiceTemplateData is available to service templates
+type ServiceTemplateData struct {
+	Hostname string
+	Target   string
+	Scheme   string
+	Port     int64
+}
+
+// ServiceInference turns raw external-dns targets, such as a bare hostname or
+// ip address, into ingress service urls
+type ServiceInference struct {
+	DefaultScheme string
+	DefaultPort   int64
+	// Templates maps a domain to the template used for hostnames under it
+	Templates map[string]*template.Template
+}
+
+// ParseServiceTemplates parses templates in the form of "<domain>=<template>",
+// e.g. "internal.example.com=https://{{.Target}}:8443"
+func ParseServiceTemplates(raw []string) (map[string]*template.Template, error) {
+	templates := map[string]*template.Template{}
+	for _, entry := range raw {
+		domain, text, ok := strings.Cut(entry, "=")
+		if !ok || domain == "" || text == "" {
+			return nil, fmt.Errorf("invalid service template: %s", entry)
+		}
+
+		domain = NormaliseHostname(domain)
+		tmpl, err := template.New(domain).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse service template for %s: %w", domain, err)
+		}
+
+		templates[domain] = tmpl
+	}
+
+	return templates, nil
+}
+
+// matchingTemplate finds the template for the longest domain which the
+// hostname falls under
+func (s ServiceInference) matchingTemplate(hostname string) *template.Template {
+	longestDomain := ""
+	for domain := range s.Templates {
+		if len(domain) > len(longestDomain) && isSubdomain(hostname, domain) {
+			longestDomain = domain
+		}
+	}
+
+	return s.Templates[longestDomain]
+}
+
+// Infer determines the service url for the endpoint. Targets which are already
+// service urls are used verbatim, otherwise the "cloudflare-tunnel/scheme" and
+// "cloudflare-tunnel/port" properties take precedence over a template for the
+// domain, which takes precedence over the default scheme and port
+func (s ServiceInference) Infer(e *endpoint.Endpoint) (string, error) {
+	if len(e.Targets) == 0 {
+		return "", fmt.Errorf("endpoint %s has no targets", e.DNSName)
+	}
+
+	target := e.Targets[0]
+	if IsServiceURL(target) {
+		return target, nil
+	}
+
+	data := ServiceTemplateData{
+		Hostname: e.DNSName,
+		Target:   target,
+		Scheme:   s.DefaultScheme,
+		Port:     s.DefaultPort,
+	}
+
+	scheme, hasScheme := GetProperty(e, PropertyScheme)
+	if hasScheme {
+		data.Scheme = scheme
+	}
+
+	rawPort, hasPort := GetProperty(e, PropertyPort)
+	if hasPort {
+		port, err := strconv.ParseInt(rawPort, 10, 64)
+		if err != nil || port < 1 || port > 65535 {
+			return "", fmt.Errorf("invalid port for endpoint %s: %s", e.DNSName, rawPort)
+		}
+
+		data.Port = port
+	}
+
+	var service string
+	if tmpl := s.matchingTemplate(e.DNSName); tmpl != nil && !hasScheme && !hasPort {
+		rendered := strings.Builder{}
+		if err := tmpl.Execute(&rendered, data); err != nil {
+			return "", fmt.Errorf("failed to render service template for endpoint %s: %w", e.DNSName, err)
+		}
+
+		service = rendered.String()
+	} else {
+		service = buildServiceURL(data.Scheme, target, data.Port)
+	}
+
+	if !IsServiceURL(service) {
+		return "", fmt.Errorf("inferred invalid service for endpoint %s: %s", e.DNSName, service)
+	}
+
+	return service, nil
+}
+
+func buildServiceURL(scheme, target string, port int64) string {
+	if scheme == "" {
+		scheme = "http"
+	}
+
+	if strings.HasPrefix(scheme, "unix") {
+		return scheme + ":" + target
+	}
+
+	host := target
+	if port > 0 {
+		if _, _, err := net.SplitHostPort(target); err != nil {
+			host = net.JoinHostPort(strings.Trim(target, "[]"), strconv.FormatInt(port, 10))
+		}
+	} else if ip := net.ParseIP(target); ip != nil && ip.To4() == nil {
+		host = "[" + target + "]"
+	}
+
+	return scheme + "://" + host
+}
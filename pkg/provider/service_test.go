@@ -0,0 +1,139 @@
+package provider_test
+
+import (
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/external-dns/endpoint"
+)
+
+func TestServiceInference_Infer(t *testing.T) {
+	templates, err := provider.ParseServiceTemplates([]string{
+		"db.example.com=tcp://{{.Target}}:5432",
+		"secure.example.com=https://{{.Target}}",
+	})
+	assert.NoError(t, err)
+
+	inference := provider.ServiceInference{
+		DefaultScheme: "http",
+		Templates:     templates,
+	}
+
+	tests := []struct {
+		name       string
+		endpoint   *endpoint.Endpoint
+		expected   string
+		errMessage string
+	}{
+		{
+			name:     "verbatim",
+			endpoint: endpoint.NewEndpoint("app.example.com", "CNAME", "https://app.default.svc:8443"),
+			expected: "https://app.default.svc:8443",
+		},
+		{
+			name:     "http status",
+			endpoint: endpoint.NewEndpoint("app.example.com", "CNAME", "http_status:404"),
+			expected: "http_status:404",
+		},
+		{
+			name:     "ip",
+			endpoint: endpoint.NewEndpoint("app.example.com", "CNAME", "10.0.0.5"),
+			expected: "http://10.0.0.5",
+		},
+		{
+			name:     "ipv6",
+			endpoint: endpoint.NewEndpoint("app.example.com", "CNAME", "fd00::1"),
+			expected: "http://[fd00::1]",
+		},
+		{
+			name:     "template",
+			endpoint: endpoint.NewEndpoint("postgres.db.example.com", "CNAME", "postgres.default.svc"),
+			expected: "tcp://postgres.default.svc:5432",
+		},
+		{
+			name:     "longest template",
+			endpoint: endpoint.NewEndpoint("app.secure.example.com", "CNAME", "app.default.svc"),
+			expected: "https://app.default.svc",
+		},
+		{
+			name: "properties",
+			endpoint: endpoint.NewEndpoint("postgres.db.example.com", "CNAME", "10.0.0.5").
+				WithProviderSpecific("cloudflare-tunnel/scheme", "ssh").
+				WithProviderSpecific("cloudflare-tunnel/port", "22"),
+			expected: "ssh://10.0.0.5:22",
+		},
+		{
+			name: "webhook properties",
+			endpoint: endpoint.NewEndpoint("app.example.com", "CNAME", "10.0.0.5").
+				WithProviderSpecific("webhook/cloudflare-tunnel-scheme", "https"),
+			expected: "https://10.0.0.5",
+		},
+		{
+			name: "existing port",
+			endpoint: endpoint.NewEndpoint("app.example.com", "CNAME", "10.0.0.5:8080").
+				WithProviderSpecific("cloudflare-tunnel/port", "80"),
+			expected: "http://10.0.0.5:8080",
+		},
+		{
+			name: "unix",
+			endpoint: endpoint.NewEndpoint("app.example.com", "CNAME", "/var/run/app.sock").
+				WithProviderSpecific("cloudflare-tunnel/scheme", "unix"),
+			expected: "unix:/var/run/app.sock",
+		},
+		{
+			name: "invalid scheme",
+			endpoint: endpoint.NewEndpoint("app.example.com", "CNAME", "10.0.0.5").
+				WithProviderSpecific("cloudflare-tunnel/scheme", "ftp"),
+			errMessage: "inferred invalid service for endpoint app.example.com: ftp://10.0.0.5",
+		},
+		{
+			name: "invalid port",
+			endpoint: endpoint.NewEndpoint("app.example.com", "CNAME", "10.0.0.5").
+				WithProviderSpecific("cloudflare-tunnel/port", "http"),
+			errMessage: "invalid port for endpoint app.example.com: http",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, err := inference.Infer(test.endpoint)
+			if test.errMessage != "" {
+				assert.EqualError(t, err, test.errMessage)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, test.expected, actual)
+		})
+	}
+}
+
+func TestParseServiceTemplates(t *testing.T) {
+	_, err := provider.ParseServiceTemplates([]string{"example.com"})
+	assert.EqualError(t, err, "invalid service template: example.com")
+
+	_, err = provider.ParseServiceTemplates([]string{"example.com=http://{{.Target"})
+	assert.ErrorContains(t, err, "failed to parse service template for example.com")
+}
+
+func TestCloudflareTunnelProvider_AdjustEndpoints(t *testing.T) {
+	p := provider.CloudflareTunnelProvider{
+		ServiceInference: provider.ServiceInference{DefaultScheme: "http"},
+	}
+
+	original := endpoint.NewEndpoint("App.example.com", "CNAME", "10.0.0.5").
+		WithProviderSpecific("cloudflare-tunnel/scheme", "https").
+		WithProviderSpecific("cloudflare-tunnel/port", "8443")
+
+	adjusted, err := p.AdjustEndpoints([]*endpoint.Endpoint{original})
+	assert.NoError(t, err)
+	assert.Len(t, adjusted, 1)
+	assert.Equal(t, "app.example.com", adjusted[0].DNSName)
+	assert.Equal(t, endpoint.Targets{"https://10.0.0.5:8443"}, adjusted[0].Targets)
+	assert.Empty(t, adjusted[0].ProviderSpecific)
+
+	// original is untouched
+	assert.Equal(t, endpoint.Targets{"10.0.0.5"}, original.Targets)
+	assert.Len(t, original.ProviderSpecific, 2)
+}
@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/cf"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/rs/zerolog/log"
+)
+
+// FindTunnel returns the remotely managed tunnel with the name, or nil if none
+// exists
+func FindTunnel(ctx context.Context, cf cf.Cloudflare, accountID, name string) (*cloudflare.Tunnel, error) {
+	tunnels, err := cf.ListTunnelsByName(ctx, accountID, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tunnels: %w", err)
+	}
+
+	for _, tunnel := range tunnels {
+		if tunnel.Name != name {
+			continue
+		}
+
+		if !tunnel.RemoteConfig {
+			return nil, fmt.Errorf("tunnel %s (%s) is locally managed, only remotely managed tunnels can be configured", name, tunnel.ID)
+		}
+
+		return &tunnel, nil
+	}
+
+	return nil, nil
+}
+
+// ProvisionTunnel returns the id of the tunnel with the name, creating a
+// remotely managed tunnel with a catch-all rule if none exists
+func ProvisionTunnel(ctx context.Context, cf cf.Cloudflare, accountID, name string) (string, error) {
+	existing, err := FindTunnel(ctx, cf, accountID, name)
+	if err != nil {
+		return "", err
+	}
+
+	if existing != nil {
+		log.Info().Str("tunnel_id", existing.ID).Str("tunnel_name", name).Msg("using existing tunnel")
+		return existing.ID, nil
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", fmt.Errorf("failed to generate tunnel secret: %w", err)
+	}
+
+	tunnel, err := cf.CreateTunnel(ctx, accountID, cloudflare.TunnelCreateParams{
+		Name:      name,
+		Secret:    base64.StdEncoding.EncodeToString(secret),
+		ConfigSrc: "cloudflare",
+	})
+	if err != nil {
+		return "", err
+	}
+
+	rules := Rules{{Service: "http_status:404"}}
+	if err := cf.UpdateTunnelIngress(ctx, accountID, tunnel.ID, rules); err != nil {
+		return "", fmt.Errorf("failed to initialise tunnel ingress rules: %w", err)
+	}
+
+	log.Info().Str("tunnel_id", tunnel.ID).Str("tunnel_name", name).Msg("created tunnel")
+	return tunnel.ID, nil
+}
+
+// WriteTunnelToken writes the connector token of the tunnel to a file, which
+// cloudflared can read with --token-file
+func WriteTunnelToken(ctx context.Context, cf cf.Cloudflare, accountID, tunnelID, path string) error {
+	token, err := cf.GetTunnelToken(ctx, accountID, tunnelID)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, []byte(token), 0o600); err != nil {
+		return fmt.Errorf("failed to write tunnel token to %s: %w", path, err)
+	}
+
+	log.Info().Str("path", path).Msg("wrote tunnel token")
+	return nil
+}
+
+// TunnelToken returns the connector token of the tunnel
+func (p CloudflareTunnelProvider) TunnelToken(ctx context.Context) (string, error) {
+	return p.Cloudflare.GetTunnelToken(ctx, p.CloudflareAccountID, p.CloudflareTunnelID)
+}
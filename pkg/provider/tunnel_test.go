@@ -0,0 +1,48 @@
+package provider_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProvisionTunnel(t *testing.T) {
+	fake := newFakeCloudflare()
+
+	id, err := provider.ProvisionTunnel(context.Background(), fake, "account123", "webhook")
+	assert.NoError(t, err)
+	if assert.Len(t, fake.tunnels, 1) {
+		assert.Equal(t, fake.tunnels[0].ID, id)
+		assert.True(t, fake.tunnels[0].RemoteConfig)
+		assert.NotEmpty(t, fake.tunnels[0].Secret)
+	}
+
+	assert.Equal(t, []cloudflare.UnvalidatedIngressRule{{Service: "http_status:404"}}, fake.Ingress(id))
+
+	existing, err := provider.ProvisionTunnel(context.Background(), fake, "account123", "webhook")
+	assert.NoError(t, err)
+	assert.Equal(t, id, existing)
+	assert.Len(t, fake.tunnels, 1)
+
+	fake.tunnels = append(fake.tunnels, cloudflare.Tunnel{ID: "local123", Name: "local"})
+	_, err = provider.ProvisionTunnel(context.Background(), fake, "account123", "local")
+	assert.ErrorContains(t, err, "locally managed")
+}
+
+func TestWriteTunnelToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "token")
+	assert.NoError(t, provider.WriteTunnelToken(context.Background(), newFakeCloudflare(), "account123", "tunnel123", path))
+
+	raw, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "token-tunnel123", string(raw))
+
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+}
@@ -0,0 +1,251 @@
+package provider
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/util"
+	"github.com/cloudflare/cloudflare-go"
+)
+
+// RuleError describes everything wrong with a single ingress rule
+type RuleError struct {
+	Index    int
+	Hostname string
+	Path     string
+	// Endpoint describes the external-dns endpoint which produced the rule, if
+	// any
+	Endpoint string
+	Err      error
+}
+
+func (e RuleError) Error() string {
+	name := e.Hostname
+	if name == "" {
+		name = "catch-all"
+	}
+
+	if e.Path != "" {
+		name = fmt.Sprintf("%s%s", name, e.Path)
+	}
+
+	if e.Endpoint != "" {
+		return fmt.Sprintf("ingress rule %d (%s) from endpoint %s: %s", e.Index, name, e.Endpoint, e.Err)
+	}
+
+	return fmt.Sprintf("ingress rule %d (%s): %s", e.Index, name, e.Err)
+}
+
+func (e RuleError) Unwrap() error {
+	return e.Err
+}
+
+// isCatchAll reports whether the rule matches every request
+func isCatchAll(rule cloudflare.UnvalidatedIngressRule) bool {
+	return (rule.Hostname == "" || rule.Hostname == "*") && rule.Path == ""
+}
+
+// Validate checks the rules the same way cloudflared does when loading remote
+// configuration, returning one error for each invalid rule
+func (r Rules) Validate() []RuleError {
+	if len(r) == 0 {
+		return []RuleError{{Index: 0, Err: fmt.Errorf("at least one catch-all rule is required")}}
+	}
+
+	ruleErrs := []RuleError{}
+	seen := map[string]int{}
+	for i, rule := range r {
+		errs := util.ErrorList{}
+
+		if err := validateRuleHostname(rule.Hostname); err != nil {
+			errs.Add(err)
+		}
+
+		if rule.Path != "" {
+			if _, err := regexp.Compile(rule.Path); err != nil {
+				errs.Add(fmt.Errorf("invalid path regex: %w", err))
+			}
+		}
+
+		if err := validateRuleService(rule.Service); err != nil {
+			errs.Add(err)
+		}
+
+		if err := validateOriginRequest(rule.OriginRequest); err != nil {
+			errs.Add(err)
+		}
+
+		key := NormaliseHostname(rule.Hostname) + rule.Path
+		if first, ok := seen[key]; ok {
+			errs.Add(fmt.Errorf("duplicates the hostname and path of rule %d", first))
+		} else {
+			seen[key] = i
+		}
+
+		last := i == len(r)-1
+		if last && !isCatchAll(rule) {
+			errs.Add(fmt.Errorf("the last rule must match all requests, i.e. have no hostname and no path"))
+		}
+
+		if !last && isCatchAll(rule) {
+			errs.Add(fmt.Errorf("rule matches all requests but is not the last rule"))
+		}
+
+		if len(errs) > 0 {
+			ruleErrs = append(ruleErrs, RuleError{
+				Index:    i,
+				Hostname: rule.Hostname,
+				Path:     rule.Path,
+				Err:      &errs,
+			})
+		}
+	}
+
+	return ruleErrs
+}
+
+func validateRuleHostname(hostname string) error {
+	if hostname == "" || hostname == "*" {
+		return nil
+	}
+
+	if strings.Contains(hostname, ":") {
+		return fmt.Errorf("hostname cannot contain a port")
+	}
+
+	if strings.Count(hostname, "*") > 1 || (strings.Contains(hostname, "*") && !IsWildcard(hostname)) {
+		return fmt.Errorf("hostname can only contain a single wildcard as the leftmost label, e.g. *.example.com")
+	}
+
+	return nil
+}
+
+func validateRuleService(service string) error {
+	if service == "" {
+		return fmt.Errorf("service is required")
+	}
+
+	if !IsServiceURL(service) {
+		return fmt.Errorf("invalid service %q, must be one of hello_world, bastion, http_status:<code> or a url with a scheme of %s", service, strings.Join(ServiceSchemes, ", "))
+	}
+
+	if code, ok := strings.CutPrefix(service, "http_status:"); ok {
+		status, err := strconv.Atoi(code)
+		if err != nil || status < 100 || status > 599 {
+			return fmt.Errorf("invalid http status code %q", code)
+		}
+
+		return nil
+	}
+
+	if service == "hello_world" || service == "bastion" {
+		return nil
+	}
+
+	if path, ok := strings.CutPrefix(service, "unix:"); ok {
+		if path == "" {
+			return fmt.Errorf("unix socket path is required")
+		}
+
+		return nil
+	}
+
+	if path, ok := strings.CutPrefix(service, "unix+tls:"); ok {
+		if path == "" {
+			return fmt.Errorf("unix socket path is required")
+		}
+
+		return nil
+	}
+
+	u, err := url.Parse(service)
+	if err != nil {
+		return fmt.Errorf("invalid service url: %w", err)
+	}
+
+	if u.Hostname() == "" {
+		return fmt.Errorf("service url %q has no host", service)
+	}
+
+	if port := u.Port(); port != "" {
+		if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("service url %q has an invalid port", service)
+		}
+	}
+
+	if u.Path != "" && u.Path != "/" {
+		return fmt.Errorf("service url %q cannot have a path", service)
+	}
+
+	return nil
+}
+
+func validateOriginRequest(config *cloudflare.OriginRequestConfig) error {
+	if config == nil {
+		return nil
+	}
+
+	errs := util.ErrorList{}
+
+	durations := []struct {
+		name     string
+		duration *cloudflare.TunnelDuration
+	}{
+		{"connectTimeout", config.ConnectTimeout},
+		{"tlsTimeout", config.TLSTimeout},
+		{"tcpKeepAlive", config.TCPKeepAlive},
+		{"keepAliveTimeout", config.KeepAliveTimeout},
+	}
+
+	for _, d := range durations {
+		if d.duration != nil && d.duration.Duration < 0 {
+			errs.Add(fmt.Errorf("originRequest.%s cannot be negative", d.name))
+		}
+	}
+
+	if config.KeepAliveConnections != nil && *config.KeepAliveConnections < 0 {
+		errs.Add(fmt.Errorf("originRequest.keepAliveConnections cannot be negative"))
+	}
+
+	if config.ProxyPort != nil && *config.ProxyPort > 65535 {
+		errs.Add(fmt.Errorf("originRequest.proxyPort must be between 0 and 65535"))
+	}
+
+	if config.ProxyType != nil && *config.ProxyType != "" && *config.ProxyType != "socks" {
+		errs.Add(fmt.Errorf("originRequest.proxyType must be empty or socks"))
+	}
+
+	for _, rule := range config.IPRules {
+		if rule.Prefix != nil {
+			if _, _, err := net.ParseCIDR(*rule.Prefix); err != nil {
+				errs.Add(fmt.Errorf("originRequest.ipRules prefix %q is not a valid cidr", *rule.Prefix))
+			}
+		}
+
+		for _, port := range rule.Ports {
+			if port < 1 || port > 65535 {
+				errs.Add(fmt.Errorf("originRequest.ipRules port %d must be between 1 and 65535", port))
+			}
+		}
+	}
+
+	if config.Access != nil && config.Access.Required {
+		if config.Access.TeamName == "" {
+			errs.Add(fmt.Errorf("originRequest.access.teamName is required"))
+		}
+
+		if len(config.Access.AudTag) == 0 {
+			errs.Add(fmt.Errorf("originRequest.access.audTag is required"))
+		}
+	}
+
+	if len(errs) > 0 {
+		return &errs
+	}
+
+	return nil
+}
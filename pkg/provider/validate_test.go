@@ -0,0 +1,56 @@
+package provider_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRules_Validate(t *testing.T) {
+	valid := provider.Rules{
+		{Hostname: "app.example.com", Service: "http://app.default.svc:8080"},
+		{Hostname: "app.example.com", Path: "^/api/.*", Service: "https://api.default.svc"},
+		{Hostname: "*.example.com", Service: "unix:/var/run/app.sock"},
+		{Hostname: "ssh.example.com", Service: "ssh://10.0.0.5:22"},
+		{Service: "http_status:404"},
+	}
+
+	assert.Empty(t, valid.Validate())
+
+	invalid := provider.Rules{
+		{Hostname: "app.example.com:8080", Service: "http://app.default.svc"},
+		{Hostname: "app.example.com", Path: "[", Service: "10.0.0.5"},
+		{Hostname: "api.example.com", Service: "http://api.default.svc/v1"},
+		{Hostname: "api.example.com", Service: "http_status:999"},
+		{Hostname: "a.*.example.com", Service: "hello_world"},
+		{Service: "http_status:404"},
+		{Hostname: "slow.example.com", Service: "http://slow.default.svc", OriginRequest: &cloudflare.OriginRequestConfig{
+			ConnectTimeout: &cloudflare.TunnelDuration{Duration: -time.Second},
+			Access:         &cloudflare.AccessConfig{Required: true},
+		}},
+	}
+
+	ruleErrs := invalid.Validate()
+	indexes := []int{}
+	for _, ruleErr := range ruleErrs {
+		indexes = append(indexes, ruleErr.Index)
+	}
+
+	assert.Equal(t, []int{0, 1, 2, 3, 4, 5, 6}, indexes)
+	assert.ErrorContains(t, ruleErrs[0], "hostname cannot contain a port")
+	assert.ErrorContains(t, ruleErrs[1], "invalid path regex")
+	assert.ErrorContains(t, ruleErrs[1], `invalid service "10.0.0.5"`)
+	assert.ErrorContains(t, ruleErrs[2], "cannot have a path")
+	assert.ErrorContains(t, ruleErrs[3], `invalid http status code "999"`)
+	assert.ErrorContains(t, ruleErrs[3], "duplicates the hostname and path of rule 2")
+	assert.ErrorContains(t, ruleErrs[4], "single wildcard")
+	assert.ErrorContains(t, ruleErrs[5], "matches all requests but is not the last rule")
+	assert.ErrorContains(t, ruleErrs[6], "originRequest.connectTimeout cannot be negative")
+	assert.ErrorContains(t, ruleErrs[6], "originRequest.access.teamName is required")
+	assert.ErrorContains(t, ruleErrs[6], "the last rule must match all requests")
+
+	assert.NotEmpty(t, provider.Rules{}.Validate())
+}
@@ -0,0 +1,157 @@
+package provider_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+)
+
+func TestRules_Order(t *testing.T) {
+	rules := provider.Rules{
+		{Hostname: "*.example.com", Service: "wildcard"},
+		{Hostname: "app.example.com", Service: "app"},
+		{Path: "/static", Service: "static"},
+		{Service: "http_status:404"},
+		{Hostname: "*.sub.example.com", Service: "sub-wildcard"},
+		{Hostname: "api.example.com", Service: "api"},
+	}
+
+	rules.Order()
+	assert.Equal(t, provider.Rules{
+		{Hostname: "app.example.com", Service: "app"},
+		{Path: "/static", Service: "static"},
+		{Hostname: "api.example.com", Service: "api"},
+		{Hostname: "*.sub.example.com", Service: "sub-wildcard"},
+		{Hostname: "*.example.com", Service: "wildcard"},
+		{Service: "http_status:404"},
+	}, rules)
+
+	// a catch-all can also be written as "*"
+	rules = provider.Rules{
+		{Hostname: "*", Service: "http_status:404"},
+		{Hostname: "*.example.com", Service: "http://wildcard"},
+		{Hostname: "app.example.com", Service: "http://app"},
+	}
+
+	rules.Order()
+	assert.Equal(t, provider.Rules{
+		{Hostname: "app.example.com", Service: "http://app"},
+		{Hostname: "*.example.com", Service: "http://wildcard"},
+		{Hostname: "*", Service: "http_status:404"},
+	}, rules)
+	assert.Empty(t, rules.Validate())
+}
+
+func TestRules_ApplyChangesWildcard(t *testing.T) {
+	rules := provider.Rules{
+		{Hostname: "app.example.com", Service: "app"},
+		{Service: "http_status:404"},
+	}
+
+	changes := &plan.Changes{
+		Create: []*endpoint.Endpoint{{DNSName: "*.example.com", Targets: []string{"wildcard"}}},
+	}
+
+	err := rules.ApplyChanges(changes, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, provider.Rules{
+		{Hostname: "app.example.com", Service: "app"},
+		{Hostname: "*.example.com", Service: "wildcard"},
+		{Service: "http_status:404"},
+	}, rules)
+}
+
+func TestZoneMap_GetRecordByNameWildcard(t *testing.T) {
+	zoneMap := provider.ZoneMap{
+		"example.com": provider.ZoneDetail{
+			Zone: cloudflare.Zone{ID: "zone123"},
+			Records: map[string]cloudflare.DNSRecord{
+				"*.example.com": {ID: "record1", Name: "*.example.com"},
+			},
+		},
+	}
+
+	assert.Nil(t, zoneMap.GetRecordByName("app.example.com"))
+	assert.Equal(t, "record1", zoneMap.GetRecordByName("*.example.com").ID)
+	assert.Equal(t, "record1", zoneMap.GetWildcardRecord("app.example.com").ID)
+	assert.Nil(t, zoneMap.GetWildcardRecord("*.example.com"))
+	assert.Nil(t, zoneMap.GetWildcardRecord("app.sub.example.com"))
+}
+
+func TestTunnelDNSChangeSet_Wildcard(t *testing.T) {
+	zoneMap := provider.ZoneMap{
+		"example.com": provider.ZoneDetail{
+			Zone: cloudflare.Zone{ID: "zone123"},
+			Records: map[string]cloudflare.DNSRecord{
+				"*.example.com": {
+					ID:      "record1",
+					ZoneID:  "zone123",
+					Name:    "*.example.com",
+					Content: "tunnel123.cfargotunnel.com",
+				},
+			},
+		},
+	}
+
+	// specific hostnames are covered by the wildcard record
+	rules := []cloudflare.UnvalidatedIngressRule{
+		{Hostname: "app.example.com", Service: "app"},
+		{Hostname: "*.example.com", Service: "wildcard"},
+	}
+
+	actual := provider.TunnelDNSChangeSet(context.Background(), "tunnel123", rules, zoneMap, provider.ChangeSetOptions{})
+	assert.Empty(t, actual.Changes)
+
+	// the wildcard record is removed so the specific hostname needs its own
+	rules = []cloudflare.UnvalidatedIngressRule{
+		{Hostname: "app.example.com", Service: "app"},
+	}
+
+	actual = provider.TunnelDNSChangeSet(context.Background(), "tunnel123", rules, zoneMap, provider.ChangeSetOptions{})
+	assert.ElementsMatch(t, []provider.Change{
+		{
+			Action:    provider.ChangeTypeCreate,
+			ZoneID:    "zone123",
+			Name:      "app.example.com",
+			TunnelURI: "tunnel123.cfargotunnel.com",
+			Service:   "app",
+		},
+		{
+			Action:    provider.ChangeTypeDelete,
+			ZoneID:    "zone123",
+			RecordID:  "record1",
+			Name:      "*.example.com",
+			TunnelURI: "tunnel123.cfargotunnel.com",
+		},
+	}, actual.Changes)
+}
+
+func TestRecordsWildcard(t *testing.T) {
+	fake := newFakeCloudflare("example.com")
+	fake.ingress["tunnel123"] = []cloudflare.UnvalidatedIngressRule{
+		{Hostname: "app.example.com", Service: "http://app"},
+		{Hostname: "covered.example.com", Service: "http://covered"},
+		{Hostname: "*.example.com", Service: "http://wildcard"},
+		{Hostname: "other.sub.example.com", Service: "http://other"},
+		{Service: "http_status:404"},
+	}
+	fake.AddRecord("example.com", "app.example.com", "tunnel123.cfargotunnel.com")
+	fake.AddRecord("example.com", "*.example.com", "tunnel123.cfargotunnel.com")
+
+	p := provider.CloudflareTunnelProvider{Cloudflare: fake, CloudflareTunnelID: "tunnel123"}
+	endpoints, err := p.Records(context.Background())
+	assert.NoError(t, err)
+
+	names := []string{}
+	for _, e := range endpoints {
+		names = append(names, e.DNSName)
+	}
+
+	// other.sub.example.com is not covered by *.example.com
+	assert.Equal(t, []string{"app.example.com", "covered.example.com", "*.example.com"}, names)
+}
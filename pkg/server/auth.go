@@ -0,0 +1,151 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/metrics"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	AuthModeNone   = "none"
+	AuthModeBearer = "bearer"
+	AuthModeHMAC   = "hmac"
+
+	SignatureHeader = "X-Webhook-Signature"
+	TimestampHeader = "X-Webhook-Timestamp"
+)
+
+// SignatureTolerance is how far the timestamp of a signed request may be from
+// the current time
+var SignatureTolerance = 5 * time.Minute
+
+// MaxBodySize is the largest body read to verify the signature of a request
+var MaxBodySize int64 = 10 << 20
+
+// Sign returns the hmac signature of a request, the hex encoded sha256 hmac of
+// "<timestamp>\n<method>\n<request uri>\n<body>"
+func Sign(secret string, timestamp int64, method, uri string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d\n%s\n%s\n", timestamp, method, uri)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyBearer checks the bearer token of the request against the secret
+func verifyBearer(r *http.Request, secret string) error {
+	bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return fmt.Errorf("missing bearer token")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(bearer), []byte(secret)) != 1 {
+		return fmt.Errorf("invalid bearer token")
+	}
+
+	return nil
+}
+
+// verifySignature checks the hmac signature of the request against the secret,
+// restoring the body for the handler. Bodies over MaxBodySize are rejected
+func verifySignature(w http.ResponseWriter, r *http.Request, secret string, now time.Time) error {
+	signature := r.Header.Get(SignatureHeader)
+	if signature == "" {
+		return fmt.Errorf("missing %s header", SignatureHeader)
+	}
+
+	timestamp, err := strconv.ParseInt(r.Header.Get(TimestampHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header: %w", TimestampHeader, err)
+	}
+
+	if skew := now.Sub(time.Unix(timestamp, 0)).Abs(); skew > SignatureTolerance {
+		return fmt.Errorf("timestamp is %s from the current time", skew.Round(time.Second))
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxBodySize))
+	if err != nil {
+		return fmt.Errorf("failed to read body: %w", err)
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	expected := Sign(secret, timestamp, r.Method, r.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	return nil
+}
+
+// verifyClientCertificate checks the request presented a client certificate
+// signed by the client ca
+func verifyClientCertificate(r *http.Request) error {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return fmt.Errorf("missing verified client certificate")
+	}
+
+	return nil
+}
+
+// authenticate rejects requests which fail the bearer or hmac check of the
+// mode, or lack a verified client certificate if required. Exempt paths are
+// only checked for the client certificate
+func authenticate(mode string, secret func() string, clientCertificate bool, exempt ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			method := mode
+			err := func() error {
+				if clientCertificate {
+					if err := verifyClientCertificate(r); err != nil {
+						method = "mtls"
+						return err
+					}
+				}
+
+				for _, path := range exempt {
+					if r.URL.Path == path {
+						return nil
+					}
+				}
+
+				switch mode {
+				case AuthModeBearer:
+					return verifyBearer(r, secret())
+				case AuthModeHMAC:
+					return verifySignature(w, r, secret(), time.Now())
+				default:
+					return nil
+				}
+			}()
+
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				log.Warn().Err(err).Str("path", r.URL.Path).Str("remote_addr", r.RemoteAddr).Msg("request body too large")
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				_, _ = w.Write([]byte(http.StatusText(http.StatusRequestEntityTooLarge)))
+				return
+			}
+
+			if err != nil {
+				metrics.AuthFailures.WithLabelValues(method).Inc()
+				log.Warn().Err(err).Str("path", r.URL.Path).Str("remote_addr", r.RemoteAddr).Msg("unauthorised request")
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,93 @@
+package server_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/server"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/external-dns/endpoint"
+	"sigs.k8s.io/external-dns/plan"
+	"sigs.k8s.io/external-dns/provider"
+)
+
+type stubProvider struct {
+	provider.BaseProvider
+	changes *plan.Changes
+}
+
+func (p *stubProvider) Records(ctx context.Context) ([]*endpoint.Endpoint, error) {
+	return []*endpoint.Endpoint{}, nil
+}
+
+func (p *stubProvider) ApplyChanges(ctx context.Context, changes *plan.Changes) error {
+	p.changes = changes
+	return nil
+}
+
+func serve(t *testing.T, mode string, r *http.Request) int {
+	s, err := server.NewServer(&stubProvider{}, server.Options{
+		AuthMode:   mode,
+		AuthSecret: func() string { return "secret" },
+	})
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	s.Handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+func TestBearerAuth(t *testing.T) {
+	assert.Equal(t, http.StatusOK, serve(t, server.AuthModeBearer, httptest.NewRequest(http.MethodGet, "/healthz", nil)))
+	assert.Equal(t, http.StatusUnauthorized, serve(t, server.AuthModeBearer, httptest.NewRequest(http.MethodGet, "/records", nil)))
+
+	r := httptest.NewRequest(http.MethodGet, "/records", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	assert.Equal(t, http.StatusUnauthorized, serve(t, server.AuthModeBearer, r))
+
+	r = httptest.NewRequest(http.MethodGet, "/records", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	assert.Equal(t, http.StatusOK, serve(t, server.AuthModeBearer, r))
+
+	assert.Equal(t, http.StatusOK, serve(t, server.AuthModeNone, httptest.NewRequest(http.MethodGet, "/records", nil)))
+}
+
+func TestHMACAuth(t *testing.T) {
+	body := `{"Create":[{"dnsName":"app.example.com","targets":["10.0.0.5"],"recordType":"CNAME"}]}`
+	sign := func(secret string, timestamp int64, uri string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(body))
+		r.Header.Set(server.TimestampHeader, strconv.FormatInt(timestamp, 10))
+		r.Header.Set(server.SignatureHeader, server.Sign(secret, timestamp, http.MethodPost, uri, []byte(body)))
+		return r
+	}
+
+	now := time.Now().Unix()
+	p := stubProvider{}
+	s, err := server.NewServer(&p, server.Options{
+		AuthMode:   server.AuthModeHMAC,
+		AuthSecret: func() string { return "secret" },
+	})
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	s.Handler.ServeHTTP(w, sign("secret", now, "/records"))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	if assert.NotNil(t, p.changes) {
+		assert.Equal(t, "app.example.com", p.changes.Create[0].DNSName)
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serve(t, server.AuthModeHMAC, sign("wrong", now, "/records")))
+	assert.Equal(t, http.StatusUnauthorized, serve(t, server.AuthModeHMAC, sign("secret", now, "/adjustendpoints")))
+	assert.Equal(t, http.StatusUnauthorized, serve(t, server.AuthModeHMAC, sign("secret", now-3600, "/records")))
+	assert.Equal(t, http.StatusUnauthorized, serve(t, server.AuthModeHMAC, httptest.NewRequest(http.MethodPost, "/records", strings.NewReader(body))))
+
+	maxBodySize := server.MaxBodySize
+	t.Cleanup(func() { server.MaxBodySize = maxBodySize })
+	server.MaxBodySize = int64(len(body) - 1)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, serve(t, server.AuthModeHMAC, sign("secret", now, "/records")))
+}
@@ -0,0 +1,74 @@
+package server_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	tunnelprovider "github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthServer(t *testing.T) {
+	get := func(s *http.Server, path string) int {
+		w := httptest.NewRecorder()
+		s.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	opts := server.Options{HealthPort: 8080}
+	webhook, err := server.NewServer(&stubProvider{}, opts)
+	assert.NoError(t, err)
+	health := server.NewHealthServer(&stubProvider{}, opts)
+
+	assert.Equal(t, http.StatusOK, get(webhook, "/records"))
+	assert.Equal(t, http.StatusNotFound, get(webhook, "/healthz"))
+	assert.Equal(t, http.StatusNotFound, get(webhook, "/metrics"))
+
+	assert.Equal(t, http.StatusOK, get(health, "/healthz"))
+	assert.Equal(t, http.StatusOK, get(health, "/metrics"))
+	assert.Equal(t, http.StatusNotFound, get(health, "/records"))
+	assert.Equal(t, http.StatusNotFound, get(health, "/debug/pprof/"))
+
+	opts.DebugEnabled = true
+	health = server.NewHealthServer(&stubProvider{}, opts)
+	assert.Equal(t, http.StatusOK, get(health, "/debug/pprof/"))
+
+	opts.HealthPort = 0
+	webhook, err = server.NewServer(&stubProvider{}, opts)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, get(webhook, "/healthz"))
+	assert.Equal(t, http.StatusOK, get(webhook, "/metrics"))
+	assert.Equal(t, http.StatusOK, get(webhook, "/debug/pprof/"))
+}
+
+type stubReadyProvider struct {
+	stubProvider
+}
+
+func (p *stubReadyProvider) Ready(ctx context.Context) (*tunnelprovider.TunnelHealth, error) {
+	return &tunnelprovider.TunnelHealth{TunnelID: "tunnel123"}, nil
+}
+
+func TestHealthServer_Authentication(t *testing.T) {
+	webhook, err := server.NewServer(&stubReadyProvider{}, server.Options{
+		AuthMode:     server.AuthModeBearer,
+		AuthSecret:   func() string { return "secret" },
+		DebugEnabled: true,
+	})
+	assert.NoError(t, err)
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		webhook.Handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, get("/healthz"))
+	assert.Equal(t, http.StatusOK, get("/readyz"))
+	assert.Equal(t, http.StatusOK, get("/metrics"))
+	assert.Equal(t, http.StatusUnauthorized, get("/debug/pprof/"))
+	assert.Equal(t, http.StatusUnauthorized, get("/records"))
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// Listen listens on the unix socket if it is set, otherwise on the listen
+// address and port. A socket left behind by a previous process is replaced,
+// and the socket is removed when the server shuts down
+func Listen(opts Options) (net.Listener, error) {
+	if opts.UnixSocket == "" {
+		return listenTCP(opts.ListenAddress, opts.Port)
+	}
+
+	if err := removeStaleSocket(opts.UnixSocket); err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", opts.UnixSocket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", opts.UnixSocket, err)
+	}
+
+	if opts.UnixSocketMode != 0 {
+		if err := os.Chmod(opts.UnixSocket, opts.UnixSocketMode); err != nil {
+			_ = listener.Close()
+			return nil, fmt.Errorf("failed to set permissions of %s: %w", opts.UnixSocket, err)
+		}
+	}
+
+	return listener, nil
+}
+
+// ListenHealth listens on the health listen address and port
+func ListenHealth(opts Options) (net.Listener, error) {
+	return listenTCP(opts.HealthListenAddress, opts.HealthPort)
+}
+
+func listenTCP(host string, port int64) (net.Listener, error) {
+	address := net.JoinHostPort(host, strconv.FormatInt(port, 10))
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket if no process is listening on it
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Serve serves on the listener over tls if it is configured
+func Serve(server *http.Server, listener net.Listener) error {
+	if server.TLSConfig != nil {
+		return server.ServeTLS(listener, "", "")
+	}
+
+	return server.Serve(listener)
+}
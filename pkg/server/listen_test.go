@@ -0,0 +1,73 @@
+package server_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	opts := server.Options{
+		UnixSocket:     filepath.Join(t.TempDir(), "webhook.sock"),
+		UnixSocketMode: 0o600,
+	}
+
+	// left behind by a previous process
+	stale, err := net.Listen("unix", opts.UnixSocket)
+	assert.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	assert.NoError(t, stale.Close())
+
+	s, err := server.NewServer(&stubProvider{}, opts)
+	assert.NoError(t, err)
+
+	listener, err := server.Listen(opts)
+	assert.NoError(t, err)
+
+	_, err = server.Listen(opts)
+	assert.ErrorContains(t, err, "in use")
+
+	info, err := os.Stat(opts.UnixSocket)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+
+	go func() { _ = server.Serve(s, listener) }()
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", opts.UnixSocket)
+		},
+	}}
+
+	res, err := client.Get("http://webhook/healthz")
+	if assert.NoError(t, err) {
+		_ = res.Body.Close()
+		assert.Equal(t, http.StatusOK, res.StatusCode)
+	}
+
+	assert.NoError(t, s.Shutdown(context.Background()))
+	_, err = os.Stat(opts.UnixSocket)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestListenNotSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhook.sock")
+	assert.NoError(t, os.WriteFile(path, nil, 0o600))
+
+	_, err := server.Listen(server.Options{UnixSocket: path})
+	assert.ErrorContains(t, err, "not a socket")
+}
+
+func TestListenAddress(t *testing.T) {
+	listener, err := server.Listen(server.Options{ListenAddress: "127.0.0.1", Port: 0})
+	assert.NoError(t, err)
+	defer listener.Close()
+
+	assert.Equal(t, "127.0.0.1", listener.Addr().(*net.TCPAddr).IP.String())
+}
@@ -0,0 +1,73 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	tunnelprovider "github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/server"
+	"github.com/stretchr/testify/assert"
+)
+
+type stubMigrator struct {
+	stubProvider
+	running bool
+}
+
+func (m *stubMigrator) MigrateTunnel(ctx context.Context, target string) (*tunnelprovider.MigrationCheckpoint, error) {
+	if m.running {
+		return nil, tunnelprovider.ErrMigrationInProgress
+	}
+
+	m.running = true
+	return &tunnelprovider.MigrationCheckpoint{SourceTunnelID: "tunnel123", TargetTunnelID: target}, nil
+}
+
+func (m *stubMigrator) ResumeMigration(ctx context.Context) (*tunnelprovider.MigrationCheckpoint, error) {
+	return nil, tunnelprovider.ErrMigrationRolledBack
+}
+
+func (m *stubMigrator) RollbackMigration(ctx context.Context) (*tunnelprovider.MigrationCheckpoint, error) {
+	return &tunnelprovider.MigrationCheckpoint{SourceTunnelID: "tunnel123", TargetTunnelID: "tunnel456"}, nil
+}
+
+func (m *stubMigrator) MigrationStatus(ctx context.Context) (*tunnelprovider.MigrationCheckpoint, error) {
+	return &tunnelprovider.MigrationCheckpoint{SourceTunnelID: "tunnel123", TargetTunnelID: "tunnel456", Migrated: 1}, nil
+}
+
+func TestMigrationEndpoints(t *testing.T) {
+	s, err := server.NewServer(&stubMigrator{}, server.Options{MigrationEnabled: true})
+	assert.NoError(t, err)
+
+	serve := func(method, path string) (int, tunnelprovider.MigrationCheckpoint) {
+		w := httptest.NewRecorder()
+		s.Handler.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+
+		var checkpoint tunnelprovider.MigrationCheckpoint
+		_ = json.Unmarshal(w.Body.Bytes(), &checkpoint)
+		return w.Code, checkpoint
+	}
+
+	status, _ := serve(http.MethodPost, "/admin/migrate")
+	assert.Equal(t, http.StatusBadRequest, status)
+
+	status, checkpoint := serve(http.MethodPost, "/admin/migrate?target=tunnel456")
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, "tunnel456", checkpoint.TargetTunnelID)
+
+	status, _ = serve(http.MethodPost, "/admin/migrate?target=tunnel456")
+	assert.Equal(t, http.StatusConflict, status)
+
+	status, _ = serve(http.MethodPost, "/admin/migrate/resume")
+	assert.Equal(t, http.StatusConflict, status)
+
+	status, _ = serve(http.MethodPost, "/admin/migrate/rollback")
+	assert.Equal(t, http.StatusAccepted, status)
+
+	status, checkpoint = serve(http.MethodGet, "/admin/migrate")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, 1, checkpoint.Migrated)
+}
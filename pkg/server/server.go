@@ -1,13 +1,22 @@
 package server
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	tunnelprovider "github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/provider"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/log"
 	"sigs.k8s.io/external-dns/endpoint"
 	"sigs.k8s.io/external-dns/plan"
@@ -19,22 +28,160 @@ const (
 	externalDNSMediaType = "application/external.dns.webhook+json;version=1"
 )
 
-func NewServer(port int64, p provider.Provider, readTimeout, writeTimeout time.Duration) *http.Server {
+// RulesAnalyser is implemented by providers which can report shadowed ingress
+// rules
+type RulesAnalyser interface {
+	AnalyseRules(ctx context.Context) ([]tunnelprovider.Shadow, error)
+}
+
+// TunnelTokenSource is implemented by providers which can report the connector
+// token of the tunnel
+type TunnelTokenSource interface {
+	TunnelToken(ctx context.Context) (string, error)
+}
+
+// TunnelMigrator is implemented by providers which can move their hostnames to
+// another tunnel
+type TunnelMigrator interface {
+	MigrateTunnel(ctx context.Context, target string) (*tunnelprovider.MigrationCheckpoint, error)
+	ResumeMigration(ctx context.Context) (*tunnelprovider.MigrationCheckpoint, error)
+	RollbackMigration(ctx context.Context) (*tunnelprovider.MigrationCheckpoint, error)
+	MigrationStatus(ctx context.Context) (*tunnelprovider.MigrationCheckpoint, error)
+}
+
+// ReadinessChecker is implemented by providers which can report whether the
+// tunnel is ready to serve hostnames
+type ReadinessChecker interface {
+	Ready(ctx context.Context) (*tunnelprovider.TunnelHealth, error)
+}
+
+type Options struct {
+	// ListenAddress is the host or ip to listen on with the port, all
+	// interfaces if empty
+	ListenAddress string
+	Port          int64
+	// UnixSocket is the path of a unix socket to listen on instead, created
+	// with UnixSocketMode
+	UnixSocket     string
+	UnixSocketMode os.FileMode
+
+	// HealthPort serves the health check, readiness, metrics and debug
+	// endpoints on their own listener at HealthListenAddress, without
+	// authentication or tls, or with the webhook if it is 0
+	HealthListenAddress string
+	HealthPort          int64
+	// DebugEnabled serves pprof at /debug
+	DebugEnabled bool
+
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// TunnelTokenSecret returns the current secret, serving the tunnel token to
+	// requests bearing it is enabled if it is set on startup
+	TunnelTokenSecret func() string
+	// MigrationEnabled enables the tunnel migration admin endpoints
+	MigrationEnabled bool
+	// AuthMode is one of none, bearer or hmac, requests other than the health
+	// check must bear or be signed with the current AuthSecret
+	AuthMode   string
+	AuthSecret func() string
+	// TLSCertFile and TLSKeyFile enable tls, and TLSClientCAFile additionally
+	// requires requests other than the health check to present a client
+	// certificate signed by the ca. The files are reloaded when they change
+	TLSCertFile     string
+	TLSKeyFile      string
+	TLSClientCAFile string
+	// TLSMinVersion is one of 1.2 or 1.3, defaults to 1.2
+	TLSMinVersion string
+	// TLSCipherSuites are the names of the cipher suites of tls 1.2, defaults
+	// to those of the standard library
+	TLSCipherSuites []string
+}
+
+func NewServer(p provider.Provider, opts Options) (*http.Server, error) {
+	server := http.Server{
+		Addr:         net.JoinHostPort(opts.ListenAddress, strconv.FormatInt(opts.Port, 10)),
+		ReadTimeout:  opts.ReadTimeout,
+		WriteTimeout: opts.WriteTimeout,
+	}
+
+	if opts.TLSCertFile != "" {
+		config, err := tlsConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+
+		server.TLSConfig = config
+	}
+
 	mux := chi.NewMux()
 	mux.Use(middleware.RequestID)
 	mux.Use(middleware.RealIP)
 	mux.Use(middleware.Recoverer)
+	mux.Use(traceRequests)
+	// the health endpoints are not authenticated, so probes and scrapes work
+	// whichever listener serves them
+	if opts.HealthPort == 0 {
+		mux.Use(middleware.Heartbeat("/healthz"))
+		mountHealth(mux, p)
+	}
+
+	mux.Group(func(mux chi.Router) {
+		// the tunnel token has its own secret
+		mux.Use(authenticate(opts.AuthMode, opts.AuthSecret, opts.TLSClientCAFile != "", "/tunnel/token"))
+		if opts.HealthPort == 0 && opts.DebugEnabled {
+			mux.Mount("/debug", middleware.Profiler())
+		}
+
+		mux.Get("/", handleNegotiation(p))
+		mux.Get("/records", handleGetRecords(p))
+		mux.Post("/records", handleApplyChanges(p))
+		mux.Post("/adjustendpoints", handleAdjustEndpoints(p))
+
+		if a, ok := p.(RulesAnalyser); ok {
+			mux.Get("/admin/rules/shadowed", handleShadowedRules(a))
+		}
+
+		if t, ok := p.(TunnelTokenSource); ok && opts.TunnelTokenSecret != nil && opts.TunnelTokenSecret() != "" {
+			mux.Get("/tunnel/token", handleTunnelToken(t, opts.TunnelTokenSecret))
+		}
+
+		if m, ok := p.(TunnelMigrator); ok && opts.MigrationEnabled {
+			mux.Get("/admin/migrate", handleMigration("handleMigrationStatus", http.StatusOK, m.MigrationStatus))
+			mux.Post("/admin/migrate", handleMigrateTunnel(m))
+			mux.Post("/admin/migrate/resume", handleMigration("handleResumeMigration", http.StatusAccepted, m.ResumeMigration))
+			mux.Post("/admin/migrate/rollback", handleMigration("handleRollbackMigration", http.StatusAccepted, m.RollbackMigration))
+		}
+	})
+
+	server.Handler = mux
+	return &server, nil
+}
+
+// NewHealthServer serves the health check, readiness, metrics and debug
+// endpoints apart from the webhook, if the health port is set
+func NewHealthServer(p provider.Provider, opts Options) *http.Server {
+	mux := chi.NewMux()
+	mux.Use(middleware.Recoverer)
 	mux.Use(middleware.Heartbeat("/healthz"))
-	mux.Get("/", handleNegotiation(p))
-	mux.Get("/records", handleGetRecords(p))
-	mux.Post("/records", handleApplyChanges(p))
-	mux.Post("/adjustendpoints", handleAdjustEndpoints(p))
+	mountHealth(mux, p)
+	if opts.DebugEnabled {
+		mux.Mount("/debug", middleware.Profiler())
+	}
 
+	// profiles take longer than the write timeout of the webhook
 	return &http.Server{
-		Handler:      mux,
-		Addr:         fmt.Sprintf(":%d", port),
-		ReadTimeout:  readTimeout,
-		WriteTimeout: writeTimeout,
+		Handler:     mux,
+		Addr:        net.JoinHostPort(opts.HealthListenAddress, strconv.FormatInt(opts.HealthPort, 10)),
+		ReadTimeout: opts.ReadTimeout,
+	}
+}
+
+// mountHealth mounts the readiness and metrics endpoints
+func mountHealth(mux chi.Router, p provider.Provider) {
+	mux.Handle("/metrics", promhttp.Handler())
+
+	if c, ok := p.(ReadinessChecker); ok {
+		mux.Get("/readyz", handleReadiness(c))
 	}
 }
 
@@ -151,3 +298,153 @@ func handleAdjustEndpoints(p provider.Provider) http.HandlerFunc {
 		_, _ = w.Write(raw)
 	}
 }
+
+func handleShadowedRules(a RulesAnalyser) http.HandlerFunc {
+	log := log.With().Str("action", "handleShadowedRules").Logger()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		shadows, err := a.AnalyseRules(r.Context())
+		if err != nil {
+			err = fmt.Errorf("failed to analyse rules: %w", err)
+			log.Error().Err(err).Send()
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+			return
+		}
+
+		raw, err := json.Marshal(shadows)
+		if err != nil {
+			err = fmt.Errorf("failed to marshal shadowed rules to json: %w", err)
+			log.Error().Err(err).Send()
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+			return
+		}
+
+		log.Debug().RawJSON("shadowed_rules", raw).Send()
+		w.Header().Set(contentTypeHeader, "application/json")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(raw)
+	}
+}
+
+func handleTunnelToken(t TunnelTokenSource, secret func() string) http.HandlerFunc {
+	log := log.With().Str("action", "handleTunnelToken").Logger()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		bearer, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		expected := secret()
+		if expected == "" || subtle.ConstantTimeCompare([]byte(bearer), []byte(expected)) != 1 {
+			log.Warn().Str("remote_addr", r.RemoteAddr).Msg("unauthorised tunnel token request")
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(http.StatusText(http.StatusUnauthorized)))
+			return
+		}
+
+		token, err := t.TunnelToken(r.Context())
+		if err != nil {
+			err = fmt.Errorf("failed to get tunnel token: %w", err)
+			log.Error().Err(err).Send()
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+			return
+		}
+
+		w.Header().Set(contentTypeHeader, "text/plain")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte(token))
+	}
+}
+
+func handleMigrateTunnel(m TunnelMigrator) http.HandlerFunc {
+	log := log.With().Str("action", "handleMigrateTunnel").Logger()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			log.Error().Err(fmt.Errorf("target tunnel is required")).Send()
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(http.StatusText(http.StatusBadRequest)))
+			return
+		}
+
+		migrate := func(ctx context.Context) (*tunnelprovider.MigrationCheckpoint, error) {
+			return m.MigrateTunnel(ctx, target)
+		}
+
+		handleMigration("handleMigrateTunnel", http.StatusAccepted, migrate)(w, r)
+	}
+}
+
+// handleMigration responds with the checkpoint returned by run. Migrations run
+// in the background, so clients poll GET /admin/migrate for their progress
+func handleMigration(action string, success int, run func(ctx context.Context) (*tunnelprovider.MigrationCheckpoint, error)) http.HandlerFunc {
+	log := log.With().Str("action", action).Logger()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		checkpoint, err := run(r.Context())
+		if err != nil {
+			status := http.StatusInternalServerError
+			switch {
+			case errors.Is(err, tunnelprovider.ErrMigrationInProgress), errors.Is(err, tunnelprovider.ErrMigrationRolledBack):
+				status = http.StatusConflict
+			case errors.Is(err, os.ErrNotExist):
+				status = http.StatusNotFound
+			}
+
+			err = fmt.Errorf("failed to migrate tunnel: %w", err)
+			log.Error().Err(err).Any("checkpoint", checkpoint).Send()
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(http.StatusText(status)))
+			return
+		}
+
+		raw, err := json.Marshal(checkpoint)
+		if err != nil {
+			err = fmt.Errorf("failed to marshal migration checkpoint to json: %w", err)
+			log.Error().Err(err).Send()
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+			return
+		}
+
+		log.Debug().RawJSON("checkpoint", raw).Send()
+		w.Header().Set(contentTypeHeader, "application/json")
+		w.WriteHeader(success)
+		_, _ = w.Write(raw)
+	}
+}
+
+type readinessResponse struct {
+	Ready  bool                         `json:"ready"`
+	Error  string                       `json:"error,omitempty"`
+	Tunnel *tunnelprovider.TunnelHealth `json:"tunnel,omitempty"`
+}
+
+func handleReadiness(c ReadinessChecker) http.HandlerFunc {
+	log := log.With().Str("action", "handleReadiness").Logger()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		health, err := c.Ready(r.Context())
+		response := readinessResponse{Ready: err == nil, Tunnel: health}
+		if err != nil {
+			log.Warn().Err(err).Msg("not ready")
+			status = http.StatusServiceUnavailable
+			response.Error = err.Error()
+		}
+
+		raw, err := json.Marshal(response)
+		if err != nil {
+			err = fmt.Errorf("failed to marshal readiness to json: %w", err)
+			log.Error().Err(err).Send()
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(http.StatusText(http.StatusInternalServerError)))
+			return
+		}
+
+		w.Header().Set(contentTypeHeader, "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write(raw)
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// CipherSuites parses the names of the cipher suites, only the suites
+// considered secure by the standard library are allowed
+func CipherSuites(names []string) ([]uint16, error) {
+	suites := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+
+	ids := []uint16{}
+	for _, name := range names {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %s", name)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// certificates holds the certificate of the server and the ca of the client
+// certificates, loading them again when any of the files change
+type certificates struct {
+	certFile, keyFile, clientCAFile string
+
+	mu          sync.Mutex
+	modified    []time.Time
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+func (c *certificates) files() []string {
+	files := []string{c.certFile, c.keyFile}
+	if c.clientCAFile != "" {
+		files = append(files, c.clientCAFile)
+	}
+
+	return files
+}
+
+// load reads the files if they have been modified since they were last read
+func (c *certificates) load() error {
+	modified := []time.Time{}
+	for _, file := range c.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+
+		modified = append(modified, info.ModTime())
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.certificate != nil && slices.EqualFunc(modified, c.modified, time.Time.Equal) {
+		return nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load tls certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if c.clientCAFile != "" {
+		raw, err := os.ReadFile(c.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client ca: %w", err)
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(raw) {
+			return fmt.Errorf("failed to parse client ca %s", c.clientCAFile)
+		}
+	}
+
+	if c.certificate != nil {
+		log.Info().Strs("files", c.files()).Msg("reloaded tls certificates")
+	}
+
+	c.modified = modified
+	c.certificate = &certificate
+	c.clientCAs = clientCAs
+	return nil
+}
+
+// configFor returns the config of the handshake with the current
+// certificates, keeping the previous certificates if they fail to load
+func (c *certificates) configFor(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		if err := c.load(); err != nil {
+			log.Error().Err(err).Msg("keeping the current tls certificates")
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		config := base.Clone()
+		config.Certificates = []tls.Certificate{*c.certificate}
+		if c.clientCAs != nil {
+			// certificates are verified if given, the middleware requires them on
+			// every route but the health check
+			config.ClientCAs = c.clientCAs
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+
+		return config, nil
+	}
+}
+
+// tlsConfig loads the certificate of the server and, if set, the ca which
+// client certificates must be signed by, both are reloaded when they change
+func tlsConfig(opts Options) (*tls.Config, error) {
+	minVersion := uint16(tls.VersionTLS12)
+	if opts.TLSMinVersion != "" {
+		version, ok := tlsVersions[opts.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unsupported tls version %s", opts.TLSMinVersion)
+		}
+
+		minVersion = version
+	}
+
+	suites, err := CipherSuites(opts.TLSCipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	certs := certificates{certFile: opts.TLSCertFile, keyFile: opts.TLSKeyFile, clientCAFile: opts.TLSClientCAFile}
+	if err := certs.load(); err != nil {
+		return nil, err
+	}
+
+	base := tls.Config{MinVersion: minVersion}
+	if len(suites) > 0 {
+		base.CipherSuites = suites
+	}
+
+	config := base.Clone()
+	config.GetConfigForClient = certs.configFor(&base)
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		config, err := config.GetConfigForClient(hello)
+		if err != nil {
+			return nil, err
+		}
+
+		return &config.Certificates[0], nil
+	}
+
+	return config, nil
+}
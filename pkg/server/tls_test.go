@@ -0,0 +1,95 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/server"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeCertificate(t *testing.T, dir string, serial int64, modified time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	for name, block := range map[string]*pem.Block{
+		"tls.crt": {Type: "CERTIFICATE", Bytes: der},
+		"tls.key": {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(block), 0o600))
+		assert.NoError(t, os.Chtimes(path, modified, modified))
+	}
+}
+
+func TestTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir, 1, time.Now().Add(-time.Minute))
+
+	s, err := server.NewServer(&stubProvider{}, server.Options{
+		TLSCertFile:   filepath.Join(dir, "tls.crt"),
+		TLSKeyFile:    filepath.Join(dir, "tls.key"),
+		TLSMinVersion: "1.3",
+	})
+	assert.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	go func() { _ = s.ServeTLS(listener, "", "") }()
+	defer s.Close()
+
+	serial := func(version uint16) (int64, error) {
+		conn, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true, MaxVersion: version})
+		if err != nil {
+			return 0, err
+		}
+
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64(), nil
+	}
+
+	got, err := serial(tls.VersionTLS13)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), got)
+
+	_, err = serial(tls.VersionTLS12)
+	assert.Error(t, err)
+
+	writeCertificate(t, dir, 2, time.Now())
+	got, err = serial(tls.VersionTLS13)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), got)
+}
+
+func TestCipherSuites(t *testing.T) {
+	suites, err := server.CipherSuites([]string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"})
+	assert.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}, suites)
+
+	_, err = server.CipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"})
+	assert.Error(t, err)
+}
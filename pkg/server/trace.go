@@ -0,0 +1,33 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/tracing"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// traceRequests records a span for each request named by its route
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, span := tracing.StartRequest(r)
+		defer span.End()
+
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r.WithContext(ctx))
+
+		if route := chi.RouteContext(r.Context()).RoutePattern(); route != "" {
+			span.SetName(fmt.Sprintf("%s %s", r.Method, route))
+			span.SetAttributes(attribute.String("http.route", route))
+		}
+
+		span.SetAttributes(attribute.Int("http.response.status_code", ww.Status()))
+		if ww.Status() >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(ww.Status()))
+		}
+	})
+}
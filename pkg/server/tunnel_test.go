@@ -0,0 +1,67 @@
+package server_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/axatol/external-dns-cloudflare-tunnel-webhook/pkg/server"
+	"github.com/stretchr/testify/assert"
+)
+
+type tokenProvider struct {
+	stubProvider
+}
+
+func (p *tokenProvider) TunnelToken(ctx context.Context) (string, error) {
+	return "token123", nil
+}
+
+func TestTunnelToken(t *testing.T) {
+	secret := "secret"
+	get := func(opts server.Options, bearer string) (int, string) {
+		s, err := server.NewServer(&tokenProvider{}, opts)
+		assert.NoError(t, err)
+
+		r := httptest.NewRequest(http.MethodGet, "/tunnel/token", nil)
+		if bearer != "" {
+			r.Header.Set("Authorization", "Bearer "+bearer)
+		}
+
+		w := httptest.NewRecorder()
+		s.Handler.ServeHTTP(w, r)
+		return w.Code, w.Body.String()
+	}
+
+	code, _ := get(server.Options{}, "secret")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	opts := server.Options{TunnelTokenSecret: func() string { return secret }}
+	code, _ = get(opts, "")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = get(opts, "wrong")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, body := get(opts, "secret")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "token123", body)
+
+	// the tunnel token secret is checked instead of the webhook secret
+	opts.AuthMode = server.AuthModeBearer
+	opts.AuthSecret = func() string { return "webhook" }
+	code, _ = get(opts, "secret")
+	assert.Equal(t, http.StatusOK, code)
+
+	code, _ = get(opts, "webhook")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// a reloaded secret takes effect without a restart
+	secret = "rotated"
+	code, _ = get(opts, "secret")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	code, _ = get(opts, "rotated")
+	assert.Equal(t, http.StatusOK, code)
+}